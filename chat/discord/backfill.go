@@ -0,0 +1,70 @@
+package discord
+
+import (
+	"chatroom/conf"
+	"chatroom/model"
+	"chatroom/store"
+	"chatroom/utils"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+const cursorBucket = "cursor"
+
+// cursor returns the id of the last message seen in the channel.
+func (a *App) cursor(channelID string) string {
+	var messageID string
+	store.Get(cursorBucket, fmt.Sprintf("%s:%s", model.DiscordType, channelID), &messageID)
+	return messageID
+}
+
+// advance moves the cursor of the channel forward, snowflake ids grow with time.
+func (a *App) advance(channelID, messageID string) {
+	a.cursorLock.Lock()
+	defer a.cursorLock.Unlock()
+	id, _ := strconv.ParseUint(messageID, 10, 64)
+	cur, _ := strconv.ParseUint(a.cursor(channelID), 10, 64)
+	if id <= cur {
+		return
+	}
+	if err := store.Put(cursorBucket, fmt.Sprintf("%s:%s", model.DiscordType, channelID), messageID); err != nil {
+		a.log.Printf("failed to save cursor of channel %s: %v", channelID, err)
+	}
+}
+
+// track advances the cursor of the channel once the rooms consumed the message, the ids of a thread are
+// not ordered with the channel.
+func (a *App) track(msg *model.DiscordMessage) {
+	if (msg.Type == model.MessageTypeTextCreate || msg.Type == model.MessageTypeTextReply) && !msg.Thread {
+		channelID, messageID := msg.Channel.CID(), msg.ID
+		msg.OnAck(func() { a.advance(channelID, messageID) })
+	}
+}
+
+// backfill replays the messages posted after the cursor, the rooms skip the ones already bridged. The caller holds
+// the intake of the channel, the live events received meanwhile are queued after the history.
+func (a *App) backfill(channelID, since string) {
+	var history []model.IChatMessage
+	defer func() { a.intake.Release(channelID, history...) }()
+	limit := utils.Default(conf.Conf.Backfill.Limit, func(v int) bool { return v != 0 }, 100)
+	if len(since) == 0 || limit < 0 {
+		return
+	}
+	maxAge := utils.Default(conf.Conf.Backfill.MaxAge, func(v time.Duration) bool { return v > 0 }, 24*time.Hour)
+	oldest := time.Now().Add(-maxAge)
+	if t, err := discordgo.SnowflakeTimestamp(since); err == nil && t.Before(oldest) {
+		// 按时间构造的 snowflake
+		since = strconv.FormatUint(uint64(oldest.UnixMilli()-1420070400000)<<22, 10)
+	}
+	messages := a.HistoryMessage(channelID, since, limit)
+	a.log.Printf("backfill %d messages of channel %s since %s", len(messages), channelID, since)
+	for _, m := range messages {
+		if dm := a.createMessage(m); dm != nil {
+			a.track(dm)
+			history = append(history, dm)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package discord
+
+import (
+	"chatroom/model"
+	"chatroom/utils"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// registerCommand registers the /bridge application command, it runs as the text command "!bridge".
+func (a *App) registerCommand() {
+	_, err := a.cli.ApplicationCommandCreate(a.cli.State.User.ID, "", &discordgo.ApplicationCommand{
+		Name:        "bridge",
+		Description: "Run a bridge command",
+		Options: []*discordgo.ApplicationCommandOption{{
+			Type:        discordgo.ApplicationCommandOptionString,
+			Name:        "command",
+			Description: "status, who, pause, resume or help",
+		}},
+	})
+	if err != nil {
+		a.log.Printf("failed to register application command: %v", err)
+	}
+}
+
+// interaction acks the /bridge command and queues it to the rooms of the channel, the rooms reply in the channel.
+func (a *App) interaction(i *discordgo.InteractionCreate) {
+	if i.Type != discordgo.InteractionApplicationCommand || i.ApplicationCommandData().Name != "bridge" {
+		return
+	}
+	var args string
+	for _, option := range i.ApplicationCommandData().Options {
+		if option.Name == "command" {
+			args = option.StringValue()
+		}
+	}
+	text := model.CommandText(args)
+	if err := a.cli.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{Content: text, Flags: discordgo.MessageFlagsEphemeral},
+	}); err != nil {
+		a.log.Printf("failed to respond interaction: %v", err)
+	}
+	user := i.User
+	if i.Member != nil {
+		user = i.Member.User
+	}
+	if user == nil {
+		return
+	}
+	userInfo := model.User{ID: user.ID, Name: user.Username, DisplayName: user.Username, BotID: utils.IfElse(user.Bot, user.ID, "")}
+	channelID := a.threadMessage(i.ChannelID, i.ID)
+	a.ReceiveMessage(&model.DiscordMessage{
+		Type: model.MessageTypeTextCreate,
+		Channel: utils.Default(a.GetChannelInfo(channelID), func(v *model.ChannelInfo) bool {
+			return v != nil
+		}, model.NewChannelInfo(channelID)),
+		User:       &userInfo,
+		Message:    text,
+		RawMessage: text,
+	})
+}
@@ -4,12 +4,16 @@ import (
 	"chatroom/conf"
 	"chatroom/model"
 	"chatroom/utils"
+	"chatroom/utils/queue"
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"os"
 	"strings"
 	"sync"
+	"sync/atomic"
 
 	"github.com/bwmarrin/discordgo"
 )
@@ -18,16 +22,27 @@ type App struct {
 	cli         *discordgo.Session
 	Users       map[string]*model.User
 	ChannelInfo map[string]*model.ChannelInfo
-	lock        sync.RWMutex
+	// threads 子区所属的频道, 空字符串表示不是子区
+	threads map[string]string
+	// pins 频道和子区的置顶消息, 用于比较置顶的变化
+	pins map[string][]string
+	// messageThread 子区内消息所在的子区
+	messageThread map[string]string
+	lock          sync.RWMutex
 
 	SubscriptMessage map[string][]chan model.IChatMessage
 	substrateLock    sync.RWMutex
+	cursorLock       sync.Mutex
+	intake           *queue.Serial[model.IChatMessage]
 
-	log *log.Logger
+	online atomic.Bool
+	log    *log.Logger
 }
 
 var app *App
 
+const maxMessageThread = 10000
+
 func NewClient(_ context.Context, conf conf.Discord) {
 	if len(conf.Token) == 0 {
 		return
@@ -35,17 +50,70 @@ func NewClient(_ context.Context, conf conf.Discord) {
 	app = new(App)
 	app.log = log.New(os.Stdout, "Discord: ", log.Lshortfile|log.Ldate|log.Ltime)
 	app.cli, _ = discordgo.New("Bot " + conf.Token)
+	// 按顺序处理事件, 同一频道的创建和编辑不会乱序
+	app.cli.SyncEvents = true
 	app.SubscriptMessage = make(map[string][]chan model.IChatMessage)
 	app.Users = make(map[string]*model.User)
 	app.ChannelInfo = make(map[string]*model.ChannelInfo)
+	app.threads = make(map[string]string)
+	app.messageThread = make(map[string]string)
+	app.pins = make(map[string][]string)
 	//app.cli.Identify.Intents = 395137247296
+	app.cli.Identify.Intents |= discordgo.IntentGuildMessagePolls
+	if conf.MemberEvents {
+		app.cli.Identify.Intents |= discordgo.IntentsGuildMembers
+	}
 	if err := app.cli.Open(); err != nil {
 		app.log.Fatalf("Cannot open the session: %v\n", err)
 	}
+	app.online.Store(true)
 	app.init()
 }
 
+// Connected reports whether the gateway connection is up.
+func Connected() bool {
+	return app != nil && app.online.Load()
+}
+
+// Refresh drops the cached users and channels and loads them again.
+func Refresh() {
+	if app == nil {
+		return
+	}
+	app.lock.Lock()
+	app.Users = make(map[string]*model.User)
+	app.ChannelInfo = make(map[string]*model.ChannelInfo)
+	app.lock.Unlock()
+	app.syncInfo()
+}
+
+// StopIntake stops queuing the platform events, the events already queued still reach the rooms.
+func StopIntake() {
+	if app == nil || app.intake == nil {
+		return
+	}
+	app.intake.Stop()
+}
+
+// Close closes the gateway connection.
+func Close() {
+	if app == nil {
+		return
+	}
+	if err := app.cli.Close(); err != nil {
+		app.log.Printf("failed to close session: %v", err)
+	}
+}
+
 func (a *App) init() {
+	a.intake = queue.NewSerial(conf.Conf.Receive.QueueSize, a.publish)
+	a.syncInfo()
+	a.handler()
+	a.registerCommand()
+}
+
+// syncInfo loads the bridged channels and their members into the cache.
+func (a *App) syncInfo() {
 	channelIDs := conf.Conf.GetDiscordChat()
 	var userIds []string
 	for _, info := range a.GetChannelsInfo(channelIDs...) {
@@ -55,25 +123,42 @@ func (a *App) init() {
 	userIds = utils.Unique(userIds)
 	a.log.Printf("sync discord users: %v\n", userIds)
 	a.GetUsersInfo(userIds...)
-	a.handler()
+	for _, channelID := range channelIDs {
+		if _, err := a.pinned(channelID); err != nil {
+			a.log.Printf("failed to get pinned messages of %s: %v", channelID, err)
+		}
+	}
 }
 
 func (a *App) handler() {
 	a.cli.AddHandler(func(_ *discordgo.Session, _ *discordgo.Ready) {
 		a.log.Println("Discord Bot is up!")
+		a.online.Store(true)
+		// 首次连接的 Ready 在注册 handler 之前, 这里只有重连, 补齐断线期间的消息
+		for _, channelID := range a.channels() {
+			a.intake.Hold(channelID)
+			go a.backfill(channelID, a.cursor(channelID))
+		}
 	})
 	a.cli.AddHandler(func(_ *discordgo.Session, _ *discordgo.Disconnect) {
 		a.log.Println("Discord Disconnection")
+		a.online.Store(false)
 	})
 	a.cli.AddHandler(func(_ *discordgo.Session, _ *discordgo.Resumed) {
 		a.log.Println("Discord connection Resumed")
+		a.online.Store(true)
 	})
-	a.cli.AddHandler(func(_ *discordgo.Session, _ *discordgo.InteractionCreate) {
+	a.cli.AddHandler(func(_ *discordgo.Session, i *discordgo.InteractionCreate) {
 		a.log.Println("InteractionCreate")
+		a.interaction(i)
 	})
 	a.handlerMessageEvent()
 	a.handlerMessageReaction()
 	a.handlerThread()
+	a.handlerMember()
+	a.handlerTyping()
+	a.handlerPin()
+	a.handlerPoll()
 }
 
 func (a *App) handlerMessageReaction() {
@@ -83,12 +168,13 @@ func (a *App) handlerMessageReaction() {
 		}
 		d, _ := json.Marshal(msg)
 		a.log.Println("reaction add", string(d))
+		channelID := a.threadMessage(msg.ChannelID, msg.MessageID)
 		dm := &model.DiscordMessage{
 			ID:   msg.MessageID,
 			Type: model.MessageTypeActionAdd,
-			Channel: utils.Default(a.GetChannelInfo(msg.ChannelID), func(v *model.ChannelInfo) bool {
+			Channel: utils.Default(a.GetChannelInfo(channelID), func(v *model.ChannelInfo) bool {
 				return v != nil
-			}, model.NewChannelInfo(msg.ChannelID)),
+			}, model.NewChannelInfo(channelID)),
 			EmojiData: &model.DiscordMessageEmoji{ID: msg.Emoji.ID, Name: msg.Emoji.Name},
 		}
 
@@ -101,7 +187,7 @@ func (a *App) handlerMessageReaction() {
 				return v != nil
 			}, model.NewUserInfo(msg.UserID))
 		}
-		go a.ReceiveMessage(dm)
+		a.ReceiveMessage(dm)
 	})
 	a.cli.AddHandler(func(s *discordgo.Session, msg *discordgo.MessageReactionRemoveAll) {
 		if msg.UserID == s.State.User.ID {
@@ -109,14 +195,15 @@ func (a *App) handlerMessageReaction() {
 		}
 		d, _ := json.Marshal(msg)
 		a.log.Println("reaction remove all", string(d))
+		channelID := a.threadMessage(msg.ChannelID, msg.MessageID)
 		dm := &model.DiscordMessage{
 			ID:   msg.MessageID,
 			Type: model.MessageTypeActionRemoveALL,
-			Channel: utils.Default(a.GetChannelInfo(msg.ChannelID), func(v *model.ChannelInfo) bool {
+			Channel: utils.Default(a.GetChannelInfo(channelID), func(v *model.ChannelInfo) bool {
 				return v != nil
-			}, model.NewChannelInfo(msg.ChannelID)),
+			}, model.NewChannelInfo(channelID)),
 		}
-		go a.ReceiveMessage(dm)
+		a.ReceiveMessage(dm)
 	})
 	a.cli.AddHandler(func(s *discordgo.Session, msg *discordgo.MessageReactionRemove) {
 		if msg.UserID == s.State.User.ID {
@@ -124,48 +211,58 @@ func (a *App) handlerMessageReaction() {
 		}
 		d, _ := json.Marshal(msg)
 		a.log.Println("reaction remove", string(d))
+		channelID := a.threadMessage(msg.ChannelID, msg.MessageID)
 		dm := &model.DiscordMessage{
 			ID:   msg.MessageID,
 			Type: model.MessageTypeActionRemove,
-			Channel: utils.Default(a.GetChannelInfo(msg.ChannelID), func(v *model.ChannelInfo) bool {
+			Channel: utils.Default(a.GetChannelInfo(channelID), func(v *model.ChannelInfo) bool {
 				return v != nil
-			}, model.NewChannelInfo(msg.ChannelID)),
+			}, model.NewChannelInfo(channelID)),
+			// 投票的表情按用户计数
+			User: utils.Default(a.GetUserInfo(msg.UserID), func(v *model.User) bool {
+				return v != nil
+			}, model.NewUserInfo(msg.UserID)),
 			EmojiData: &model.DiscordMessageEmoji{ID: msg.Emoji.ID, Name: msg.Emoji.Name},
 		}
-		go a.ReceiveMessage(dm)
+		a.ReceiveMessage(dm)
 	})
 }
 
 func (a *App) handlerMessageEvent() {
 	a.cli.AddHandler(func(s *discordgo.Session, msg *discordgo.MessageDelete) {
-		// 过滤自己
-		//if msg.Author.ID == s.State.User.ID {
-		//	return
-		//}
+		// 过滤自己, 删除事件只有缓存中的消息才有作者
+		if msg.BeforeDelete != nil && msg.BeforeDelete.Author != nil && msg.BeforeDelete.Author.ID == s.State.User.ID {
+			return
+		}
+		channelID := a.threadMessage(msg.ChannelID, msg.Message.ID)
 		dm := model.DiscordMessage{
 			ID:   msg.Message.ID,
 			Type: model.MessageTypeTextDelete,
-			Channel: utils.Default(a.GetChannelInfo(msg.ChannelID), func(v *model.ChannelInfo) bool {
+			Channel: utils.Default(a.GetChannelInfo(channelID), func(v *model.ChannelInfo) bool {
 				return v != nil
-			}, model.NewChannelInfo(msg.ChannelID)),
+			}, model.NewChannelInfo(channelID)),
 		}
-		go a.ReceiveMessage(&dm)
+		a.ReceiveMessage(&dm)
 	})
 	a.cli.AddHandler(func(s *discordgo.Session, msg *discordgo.MessageUpdate) {
 		// 过滤自己
 		if msg.Author == nil || msg.Author.ID == s.State.User.ID {
 			return
 		}
+		if msg.Poll != nil {
+			return // 投票结果的变化, 票数由投票事件桥接
+		}
 		d, _ := json.Marshal(msg)
 		a.log.Println("message update", string(d))
-		userInfo := model.User{ID: msg.Author.ID, Name: msg.Author.Username, DisplayName: msg.Author.Username}
+		userInfo := model.User{ID: msg.Author.ID, Name: msg.Author.Username, DisplayName: msg.Author.Username, BotID: utils.IfElse(msg.Author.Bot, msg.Author.ID, "")}
 		a.SetUserInfo(userInfo)
+		channelID := a.threadMessage(msg.ChannelID, msg.Message.ID)
 		dm := model.DiscordMessage{
 			ID:   msg.Message.ID,
 			Type: model.MessageTypeTextUpdate,
-			Channel: utils.Default(a.GetChannelInfo(msg.ChannelID), func(v *model.ChannelInfo) bool {
+			Channel: utils.Default(a.GetChannelInfo(channelID), func(v *model.ChannelInfo) bool {
 				return v != nil
-			}, model.NewChannelInfo(msg.ChannelID)),
+			}, model.NewChannelInfo(channelID)),
 			User:     &userInfo,
 			SendTime: msg.Timestamp.UnixNano(),
 		}
@@ -175,72 +272,233 @@ func (a *App) handlerMessageEvent() {
 		} else {
 			dm.Message = text
 		}
-		for _, attachment := range msg.Attachments {
-			dm.Attachments = append(dm.Attachments, model.Attachment{
-				Type: attachment.ContentType,
-				URL:  attachment.URL,
-			})
-		}
-		go a.ReceiveMessage(&dm)
+		dm.Mentioned = a.mentions(msg.Message)
+		dm.Attachments = attachments(msg.Message)
+		a.ReceiveMessage(&dm)
 	})
-	a.cli.AddHandler(func(s *discordgo.Session, msg *discordgo.MessageCreate) {
-		// 过滤自己
-		if msg.Author == nil || msg.Author.ID == s.State.User.ID {
-			return
-		}
-		d, _ := json.Marshal(msg)
-		a.log.Println("receive message,", string(d))
-		userInfo := model.User{ID: msg.Author.ID, Name: msg.Author.Username, DisplayName: msg.Author.Username}
-		a.SetUserInfo(userInfo)
-		dm := &model.DiscordMessage{
-			ID:   msg.ID,
-			Type: model.MessageTypeTextCreate,
-			Channel: utils.Default(a.GetChannelInfo(msg.ChannelID), func(v *model.ChannelInfo) bool {
-				return v != nil
-			}, model.NewChannelInfo(msg.ChannelID)),
-			User:     &userInfo,
-			SendTime: msg.Timestamp.UnixNano(),
+	a.cli.AddHandler(func(_ *discordgo.Session, msg *discordgo.MessageCreate) {
+		a.messageCreate(msg.Message)
+	})
+}
+
+func (a *App) messageCreate(msg *discordgo.Message) {
+	if a.receivePoll(msg) {
+		return
+	}
+	if dm := a.createMessage(msg); dm != nil {
+		a.ReceiveMessage(dm)
+	}
+}
+
+// createMessage converts a new message, it returns nil for the messages which are not bridged.
+func (a *App) createMessage(msg *discordgo.Message) *model.DiscordMessage {
+	// 过滤自己
+	if msg.Author == nil || msg.Author.ID == a.cli.State.User.ID {
+		return nil
+	}
+	if msg.Type == discordgo.MessageTypeThreadCreated || msg.Type == discordgo.MessageTypeThreadStarterMessage {
+		return nil // 子区创建的系统消息
+	}
+	if msg.Type == discordgo.MessageTypeChannelPinnedMessage {
+		return nil // 置顶的系统消息, 由 ChannelPinsUpdate 桥接
+	}
+	if msg.Poll != nil {
+		return nil // 投票由 receivePoll 桥接, 补齐历史时不重放
+	}
+	d, _ := json.Marshal(msg)
+	a.log.Println("receive message,", string(d))
+	userInfo := model.User{ID: msg.Author.ID, Name: msg.Author.Username, DisplayName: msg.Author.Username, BotID: utils.IfElse(msg.Author.Bot, msg.Author.ID, "")}
+	a.SetUserInfo(userInfo)
+	channelID := a.threadMessage(msg.ChannelID, msg.ID)
+	dm := &model.DiscordMessage{
+		ID:   msg.ID,
+		Type: model.MessageTypeTextCreate,
+		Channel: utils.Default(a.GetChannelInfo(channelID), func(v *model.ChannelInfo) bool {
+			return v != nil
+		}, model.NewChannelInfo(channelID)),
+		User:     &userInfo,
+		SendTime: msg.Timestamp.UnixNano(),
+	}
+	dm.RawMessage = msg.Content
+	if text, err := msg.ContentWithMoreMentionsReplaced(a.cli); err != nil {
+		dm.Message = msg.ContentWithMentionsReplaced()
+	} else {
+		dm.Message = text
+	}
+	dm.Mentioned = a.mentions(msg)
+	dm.Attachments = attachments(msg)
+	if msg.MessageReference != nil && msg.Type == discordgo.MessageTypeReply {
+		// 回复消息
+		dm.Type = model.MessageTypeTextReply
+		dm.ParentID = msg.MessageReference.MessageID
+	}
+	if channelID != msg.ChannelID {
+		// 子区消息回复子区的起始消息, 子区 ID 与起始消息 ID 相同; 子区内的回复保留回复的消息
+		dm.Type = model.MessageTypeTextReply
+		dm.ParentID = utils.Default(dm.ParentID, func(v string) bool { return len(v) != 0 }, msg.ChannelID)
+		dm.Thread = true
+	}
+	return dm
+}
+
+func (a *App) handlerThread() {
+	a.cli.AddHandler(func(_ *discordgo.Session, c *discordgo.ThreadCreate) {
+		a.log.Printf("thread create: %s parent: %s", c.ID, c.ParentID)
+		a.SetThread(c.ID, c.ParentID)
+	})
+	a.cli.AddHandler(func(_ *discordgo.Session, c *discordgo.ThreadDelete) {
+		a.log.Printf("thread delete: %s parent: %s", c.ID, c.ParentID)
+		a.lock.Lock()
+		delete(a.threads, c.ID)
+		a.lock.Unlock()
+	})
+}
+
+func (a *App) SetThread(threadID, parentID string) {
+	a.lock.Lock()
+	a.threads[threadID] = parentID
+	a.lock.Unlock()
+}
+
+// threadParent returns the parent channel when the channel is a thread.
+func (a *App) threadParent(channelID string) (string, bool) {
+	a.lock.RLock()
+	parent, ok := a.threads[channelID]
+	a.lock.RUnlock()
+	if ok {
+		return parent, len(parent) != 0
+	}
+	a.substrateLock.RLock()
+	_, subscribed := a.SubscriptMessage[channelID]
+	a.substrateLock.RUnlock()
+	if subscribed {
+		return "", false
+	}
+	channel, err := a.cli.State.Channel(channelID)
+	if err != nil {
+		if channel, err = a.cli.Channel(channelID); err != nil {
+			return "", false
 		}
-		dm.RawMessage = msg.Content
-		if text, err := msg.ContentWithMoreMentionsReplaced(a.cli); err != nil {
-			dm.Message = msg.ContentWithMentionsReplaced()
-		} else {
-			dm.Message = text
+	}
+	if channel.IsThread() {
+		parent = channel.ParentID
+	}
+	a.SetThread(channelID, parent)
+	return parent, len(parent) != 0
+}
+
+// threadMessage records the thread of the message and returns the channel it is bridged with.
+func (a *App) threadMessage(channelID, messageID string) string {
+	parent, ok := a.threadParent(channelID)
+	if !ok {
+		return channelID
+	}
+	a.SetMessageThread(messageID, channelID)
+	return parent
+}
+
+func (a *App) SetMessageThread(messageID, threadID string) {
+	a.lock.Lock()
+	if len(a.messageThread) >= maxMessageThread {
+		a.messageThread = make(map[string]string)
+	}
+	a.messageThread[messageID] = threadID
+	a.lock.Unlock()
+}
+
+func (a *App) MessageThread(messageID string) string {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	return a.messageThread[messageID]
+}
+
+// StartThread returns the thread of the message, the thread is created when it does not exist.
+func (a *App) StartThread(channelID, messageID, name string) (string, error) {
+	if thread := a.MessageThread(messageID); len(thread) != 0 {
+		return thread, nil
+	}
+	a.lock.RLock()
+	_, exist := a.threads[messageID]
+	a.lock.RUnlock()
+	if exist {
+		return messageID, nil
+	}
+	thread, err := a.cli.MessageThreadStart(channelID, messageID, name, 1440)
+	if err != nil {
+		var restErr *discordgo.RESTError
+		if errors.As(err, &restErr) && restErr.Message != nil && restErr.Message.Code == discordgo.ErrCodeThreadAlreadyCreatedForThisMessage {
+			a.SetThread(messageID, channelID)
+			return messageID, nil
 		}
-		for _, attachment := range msg.Attachments {
-			dm.Attachments = append(dm.Attachments, model.Attachment{
-				Type: attachment.ContentType,
-				URL:  attachment.URL,
-			})
+		return "", err
+	}
+	a.SetThread(thread.ID, channelID)
+	return thread.ID, nil
+}
+
+// ReceiveMessage queues the message by channel, the messages of a channel reach the rooms in order.
+func (a *App) ReceiveMessage(msg *model.DiscordMessage) {
+	a.substrateLock.RLock()
+	_, ok := a.SubscriptMessage[msg.Channel.CID()]
+	a.substrateLock.RUnlock()
+	if !ok {
+		return
+	}
+	a.track(msg)
+	a.intake.Push(msg.Channel.CID(), msg)
+}
+
+// mentions returns the mentioned users as ContentWithMoreMentionsReplaced writes them, <@id> becomes the
+// username and <@!id> the nickname.
+func (a *App) mentions(msg *discordgo.Message) []model.Mention {
+	var result []model.Mention
+	for _, user := range msg.Mentions {
+		result = append(result, model.Mention{Source: model.DiscordType, UserID: user.ID, Name: "@" + user.Username})
+		if !strings.Contains(msg.Content, "<@!"+user.ID+">") {
+			continue
 		}
-		if msg.MessageReference != nil && msg.Type == discordgo.MessageTypeReply {
-			// 回复消息
-			dm.Type = model.MessageTypeTextReply
-			dm.ParentID = msg.MessageReference.MessageID
+		if channel, err := a.cli.State.Channel(msg.ChannelID); err == nil {
+			if member, err := a.cli.State.Member(channel.GuildID, user.ID); err == nil && len(member.Nick) != 0 {
+				result = append(result, model.Mention{Source: model.DiscordType, UserID: user.ID, Name: "@" + member.Nick})
+			}
 		}
-		go a.ReceiveMessage(dm)
-	})
+	}
+	return result
 }
 
-func (a *App) handlerThread() {
-	a.cli.AddHandler(func(s *discordgo.Session, c *discordgo.ThreadCreate) {})
-	a.cli.AddHandler(func(s *discordgo.Session, c *discordgo.ThreadDelete) {})
+func (a *App) channels() []string {
+	a.substrateLock.RLock()
+	defer a.substrateLock.RUnlock()
+	var result []string
+	for channelID := range a.SubscriptMessage {
+		result = append(result, channelID)
+	}
+	return result
 }
 
-func (a *App) ReceiveMessage(msg *model.DiscordMessage) {
+func (a *App) publish(msg model.IChatMessage) {
 	var chs []chan model.IChatMessage
 	a.substrateLock.RLock()
-	chs = append(chs, a.SubscriptMessage[msg.Channel.CID()]...)
+	chs = append(chs, a.SubscriptMessage[msg.BelongChannel().CID()]...)
 	a.substrateLock.RUnlock()
+	if r, ok := msg.(model.Acked); ok {
+		r.Expect(len(chs))
+	}
 	for _, ch := range chs {
 		ch <- msg
 	}
 }
 
 func (a *App) RegisterChannel(channelID string, ch chan model.IChatMessage) {
+	since := a.cursor(channelID)
 	a.substrateLock.Lock()
+	first := len(a.SubscriptMessage[channelID]) == 0
 	a.SubscriptMessage[channelID] = append(a.SubscriptMessage[channelID], ch)
 	a.substrateLock.Unlock()
+	if first {
+		a.intake.Hold(channelID)
+		go a.backfill(channelID, since)
+	}
 }
 
 func (a *App) GetChannelInfo(channelID string) *model.ChannelInfo {
@@ -297,18 +555,6 @@ func (a *App) SetUserInfo(user model.User) {
 	a.lock.Unlock()
 }
 
-func (a *App) SearchUserName(name string) *model.User {
-	var result *model.User
-	a.lock.RLock()
-	for _, user := range a.Users {
-		if strings.EqualFold(user.UName(), name) {
-			result = user
-		}
-	}
-	a.lock.RUnlock()
-	return result
-}
-
 func (a *App) GetUserInfo(userID string) *model.User {
 	if v := a.GetUsersInfo(userID); len(v) != 0 {
 		return v[userID]
@@ -356,3 +602,30 @@ func (a *App) GetUsersInfo(userIDs ...string) map[string]*model.User {
 	}
 	return result
 }
+
+// attachments maps the files and stickers of the message, lottie stickers can not be shown elsewhere and are dropped.
+func attachments(msg *discordgo.Message) []model.Attachment {
+	var list []model.Attachment
+	for _, attachment := range msg.Attachments {
+		list = append(list, model.Attachment{
+			Name:   attachment.Filename,
+			Type:   attachment.ContentType,
+			URL:    attachment.URL,
+			Width:  attachment.Width,
+			Height: attachment.Height,
+		})
+	}
+	for _, sticker := range msg.StickerItems {
+		if sticker.FormatType == discordgo.StickerFormatTypeLottie {
+			continue
+		}
+		ext := utils.IfElse(sticker.FormatType == discordgo.StickerFormatTypeGIF, "gif", "png")
+		list = append(list, model.Attachment{
+			Name: sticker.Name,
+			Type: "image/" + ext,
+			URL:  fmt.Sprintf("https://media.discordapp.net/stickers/%s.%s", sticker.ID, ext),
+			Kind: model.AttachmentSticker,
+		})
+	}
+	return list
+}
@@ -0,0 +1,93 @@
+package discord
+
+import (
+	"chatroom/model"
+	"chatroom/utils"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// handlerMember bridges the members of the guilds of the bridged channels, the events are only
+// sent with the server members intent, see conf.Discord.MemberEvents.
+func (a *App) handlerMember() {
+	a.cli.AddHandler(func(_ *discordgo.Session, g *discordgo.GuildCreate) {
+		var members []string
+		for _, m := range g.Members {
+			if m.User != nil {
+				members = append(members, m.User.ID)
+				a.SetUserInfo(model.User{ID: m.User.ID, Name: m.User.Username, DisplayName: m.User.Username, BotID: utils.IfElse(m.User.Bot, m.User.ID, "")})
+			}
+		}
+		if len(members) == 0 {
+			return
+		}
+		for _, channelID := range a.guildChannels(g.ID) {
+			if channel := a.GetChannelInfo(channelID); channel != nil {
+				a.lock.Lock()
+				channel.Members = utils.Unique(append(channel.Members, members...))
+				a.lock.Unlock()
+			}
+		}
+	})
+	a.cli.AddHandler(func(_ *discordgo.Session, m *discordgo.GuildMemberAdd) {
+		a.memberEvent(m.Member, model.MessageTypeMemberJoin, "")
+	})
+	a.cli.AddHandler(func(_ *discordgo.Session, m *discordgo.GuildMemberRemove) {
+		a.memberEvent(m.Member, model.MessageTypeMemberLeave, "")
+	})
+	a.cli.AddHandler(func(_ *discordgo.Session, m *discordgo.GuildMemberUpdate) {
+		// 只有缓存了旧的成员信息才知道是否改名
+		if m.BeforeUpdate == nil || m.BeforeUpdate.User == nil || m.User == nil {
+			return
+		}
+		if old := memberName(m.BeforeUpdate); old != memberName(m.Member) {
+			a.memberEvent(m.Member, model.MessageTypeMemberRename, old)
+		}
+	})
+}
+
+// memberName is the nickname of the member in the guild, or the username without one.
+func memberName(m *discordgo.Member) string {
+	return utils.Default(m.Nick, func(v string) bool { return len(v) != 0 }, m.User.Username)
+}
+
+// memberEvent updates the members of the bridged channels of the guild and queues the change to their rooms.
+func (a *App) memberEvent(m *discordgo.Member, tp model.MessageType, oldName string) {
+	if m.User == nil || m.User.ID == a.cli.State.User.ID {
+		return
+	}
+	user := model.User{ID: m.User.ID, Name: m.User.Username, DisplayName: m.User.Username, BotID: utils.IfElse(m.User.Bot, m.User.ID, "")}
+	if tp == model.MessageTypeMemberRename {
+		user.DisplayName = memberName(m)
+	} else {
+		a.SetUserInfo(user)
+	}
+	for _, channelID := range a.guildChannels(m.GuildID) {
+		channel := utils.Default(a.GetChannelInfo(channelID), func(v *model.ChannelInfo) bool { return v != nil }, model.NewChannelInfo(channelID))
+		if tp != model.MessageTypeMemberRename {
+			a.lock.Lock()
+			channel.Members = model.SetMember(channel.Members, user.ID, tp == model.MessageTypeMemberJoin)
+			a.lock.Unlock()
+		}
+		msg := model.NewMemberMessage(model.DiscordType, channel, &user, tp)
+		msg.OldName = oldName
+		a.intake.Push(channelID, msg)
+	}
+}
+
+// guildChannels returns the subscribed channels of the guild.
+func (a *App) guildChannels(guildID string) []string {
+	var result []string
+	for _, channelID := range a.channels() {
+		channel, err := a.cli.State.Channel(channelID)
+		if err != nil {
+			if channel, err = a.cli.Channel(channelID); err != nil {
+				continue
+			}
+		}
+		if channel.GuildID == guildID {
+			result = append(result, channelID)
+		}
+	}
+	return result
+}
@@ -4,6 +4,9 @@ import (
 	"chatroom/model"
 	"chatroom/utils"
 	"encoding/json"
+	"slices"
+
+	"github.com/bwmarrin/discordgo"
 )
 
 func (a *App) getUserInfo(userID ...string) (data []model.User) {
@@ -37,27 +40,25 @@ func (a *App) getChannelInfo(channelID ...string) (data []model.ChannelInfo) {
 	return
 }
 
-func (a *App) HistoryMessage(channelID string, size int) []model.DiscordMessage {
-	var beforeID string
-	var messages []model.DiscordMessage
-	for size > 0 {
-		message, err := app.cli.ChannelMessages(channelID, 100, beforeID, "", "")
-		d, _ := json.Marshal(message)
-		a.log.Println(string(d))
+// HistoryMessage returns at most size messages of the channel posted after the message, from the oldest.
+func (a *App) HistoryMessage(channelID, afterID string, size int) []*discordgo.Message {
+	var messages []*discordgo.Message
+	for len(messages) < size {
+		message, err := a.cli.ChannelMessages(channelID, 100, "", afterID, "")
 		if err != nil {
-			a.log.Println(err.Error())
-			continue
+			a.log.Printf("failed to get history of channel %s: %v", channelID, err)
+			break
 		}
-		for _, m := range message {
-			v := model.DiscordMessage{
-				ID: m.ID,
-				Channel: utils.Default(a.GetChannelInfo(m.ChannelID), func(v *model.ChannelInfo) bool {
-					return v != nil
-				}, model.NewChannelInfo(m.ChannelID)),
-			}
-			messages = append(messages, v)
+		// 返回的消息从新到旧
+		slices.Reverse(message)
+		messages = append(messages, message...)
+		if len(message) < 100 {
+			break
 		}
-		break
+		afterID = message[len(message)-1].ID
+	}
+	if len(messages) > size {
+		messages = messages[:size]
 	}
 	return messages
 }
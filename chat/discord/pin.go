@@ -0,0 +1,90 @@
+package discord
+
+import (
+	"chatroom/model"
+	"chatroom/utils"
+	"slices"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// handlerPin bridges the pins of the bridged channels and their threads. The pins update event does not
+// tell which message changed, the pinned messages are looked up and compared with the cached ones.
+func (a *App) handlerPin() {
+	a.cli.AddHandler(func(_ *discordgo.Session, ev *discordgo.ChannelPinsUpdate) {
+		channelID := ev.ChannelID
+		if parent, ok := a.threadParent(channelID); ok {
+			channelID = parent
+		}
+		a.substrateLock.RLock()
+		_, ok := a.SubscriptMessage[channelID]
+		a.substrateLock.RUnlock()
+		if !ok {
+			return
+		}
+		a.lock.RLock()
+		before, seeded := a.pins[ev.ChannelID]
+		a.lock.RUnlock()
+		after, err := a.pinned(ev.ChannelID)
+		if err != nil {
+			a.log.Printf("failed to get pinned messages of %s: %v", ev.ChannelID, err)
+			return
+		}
+		if !seeded {
+			// 首次看到的子区没有之前的置顶, 无法比较
+			a.log.Printf("pinned messages of %s loaded: %v", ev.ChannelID, after)
+			return
+		}
+		for _, id := range after {
+			if !slices.Contains(before, id) {
+				a.pinEvent(ev.ChannelID, id, model.MessageTypePin)
+			}
+		}
+		for _, id := range before {
+			if !slices.Contains(after, id) {
+				a.pinEvent(ev.ChannelID, id, model.MessageTypeUnpin)
+			}
+		}
+	})
+}
+
+// pinned loads the pinned message ids of the channel into the cache.
+func (a *App) pinned(channelID string) ([]string, error) {
+	messages, err := a.cli.ChannelMessagesPinned(channelID)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0, len(messages))
+	for _, m := range messages {
+		ids = append(ids, m.ID)
+	}
+	a.lock.Lock()
+	a.pins[channelID] = ids
+	a.lock.Unlock()
+	return ids, nil
+}
+
+// setPinned records a pin made by the bridge so that its update event is not bridged back, a channel
+// which is not cached yet is left to the next lookup.
+func (a *App) setPinned(channelID, messageID string, pinned bool) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	ids, ok := a.pins[channelID]
+	if !ok {
+		return
+	}
+	a.pins[channelID] = model.SetMember(ids, messageID, pinned)
+}
+
+// pinEvent sends the pin of a message, discord does not tell who pinned it.
+func (a *App) pinEvent(channelID, messageID string, tp model.MessageType) {
+	channelID = a.threadMessage(channelID, messageID)
+	a.ReceiveMessage(&model.DiscordMessage{
+		ID:   messageID,
+		Type: tp,
+		Channel: utils.Default(a.GetChannelInfo(channelID), func(v *model.ChannelInfo) bool {
+			return v != nil
+		}, model.NewChannelInfo(channelID)),
+		User: model.NewUserInfo(""),
+	})
+}
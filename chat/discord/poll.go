@@ -0,0 +1,133 @@
+package discord
+
+import (
+	"chatroom/format"
+	"chatroom/model"
+	"chatroom/store"
+	"chatroom/utils"
+	"fmt"
+	"slices"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+const pollBucket = "discord-poll"
+
+// discord 投票的限制, 时长以小时为单位
+const (
+	maxPollAnswers  = 10
+	maxPollQuestion = 300
+	maxPollAnswer   = 55
+	pollDuration    = 24
+)
+
+// handlerPoll bridges the votes of the native polls, discord sends every added or removed answer on its own.
+func (a *App) handlerPoll() {
+	a.cli.AddHandler(func(_ *discordgo.Session, ev *discordgo.MessagePollVoteAdd) {
+		a.pollVote(ev.ChannelID, ev.MessageID, ev.UserID, ev.AnswerID, true)
+	})
+	a.cli.AddHandler(func(_ *discordgo.Session, ev *discordgo.MessagePollVoteRemove) {
+		a.pollVote(ev.ChannelID, ev.MessageID, ev.UserID, ev.AnswerID, false)
+	})
+}
+
+// receivePoll bridges a poll created in a channel, it returns false when the message is not a poll.
+func (a *App) receivePoll(msg *discordgo.Message) bool {
+	if msg.Poll == nil {
+		return false
+	}
+	if msg.Author == nil || msg.Author.ID == a.cli.State.User.ID {
+		return true
+	}
+	user := model.User{ID: msg.Author.ID, Name: msg.Author.Username, DisplayName: msg.Author.Username, BotID: utils.IfElse(msg.Author.Bot, msg.Author.ID, "")}
+	a.SetUserInfo(user)
+	poll := &model.Poll{Question: msg.Poll.Question.Text, Multiple: msg.Poll.AllowMultiselect}
+	for _, answer := range msg.Poll.Answers {
+		var text string
+		if answer.Media != nil {
+			text = answer.Media.Text
+			if len(text) == 0 && answer.Media.Emoji != nil {
+				text = answer.Media.Emoji.Name
+			}
+		}
+		poll.Options = append(poll.Options, text)
+	}
+	a.push(&model.PollMessage{
+		ID:      msg.ID,
+		Type:    model.MessageTypePoll,
+		From:    model.DiscordType,
+		Channel: a.channelInfo(a.threadMessage(msg.ChannelID, msg.ID)),
+		User:    &user,
+		Poll:    poll,
+	})
+	return true
+}
+
+// pollVote bridges a vote. The other platforms send every selected option, so the answers of the voter are kept
+// and sent as a whole. Discord numbers the answers from 1 in their order.
+func (a *App) pollVote(channelID, messageID, userID string, answerID int, add bool) {
+	if userID == a.cli.State.User.ID {
+		return
+	}
+	key := fmt.Sprintf("%s/%s", messageID, userID)
+	var votes []int
+	store.Get(pollBucket, key, &votes)
+	option := answerID - 1
+	votes = slices.DeleteFunc(votes, func(v int) bool { return v == option })
+	if add {
+		votes = append(votes, option)
+		slices.Sort(votes)
+	}
+	var err error
+	if len(votes) == 0 {
+		err = store.Delete(pollBucket, key)
+	} else {
+		err = store.Put(pollBucket, key, votes)
+	}
+	if err != nil {
+		a.log.Printf("failed to save the votes of %s on poll %s: %v", userID, messageID, err)
+	}
+	a.push(&model.PollMessage{
+		ID:      messageID,
+		Type:    model.MessageTypePollVote,
+		From:    model.DiscordType,
+		Channel: a.channelInfo(a.threadMessage(channelID, messageID)),
+		User:    utils.Default(a.GetUserInfo(userID), func(v *model.User) bool { return v != nil }, model.NewUserInfo(userID)),
+		Votes:   votes,
+	})
+}
+
+func (a *App) channelInfo(channelID string) *model.ChannelInfo {
+	return utils.Default(a.GetChannelInfo(channelID), func(v *model.ChannelInfo) bool { return v != nil }, model.NewChannelInfo(channelID))
+}
+
+// push queues the message when its channel is bridged.
+func (a *App) push(msg model.IChatMessage) {
+	a.substrateLock.RLock()
+	_, ok := a.SubscriptMessage[msg.BelongChannel().CID()]
+	a.substrateLock.RUnlock()
+	if ok {
+		a.intake.Push(msg.BelongChannel().CID(), msg)
+	}
+}
+
+// SendPoll sends a native poll, the question shows who asked. The poll closes after a day.
+func (c *Chat) SendPoll(msg model.IChatMessage) (string, error) {
+	poll := model.PollOf(msg)
+	if poll == nil || len(poll.Options) < 2 {
+		return c.SendMessage(msg)
+	}
+	p := &discordgo.Poll{
+		Question:         discordgo.PollMedia{Text: format.Truncate(maxPollQuestion, fmt.Sprintf("[%s] %s: %s", msg.Source(), msg.BelongUser().UName(), poll.Question))},
+		AllowMultiselect: poll.Multiple,
+		Duration:         pollDuration,
+	}
+	for _, option := range poll.Options[:min(len(poll.Options), maxPollAnswers)] {
+		p.Answers = append(p.Answers, discordgo.PollAnswer{Media: &discordgo.PollMedia{Text: format.Truncate(maxPollAnswer, option)}})
+	}
+	rsp, err := app.cli.ChannelMessageSendComplex(c.Channel, &discordgo.MessageSend{Poll: p})
+	if err != nil {
+		return "", err
+	}
+	return rsp.ID, nil
+}
@@ -1,22 +1,28 @@
 package discord
 
 import (
+	"chatroom/format"
+	"chatroom/identity"
 	"chatroom/model"
+	"errors"
 	"fmt"
-	"regexp"
+	"net/http"
 	"strings"
+	"time"
 
 	"github.com/bwmarrin/discordgo"
 )
 
 type Chat struct {
-	Channel string
+	Channel  string
+	Template *format.Template
 }
 
-func NewDiscordChat(channelID string, receiveCh chan model.IChatMessage) *Chat {
+func NewDiscordChat(channelID string, receiveCh chan model.IChatMessage, tpl *format.Template) *Chat {
 	app.RegisterChannel(channelID, receiveCh)
 	c := new(Chat)
 	c.Channel = channelID
+	c.Template = tpl
 	c.init()
 	return c
 }
@@ -32,21 +38,44 @@ func (c *Chat) Source() model.TypeSource {
 	return model.DiscordType
 }
 
-func (c *Chat) mentionParsing(text string) string {
-	rgx := regexp.MustCompile(`@([^@\\s]*)\\s`)
-	userID := rgx.FindAllStringSubmatch(text, -1)
-	var args []string
-	for _, id := range userID {
-		if len(id) != 2 {
-			continue
-		}
-		user := app.SearchUserName(id[1])
-		if user == nil {
-			continue
+func (c *Chat) Connected() bool {
+	return Connected()
+}
+
+func (c *Chat) Members() []string {
+	info := app.GetChannelInfo(c.Channel)
+	if info == nil {
+		return nil
+	}
+	var result []string
+	for _, user := range app.GetUsersInfo(info.Members...) {
+		if !user.IsBot() {
+			result = append(result, user.UName())
 		}
-		args = append(args, id[0], "<@"+user.UID()+"> ")
 	}
-	return strings.NewReplacer(args...).Replace(text)
+	return result
+}
+
+// mentionParsing replaces the mentions with the linked discord users, the others are kept as they are.
+func (c *Chat) mentionParsing(msg model.IChatMessage) string {
+	return identity.Translate(msg.Text(), msg.Mentions(), model.DiscordType, func(userID string) string {
+		return "<@" + userID + ">"
+	})
+}
+
+// Whisper sends a direct message to the user.
+func (c *Chat) Whisper(userID, text string) error {
+	channel, err := app.cli.UserChannelCreate(userID)
+	if err != nil {
+		return err
+	}
+	_, err = app.cli.ChannelMessageSend(channel.ID, text)
+	return err
+}
+
+// Typing shows the bot typing in the channel, discord clears it after 10 seconds or when the bot sends.
+func (c *Chat) Typing() error {
+	return app.cli.ChannelTyping(c.Channel)
 }
 
 func (c *Chat) SendMessage(msg model.IChatMessage) (string, error) {
@@ -60,10 +89,26 @@ func (c *Chat) SendMessage(msg model.IChatMessage) (string, error) {
 func (c *Chat) SendReplyMessage(parentID string, msg model.IChatMessage) (string, error) {
 	var rsp *discordgo.Message
 	var err error
+	if len(parentID) != 0 && msg.InThread() {
+		// 线程回复发送到由父消息创建的子区
+		thread, err := app.StartThread(c.channelOf(parentID), parentID, threadName(msg))
+		if err == nil {
+			if rsp, err = app.cli.ChannelMessageSend(thread, c.formatText(msg)); err != nil {
+				return "", err
+			}
+			app.SetMessageThread(rsp.ID, thread)
+			return rsp.ID, nil
+		}
+		app.log.Printf("failed to start thread of message %s, fall back to reply: %v", parentID, err)
+	}
 	if len(parentID) == 0 {
 		rsp, err = app.cli.ChannelMessageSend(c.Channel, fmt.Sprintf("%s\n[Reply Message, Parent message not found]", c.formatText(msg)))
 	} else {
-		rsp, err = app.cli.ChannelMessageSendReply(c.Channel, c.formatText(msg), &discordgo.MessageReference{MessageID: parentID, ChannelID: c.Channel})
+		channelID := c.channelOf(parentID)
+		rsp, err = app.cli.ChannelMessageSendReply(channelID, c.formatText(msg), &discordgo.MessageReference{MessageID: parentID, ChannelID: channelID})
+		if err == nil && channelID != c.Channel {
+			app.SetMessageThread(rsp.ID, channelID)
+		}
 	}
 	if err != nil {
 		return "", err
@@ -76,35 +121,80 @@ func (c *Chat) UpdateMessage(messageID string, msg model.IChatMessage) error {
 		_, err := app.cli.ChannelMessageSend(c.Channel, fmt.Sprintf("%s\n[Edit Message, Original message not found]", c.formatText(msg)))
 		return err
 	}
-	_, err := app.cli.ChannelMessageEdit(c.Channel, messageID, c.formatText(msg))
+	_, err := app.cli.ChannelMessageEdit(c.channelOf(messageID), messageID, c.formatText(msg))
 	return err
 }
 
 func (c *Chat) DeleteMessage(messageID string) error {
-	return app.cli.ChannelMessageDelete(c.Channel, messageID)
+	return app.cli.ChannelMessageDelete(c.channelOf(messageID), messageID)
 }
 
 func (c *Chat) SendReaction(messageID string, emojiID string) error {
-	return app.cli.MessageReactionAdd(c.Channel, messageID, emojiID)
+	return app.cli.MessageReactionAdd(c.channelOf(messageID), messageID, emojiID)
 }
 
 func (c *Chat) RemoveReaction(messageID string, emojiID string) error {
-	return app.cli.MessageReactionsRemoveEmoji(c.Channel, messageID, emojiID)
+	return app.cli.MessageReactionsRemoveEmoji(c.channelOf(messageID), messageID, emojiID)
 }
 
 func (c *Chat) RemoveReactionAll(messageID string) error {
-	return app.cli.MessageReactionsRemoveAll(c.Channel, messageID)
+	return app.cli.MessageReactionsRemoveAll(c.channelOf(messageID), messageID)
+}
+
+func (c *Chat) Pin(messageID string) error {
+	channelID := c.channelOf(messageID)
+	app.setPinned(channelID, messageID, true)
+	if err := app.cli.ChannelMessagePin(channelID, messageID); err != nil {
+		app.setPinned(channelID, messageID, false)
+		return err
+	}
+	return nil
+}
+
+func (c *Chat) Unpin(messageID string) error {
+	channelID := c.channelOf(messageID)
+	app.setPinned(channelID, messageID, false)
+	if err := app.cli.ChannelMessageUnpin(channelID, messageID); err != nil {
+		app.setPinned(channelID, messageID, true)
+		return err
+	}
+	return nil
+}
+
+// channelOf returns the thread of the message or the chat channel.
+func (c *Chat) channelOf(messageID string) string {
+	if thread := app.MessageThread(messageID); len(thread) != 0 {
+		return thread
+	}
+	return c.Channel
 }
 
+func threadName(msg model.IChatMessage) string {
+	name, _, _ := strings.Cut(strings.TrimSpace(msg.Text()), "\n")
+	if name = strings.TrimSpace(name); len(name) == 0 {
+		name = fmt.Sprintf("%s thread", msg.Source())
+	}
+	if r := []rune(name); len(r) > 80 {
+		name = string(r[:80])
+	}
+	return name
+}
+
+// formatText renders the bridged text with the template of the chat.
 func (c *Chat) formatText(msg model.IChatMessage) string {
-	var text string
-	if msg.Source() == c.Source() {
-		text = fmt.Sprintf("From: [%s] User: [%s] Send: \n%s", msg.BelongChannel().CName(), msg.BelongUser().UName(), msg.RawText())
-	} else {
-		text = fmt.Sprintf("From: [%s] User: [%s] Send: \n%s", msg.Source(), msg.BelongUser().UName(), c.mentionParsing(msg.Text()))
+	return c.Template.Render(msg, c.Source(), c.mentionParsing(msg))
+}
+
+// RetryAfter reports the rate limit delay of discord, server errors are retried with the outbox backoff.
+func (c *Chat) RetryAfter(err error) (time.Duration, bool) {
+	var rateErr *discordgo.RateLimitError
+	if errors.As(err, &rateErr) && rateErr.RateLimit != nil && rateErr.TooManyRequests != nil {
+		return rateErr.RetryAfter, true
 	}
-	if att := msg.Attachment(); len(att) != 0 {
-		text += model.Attachments(att).String()
+	var restErr *discordgo.RESTError
+	if errors.As(err, &restErr) && restErr.Response != nil {
+		code := restErr.Response.StatusCode
+		return 0, code == http.StatusTooManyRequests || code >= http.StatusInternalServerError
 	}
-	return text
+	return 0, false
 }
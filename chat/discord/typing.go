@@ -0,0 +1,30 @@
+package discord
+
+import (
+	"chatroom/model"
+	"chatroom/utils"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// handlerTyping bridges the users typing in the bridged channels and their threads.
+func (a *App) handlerTyping() {
+	a.cli.AddHandler(func(s *discordgo.Session, t *discordgo.TypingStart) {
+		if t.UserID == s.State.User.ID {
+			return
+		}
+		channelID := t.ChannelID
+		if parent, ok := a.threadParent(channelID); ok {
+			channelID = parent
+		}
+		a.substrateLock.RLock()
+		_, ok := a.SubscriptMessage[channelID]
+		a.substrateLock.RUnlock()
+		if !ok {
+			return
+		}
+		channel := utils.Default(a.GetChannelInfo(channelID), func(v *model.ChannelInfo) bool { return v != nil }, model.NewChannelInfo(channelID))
+		user := utils.Default(a.GetUserInfo(t.UserID), func(v *model.User) bool { return v != nil }, model.NewUserInfo(t.UserID))
+		a.intake.Push(channelID, model.NewTypingMessage(model.DiscordType, channel, user))
+	})
+}
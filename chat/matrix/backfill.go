@@ -0,0 +1,122 @@
+package matrix
+
+import (
+	"chatroom/conf"
+	"chatroom/model"
+	"chatroom/store"
+	"chatroom/utils"
+	"context"
+	"fmt"
+	"slices"
+	"time"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+const cursorBucket = "cursor"
+
+// cursor returns the timestamp in milliseconds of the last event seen in the room.
+func (a *App) cursor(roomID string) int64 {
+	var ts int64
+	store.Get(cursorBucket, fmt.Sprintf("%s:%s", model.MatrixType, roomID), &ts)
+	return ts
+}
+
+func (a *App) advance(roomID string, ts int64) {
+	a.cursorLock.Lock()
+	defer a.cursorLock.Unlock()
+	if ts <= a.cursor(roomID) {
+		return
+	}
+	if err := store.Put(cursorBucket, fmt.Sprintf("%s:%s", model.MatrixType, roomID), ts); err != nil {
+		a.log.Printf("failed to save cursor of room %s: %v", roomID, err)
+	}
+}
+
+// track advances the cursor of the room once the rooms consumed the message.
+func (a *App) track(msg *model.MatrixMessage) {
+	if msg.SendTime > 0 {
+		roomID, ts := msg.Channel.CID(), msg.SendTime
+		msg.OnAck(func() { a.advance(roomID, ts) })
+	}
+}
+
+func (a *App) loadCursor(roomID ...string) {
+	a.since = make(map[string]int64)
+	for _, rid := range roomID {
+		if ts := a.cursor(rid); ts > 0 {
+			a.since[rid] = ts
+		}
+	}
+}
+
+// fresh reports whether the event has not been seen before, without a cursor only the events after the start are new.
+func (a *App) fresh(evt *event.Event, start time.Time) bool {
+	if since, ok := a.since[evt.RoomID.String()]; ok {
+		return evt.Timestamp > since
+	}
+	return time.UnixMilli(evt.Timestamp).Sub(start).Seconds() >= -20
+}
+
+// backfill replays the events posted after the cursor of the previous run, the rooms skip the ones already bridged.
+// The caller holds the intake of the room, the live events received meanwhile are queued after the history.
+func (a *App) backfill(ctx context.Context, roomID string) {
+	var history []model.IChatMessage
+	defer func() { a.intake.Release(roomID, history...) }()
+	limit := utils.Default(conf.Conf.Backfill.Limit, func(v int) bool { return v != 0 }, 100)
+	since, ok := a.since[roomID]
+	if !ok || limit < 0 {
+		return
+	}
+	maxAge := utils.Default(conf.Conf.Backfill.MaxAge, func(v time.Duration) bool { return v > 0 }, 24*time.Hour)
+	since = max(since, time.Now().Add(-maxAge).UnixMilli())
+	filter := &mautrix.FilterPart{NotSenders: []id.UserID{id.UserID(a.SelfID)}}
+	var events []*event.Event
+	var from string
+	for len(events) < limit {
+		rsp, err := a.cli.Messages(ctx, id.RoomID(roomID), from, "", mautrix.DirectionBackward, filter, 100)
+		if err != nil {
+			a.log.Printf("failed to get messages of room %s: %v", roomID, err)
+			break
+		}
+		done := len(rsp.Chunk) == 0 || len(rsp.End) == 0
+		for _, evt := range rsp.Chunk {
+			if evt.Timestamp <= since {
+				done = true
+				break
+			}
+			events = append(events, evt)
+		}
+		if done {
+			break
+		}
+		from = rsp.End
+	}
+	if len(events) > limit {
+		events = events[:limit]
+	}
+	// 从旧到新重放
+	slices.Reverse(events)
+	a.log.Printf("backfill %d events of room %s since %d", len(events), roomID, since)
+	for _, evt := range events {
+		evt.RoomID = id.RoomID(roomID)
+		if err := evt.Content.ParseRaw(evt.Type); err != nil {
+			a.log.Printf("failed to parse event %s: %v", evt.ID, err)
+			continue
+		}
+		if evt.Type == event.EventEncrypted && a.cli.Crypto != nil {
+			decrypted, err := a.cli.Crypto.Decrypt(ctx, evt)
+			if err != nil {
+				a.log.Printf("failed to decrypt event %s: %v", evt.ID, err)
+				continue
+			}
+			evt = decrypted
+		}
+		if msg := a.eventMessage(evt); msg != nil {
+			a.track(msg)
+			history = append(history, msg)
+		}
+	}
+}
@@ -3,12 +3,13 @@ package matrix
 import (
 	"chatroom/conf"
 	"chatroom/model"
+	"chatroom/utils/queue"
 	"context"
-	"fmt"
 	"log"
 	"os"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"maunium.net/go/mautrix"
@@ -26,17 +27,29 @@ type baseInfo struct {
 
 	SubscriptMessage map[string][]chan model.IChatMessage
 	substrateLock    sync.RWMutex
+	cursorLock       sync.Mutex
+	intake           *queue.Serial[model.IChatMessage]
 	lock             sync.RWMutex
+	// eventThread 线程内事件的根事件
+	eventThread map[string]string
+	// pollAnswer 投票各选项的 id, 投票回复只带选项 id
+	pollAnswer map[string][]string
+	// since 启动时各房间的游标, 之前的事件已经桥接或由 backfill 补齐
+	since map[string]int64
 }
 
 type App struct {
 	baseInfo
-	cli *mautrix.Client
-	log *log.Logger
+	cli    *mautrix.Client
+	crypto *cryptohelper.CryptoHelper
+	online atomic.Bool
+	log    *log.Logger
 }
 
 var app *App
 
+const maxEventThread = 10000
+
 func NewClient(ctx context.Context, conf conf.Matrix) {
 	if len(conf.Host) == 0 || len(conf.User) == 0 || len(conf.Password) == 0 {
 		return
@@ -46,6 +59,8 @@ func NewClient(ctx context.Context, conf conf.Matrix) {
 	app.Users = make(map[string]*model.User)
 	app.ChannelInfo = make(map[string]*model.ChannelInfo)
 	app.SubscriptMessage = make(map[string][]chan model.IChatMessage)
+	app.eventThread = make(map[string]string)
+	app.pollAnswer = make(map[string][]string)
 	cli, err := mautrix.NewClient(conf.Host, "", "")
 	if err != nil {
 		app.log.Panicln(err.Error())
@@ -79,6 +94,8 @@ func NewClient(ctx context.Context, conf conf.Matrix) {
 		panic(err)
 	}
 	cli.Crypto = cryptoHelper
+	cli.Store = &syncStore{SyncStore: cli.Store}
+	app.crypto = cryptoHelper
 	app.SelfID = cli.UserID.String()
 	app.init(ctx)
 	if err = app.eventLoop(ctx); err != nil {
@@ -87,12 +104,49 @@ func NewClient(ctx context.Context, conf conf.Matrix) {
 	app.log.Println("matrix init complete")
 }
 
+// StopIntake stops queuing the platform events, the events already queued still reach the rooms.
+func StopIntake() {
+	if app == nil || app.intake == nil {
+		return
+	}
+	app.intake.Stop()
+}
+
+// Close stops syncing and closes the crypto store.
+func Close() {
+	if app == nil {
+		return
+	}
+	app.cli.StopSync()
+	if err := app.crypto.Close(); err != nil {
+		app.log.Printf("failed to close crypto helper: %v", err)
+	}
+}
+
 func (a *App) init(ctx context.Context) {
+	a.intake = queue.NewSerial(conf.Conf.Receive.QueueSize, a.publish)
 	channelIds := conf.Conf.GetMatrixChat()
 	a.joinRoom(ctx, channelIds...)
 	a.updateChannelMember(ctx, channelIds...)
 }
 
+// Connected reports whether the last sync succeeded.
+func Connected() bool {
+	return app != nil && app.online.Load()
+}
+
+// Refresh drops the cached users and rooms and loads the room members again.
+func Refresh() {
+	if app == nil {
+		return
+	}
+	app.lock.Lock()
+	app.Users = make(map[string]*model.User)
+	app.ChannelInfo = make(map[string]*model.ChannelInfo)
+	app.lock.Unlock()
+	app.updateChannelMember(context.Background(), conf.Conf.GetMatrixChat()...)
+}
+
 func (a *App) eventLoop(ctx context.Context) error {
 	channel := conf.Conf.GetMatrixChat()
 	var roomID []id.RoomID
@@ -115,9 +169,14 @@ func (a *App) eventLoop(ctx context.Context) error {
 	}
 	syncer.FilterJSON = filter
 	nowTime := time.Now()
+	a.loadCursor(channel...)
+	syncer.OnSync(func(context.Context, *mautrix.RespSync, string) bool {
+		a.online.Store(true)
+		return true
+	})
 	syncer.OnEventType(event.EventMessage, func(ctx context.Context, evt *event.Event) {
-		if v := time.UnixMilli(evt.Timestamp).Sub(nowTime); v.Seconds() < -20 {
-			a.log.Println("filter message", evt.Sender, evt.RoomID, evt.Type, v.Seconds())
+		if !a.fresh(evt, nowTime) {
+			a.log.Println("filter message", evt.Sender, evt.RoomID, evt.Type, evt.Timestamp)
 			return
 		}
 		if evt.Sender.String() == a.SelfID {
@@ -125,14 +184,39 @@ func (a *App) eventLoop(ctx context.Context) error {
 		}
 		a.handlerMessage(ctx, evt)
 	})
-	//syncer.OnEventType(event.StateMember, func(ctx context.Context, evt *event.Event) {
-	//	// 成员状态
-	//	data, _ := json.Marshal(evt)
-	//	a.log.Println(string(data))
-	//})
+	syncer.OnEventType(event.EventSticker, func(ctx context.Context, evt *event.Event) {
+		if !a.fresh(evt, nowTime) || evt.Sender.String() == a.SelfID {
+			return
+		}
+		a.handlerMessage(ctx, evt)
+	})
+	syncer.OnEventType(event.StateMember, func(ctx context.Context, evt *event.Event) {
+		// 初次同步的成员状态不是新的变化
+		if !a.fresh(evt, nowTime) {
+			return
+		}
+		a.memberEvent(ctx, evt)
+	})
+	syncer.OnEventType(event.StatePinnedEvents, func(ctx context.Context, evt *event.Event) {
+		if !a.fresh(evt, nowTime) {
+			return
+		}
+		a.pinEvent(ctx, evt)
+	})
+	for _, tp := range []event.Type{event.EventUnstablePollStart, event.EventUnstablePollResponse} {
+		syncer.OnEventType(tp, func(ctx context.Context, evt *event.Event) {
+			if !a.fresh(evt, nowTime) || evt.Sender.String() == a.SelfID {
+				return
+			}
+			a.pollEvent(ctx, evt)
+		})
+	}
+	syncer.OnEventType(event.EphemeralEventTyping, func(ctx context.Context, evt *event.Event) {
+		a.typingEvent(evt)
+	})
 	syncer.OnEventType(event.EventRedaction, func(ctx context.Context, evt *event.Event) {
-		if v := time.UnixMilli(evt.Timestamp).Sub(nowTime); v.Seconds() < -20 {
-			a.log.Println("filter message", evt.Sender, evt.RoomID, evt.Type, v.Seconds())
+		if !a.fresh(evt, nowTime) {
+			a.log.Println("filter message", evt.Sender, evt.RoomID, evt.Type, evt.Timestamp)
 			return
 		}
 		if evt.Sender.String() == a.SelfID {
@@ -141,8 +225,8 @@ func (a *App) eventLoop(ctx context.Context) error {
 		a.handlerMessage(ctx, evt)
 	})
 	syncer.OnEventType(event.EventReaction, func(ctx context.Context, evt *event.Event) {
-		if v := time.UnixMilli(evt.Timestamp).Sub(nowTime); v.Seconds() < -20 {
-			a.log.Println("filter message", evt.Sender, evt.RoomID, evt.Type, v.Seconds())
+		if !a.fresh(evt, nowTime) {
+			a.log.Println("filter message", evt.Sender, evt.RoomID, evt.Type, evt.Timestamp)
 			return
 		}
 		if evt.Sender.String() == a.SelfID {
@@ -166,15 +250,31 @@ func (a *App) eventLoop(ctx context.Context) error {
 		if err := a.cli.SyncWithContext(ctx); err != nil {
 			a.log.Println(err.Error())
 		}
+		a.online.Store(false)
 	}()
 	return nil
 }
 
+// ReceiveMessage queues the message by channel, the messages of a channel reach the rooms in order.
 func (a *App) ReceiveMessage(msg *model.MatrixMessage) {
+	a.substrateLock.RLock()
+	_, ok := a.SubscriptMessage[msg.Channel.CID()]
+	a.substrateLock.RUnlock()
+	if !ok {
+		return
+	}
+	a.track(msg)
+	a.intake.Push(msg.Channel.CID(), msg)
+}
+
+func (a *App) publish(msg model.IChatMessage) {
 	var chs []chan model.IChatMessage
 	a.substrateLock.RLock()
-	chs = append(chs, a.SubscriptMessage[msg.Channel.CID()]...)
+	chs = append(chs, a.SubscriptMessage[msg.BelongChannel().CID()]...)
 	a.substrateLock.RUnlock()
+	if r, ok := msg.(model.Acked); ok {
+		r.Expect(len(chs))
+	}
 	for _, ch := range chs {
 		ch <- msg
 	}
@@ -182,14 +282,26 @@ func (a *App) ReceiveMessage(msg *model.MatrixMessage) {
 
 func (a *App) RegisterChannel(channelID string, ch chan model.IChatMessage) {
 	a.substrateLock.Lock()
+	first := len(a.SubscriptMessage[channelID]) == 0
 	a.SubscriptMessage[channelID] = append(a.SubscriptMessage[channelID], ch)
 	a.substrateLock.Unlock()
+	if first {
+		a.intake.Hold(channelID)
+		go a.backfill(context.Background(), channelID)
+	}
 }
 
 func (a *App) handlerMessage(_ context.Context, evt *event.Event) {
+	if msg := a.eventMessage(evt); msg != nil {
+		a.ReceiveMessage(msg)
+	}
+}
+
+// eventMessage converts a message, reaction or redaction event, it returns nil for the other events.
+func (a *App) eventMessage(evt *event.Event) *model.MatrixMessage {
 	msg := new(model.MatrixMessage)
 	switch evt.Type {
-	case event.EventMessage:
+	case event.EventMessage, event.EventSticker:
 		msg.ID = evt.ID.String()
 		msg.Type = model.MessageTypeTextCreate
 		msg.Channel = a.getChannelInfo(evt.RoomID.String())
@@ -201,22 +313,37 @@ func (a *App) handlerMessage(_ context.Context, evt *event.Event) {
 				msg.Type = model.MessageTypeTextUpdate
 				msg.ID = em.RelatesTo.GetReplaceID().String()
 				if em.NewContent != nil {
-					msg.Message = formatMessageBody(em.NewContent.MsgType, em.NewContent.Body)
+					msg.Message = messageText(em.NewContent)
 				} else {
-					msg.Message = formatMessageBody(em.MsgType, em.Body) // 回退到原始内容
+					msg.Message = messageText(em) // 回退到原始内容
 				}
+			} else if root := em.RelatesTo.GetThreadParent(); len(root) != 0 {
+				// 线程消息回复线程的根消息
+				msg.Type = model.MessageTypeTextReply
+				msg.Thread = true
+				msg.ParentID = root.String()
+				a.SetEventThread(evt.ID.String(), root.String())
+				em.RemoveReplyFallback()
+				msg.Message = messageText(em)
 			} else if em.RelatesTo.InReplyTo != nil {
 				msg.Type = model.MessageTypeTextReply
 				msg.ParentID = em.RelatesTo.InReplyTo.EventID.String()
-				msg.Message = formatMessageBody(em.MsgType, em.Body)
+				em.RemoveReplyFallback()
+				msg.Message = messageText(em)
 			} else {
-				msg.Message = formatMessageBody(em.MsgType, em.Body)
+				msg.Message = messageText(em)
 				msg.Type = model.MessageTypeTextCreate
 			}
 		} else {
-			msg.Message = formatMessageBody(em.MsgType, em.Body)
+			msg.Message = messageText(em)
+		}
+		if em.NewContent != nil && msg.Type == model.MessageTypeTextUpdate {
+			msg.Mentioned = a.mentions(evt.RoomID.String(), em.NewContent)
+			msg.Attachments = a.attachments(evt.Type, em.NewContent)
+		} else {
+			msg.Mentioned = a.mentions(evt.RoomID.String(), em)
+			msg.Attachments = a.attachments(evt.Type, em)
 		}
-		go a.ReceiveMessage(msg)
 	case event.EventReaction:
 		msg.ID = evt.ID.String()
 		msg.Type = model.MessageTypeActionAdd
@@ -230,22 +357,31 @@ func (a *App) handlerMessage(_ context.Context, evt *event.Event) {
 				msg.ID = em.EventID.String()
 			}
 		}
-		go a.ReceiveMessage(msg)
 	case event.EventRedaction:
 		msg.Type = model.MessageTypeTextDelete
 		msg.Channel = a.getChannelInfo(evt.RoomID.String())
 		msg.ID = evt.Redacts.String()
-		go a.ReceiveMessage(msg)
 	default:
+		return nil
 	}
+	return msg
 }
 
-func formatMessageBody(tp event.MessageType, body string) string {
-	if tp.IsText() {
-		return body
+// mentions returns the users of m.mentions, clients write the display name of the user in the body.
+func (a *App) mentions(roomID string, content *event.MessageEventContent) []model.Mention {
+	if content.Mentions == nil {
+		return nil
 	}
-	return fmt.Sprintf("[%s] %s", strings.TrimPrefix(string(tp), "m."), body)
+	var result []model.Mention
+	for _, uid := range content.Mentions.UserIDs {
+		result = append(result, model.Mention{Source: model.MatrixType, UserID: uid.String(), Name: a.getUserInfo(roomID, uid.String()).UName()})
+		if strings.Contains(content.Body, uid.String()) {
+			result = append(result, model.Mention{Source: model.MatrixType, UserID: uid.String(), Name: uid.String()})
+		}
+	}
+	return result
 }
+
 func (a *App) getChannelIds() []string {
 	a.lock.RLock()
 	result := make([]string, 0, len(a.ChannelInfo))
@@ -255,15 +391,3 @@ func (a *App) getChannelIds() []string {
 	a.lock.RUnlock()
 	return result
 }
-
-func (a *App) SearchUserName(name string) *model.User {
-	var result *model.User
-	a.lock.RLock()
-	for _, user := range a.Users {
-		if strings.EqualFold(user.UName(), name) {
-			result = user
-		}
-	}
-	a.lock.RUnlock()
-	return result
-}
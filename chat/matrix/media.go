@@ -0,0 +1,183 @@
+package matrix
+
+import (
+	"bytes"
+	"chatroom/model"
+	"chatroom/utils"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+const (
+	// maxUpload bounds the media downloaded from the other platforms and uploaded to the homeserver.
+	maxUpload = 50 << 20
+	// uploadTimeout bounds the download and the upload of one media, the outbox of the room waits for them.
+	uploadTimeout = 2 * time.Minute
+)
+
+var mediaClient = &http.Client{Timeout: uploadTimeout}
+
+// messageText returns the text of the message. The body of a media message is the file name,
+// unless the file name is set separately and the body is the caption.
+func messageText(em *event.MessageEventContent) string {
+	switch em.MsgType {
+	case event.MsgImage, event.MsgVideo, event.MsgAudio, event.MsgFile, "":
+		if len(em.FileName) != 0 && em.FileName != em.Body {
+			return em.Body
+		}
+		return ""
+	case event.MsgLocation:
+		return ""
+	}
+	return em.Body
+}
+
+// attachments maps the media of the message, stickers are m.sticker events without a msgtype.
+func (a *App) attachments(tp event.Type, em *event.MessageEventContent) []model.Attachment {
+	var kind string
+	switch {
+	case tp == event.EventSticker:
+		kind = model.AttachmentSticker
+	case em.MsgType == event.MsgImage:
+		kind = utils.IfElse(em.Info != nil && (em.Info.MauGIF || em.Info.MimeType == "image/gif"), model.AttachmentAnimation, model.AttachmentImage)
+	case em.MsgType == event.MsgVideo:
+		kind = model.AttachmentVideo
+	case em.MsgType == event.MsgAudio:
+		kind = utils.IfElse(em.MSC3245Voice != nil, model.AttachmentVoice, model.AttachmentAudio)
+	case em.MsgType == event.MsgFile:
+		kind = model.AttachmentFile
+	case em.MsgType == event.MsgLocation:
+		latitude, longitude, ok := parseGeoURI(em.GeoURI)
+		if !ok {
+			return nil
+		}
+		return []model.Attachment{model.NewLocation(em.Body, latitude, longitude)}
+	default:
+		return nil
+	}
+	att := model.Attachment{Name: utils.Default(em.FileName, func(v string) bool { return len(v) != 0 }, em.Body), Kind: kind, URL: a.mediaURL(em.URL)}
+	if em.Info != nil {
+		att.Type = em.Info.MimeType
+		att.Width, att.Height = em.Info.Width, em.Info.Height
+		att.Duration = time.Duration(em.Info.Duration) * time.Millisecond
+		att.Thumbnail = a.mediaURL(em.Info.ThumbnailURL)
+	}
+	return []model.Attachment{att}
+}
+
+// mediaURL returns the download url of the mxc uri, empty for the encrypted files.
+func (a *App) mediaURL(uri id.ContentURIString) string {
+	mxc, err := uri.Parse()
+	if err != nil || mxc.IsEmpty() {
+		return ""
+	}
+	return fmt.Sprintf("%s/_matrix/media/v3/download/%s/%s", strings.TrimSuffix(a.cli.HomeserverURL.String(), "/"), mxc.Homeserver, mxc.FileID)
+}
+
+// parseGeoURI parses "geo:latitude,longitude;u=accuracy".
+func parseGeoURI(uri string) (float64, float64, bool) {
+	coords, _, _ := strings.Cut(strings.TrimPrefix(uri, "geo:"), ";")
+	lat, lon, ok := strings.Cut(coords, ",")
+	if !ok {
+		return 0, 0, false
+	}
+	latitude, err1 := strconv.ParseFloat(lat, 64)
+	longitude, err2 := strconv.ParseFloat(lon, 64)
+	return latitude, longitude, err1 == nil && err2 == nil
+}
+
+// sendMedia sends the media and the locations of the message after its text, they stay as links in the text
+// when they can not be sent. Stickers are sent as images.
+func (c Chat) sendMedia(attachments []model.Attachment) {
+	ctx := context.Background()
+	for _, att := range attachments {
+		content := &event.MessageEventContent{Body: utils.Default(att.Name, func(v string) bool { return len(v) != 0 }, att.MediaKind())}
+		switch att.MediaKind() {
+		case model.AttachmentImage, model.AttachmentSticker, model.AttachmentAnimation:
+			content.MsgType = event.MsgImage
+		case model.AttachmentVideo, model.AttachmentVideoNote:
+			content.MsgType = event.MsgVideo
+		case model.AttachmentAudio:
+			content.MsgType = event.MsgAudio
+		case model.AttachmentVoice:
+			content.MsgType = event.MsgAudio
+			content.MSC3245Voice = &event.MSC3245Voice{}
+			content.MSC1767Audio = &event.MSC1767Audio{Duration: int(att.Duration.Milliseconds())}
+		case model.AttachmentLocation:
+			latitude, longitude, ok := att.Location()
+			if !ok {
+				continue
+			}
+			content.MsgType = event.MsgLocation
+			content.GeoURI = fmt.Sprintf("geo:%f,%f", latitude, longitude)
+			if _, err := app.cli.SendMessageEvent(ctx, id.RoomID(c.RoomId), event.EventMessage, content); err != nil {
+				app.log.Printf("failed to send location: %v", err)
+			}
+			continue
+		default:
+			continue
+		}
+		uri, mime, err := upload(ctx, att.URL)
+		if err != nil {
+			app.log.Printf("failed to upload %s: %v", att.URL, err)
+			continue
+		}
+		content.URL = uri.CUString()
+		content.Info = &event.FileInfo{
+			MimeType: utils.Default(att.Type, func(v string) bool { return strings.Contains(v, "/") }, mime),
+			Width:    att.Width,
+			Height:   att.Height,
+			Duration: int(att.Duration.Milliseconds()),
+		}
+		if _, err = app.cli.SendMessageEvent(ctx, id.RoomID(c.RoomId), event.EventMessage, content); err != nil {
+			app.log.Printf("failed to send %s: %v", att.MediaKind(), err)
+		}
+	}
+}
+
+// upload downloads the public media and uploads it to the homeserver, the private urls of the other
+// platforms answer with an error or a login page and are skipped.
+func upload(ctx context.Context, link string) (id.ContentURI, string, error) {
+	if !strings.HasPrefix(link, "http") {
+		return id.ContentURI{}, "", fmt.Errorf("not a public url")
+	}
+	ctx, cancel := context.WithTimeout(ctx, uploadTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, link, nil)
+	if err != nil {
+		return id.ContentURI{}, "", err
+	}
+	rsp, err := mediaClient.Do(req)
+	if err != nil {
+		return id.ContentURI{}, "", err
+	}
+	defer rsp.Body.Close()
+	mime := rsp.Header.Get("Content-Type")
+	if rsp.StatusCode != http.StatusOK || strings.HasPrefix(mime, "text/html") {
+		return id.ContentURI{}, "", fmt.Errorf("download status %s, type %s", rsp.Status, mime)
+	}
+	if rsp.ContentLength > maxUpload {
+		return id.ContentURI{}, "", fmt.Errorf("media is too large, %d bytes", rsp.ContentLength)
+	}
+	// 分块传输没有长度, 读取时限制大小
+	data, err := io.ReadAll(io.LimitReader(rsp.Body, maxUpload+1))
+	if err != nil {
+		return id.ContentURI{}, "", err
+	}
+	if len(data) > maxUpload {
+		return id.ContentURI{}, "", fmt.Errorf("media is larger than %d bytes", maxUpload)
+	}
+	uploaded, err := app.cli.Upload(ctx, bytes.NewReader(data), mime, int64(len(data)))
+	if err != nil {
+		return id.ContentURI{}, "", err
+	}
+	return uploaded.ContentURI, mime, nil
+}
@@ -0,0 +1,61 @@
+package matrix
+
+import (
+	"chatroom/model"
+	"context"
+	"errors"
+
+	"maunium.net/go/mautrix/event"
+)
+
+// memberEvent bridges the membership changes of the bridged rooms, a join after a join is a rename.
+func (a *App) memberEvent(_ context.Context, evt *event.Event) {
+	roomID := evt.RoomID.String()
+	a.substrateLock.RLock()
+	_, ok := a.SubscriptMessage[roomID]
+	a.substrateLock.RUnlock()
+	if !ok || evt.StateKey == nil || *evt.StateKey == a.SelfID {
+		return
+	}
+	content := evt.Content.AsMember()
+	prev := &event.MemberEventContent{Membership: event.MembershipLeave}
+	if p := evt.Unsigned.PrevContent; p != nil {
+		if err := p.ParseRaw(evt.Type); err == nil || errors.Is(err, event.ErrContentAlreadyParsed) {
+			prev = p.AsMember()
+		}
+	}
+	var tp model.MessageType
+	switch {
+	case content.Membership == event.MembershipJoin && prev.Membership != event.MembershipJoin:
+		tp = model.MessageTypeMemberJoin
+	case content.Membership == event.MembershipJoin && content.Displayname != prev.Displayname && len(prev.Displayname) != 0:
+		tp = model.MessageTypeMemberRename
+	case prev.Membership == event.MembershipJoin && (content.Membership == event.MembershipLeave || content.Membership == event.MembershipBan):
+		tp = model.MessageTypeMemberLeave
+	default:
+		return
+	}
+	userID := *evt.StateKey
+	name := content.Displayname
+	if tp == model.MessageTypeMemberLeave || len(name) == 0 {
+		name = prev.Displayname
+	}
+	user := &model.User{ID: userID, Name: formatUserDisplay(userID), DisplayName: name, Avatar: string(content.AvatarURL)}
+	if len(user.DisplayName) == 0 {
+		user.DisplayName = user.Name
+	}
+	channel := a.getChannelInfo(roomID)
+	a.lock.Lock()
+	if tp != model.MessageTypeMemberLeave {
+		a.Users[userID] = user
+	}
+	if tp != model.MessageTypeMemberRename {
+		channel.Members = model.SetMember(channel.Members, userID, tp == model.MessageTypeMemberJoin)
+	}
+	a.lock.Unlock()
+	msg := model.NewMemberMessage(model.MatrixType, channel, user, tp)
+	if tp == model.MessageTypeMemberRename {
+		msg.OldName = prev.Displayname
+	}
+	a.intake.Push(roomID, msg)
+}
@@ -5,6 +5,7 @@ import (
 	"context"
 	"strings"
 
+	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
 )
 
@@ -97,3 +98,53 @@ func formatUserDisplay(userId string) string {
 	userId = strings.TrimPrefix(userId, "@")
 	return strings.TrimSuffix(userId, ":matrix.org")
 }
+
+func (a *App) SetEventThread(eventID, rootID string) {
+	a.lock.Lock()
+	if len(a.eventThread) >= maxEventThread {
+		a.eventThread = make(map[string]string)
+	}
+	a.eventThread[eventID] = rootID
+	a.lock.Unlock()
+}
+
+// getEvent fetches the event and decrypts it when the room is encrypted.
+func (a *App) getEvent(ctx context.Context, roomID, eventID string) (*event.Event, error) {
+	evt, err := a.cli.GetEvent(ctx, id.RoomID(roomID), id.EventID(eventID))
+	if err != nil {
+		return nil, err
+	}
+	if evt.Type == event.EventEncrypted && a.cli.Crypto != nil {
+		if err = evt.Content.ParseRaw(evt.Type); err != nil {
+			return nil, err
+		}
+		if evt, err = a.cli.Crypto.Decrypt(ctx, evt); err != nil {
+			return nil, err
+		}
+	}
+	if evt.Content.Parsed == nil {
+		if err = evt.Content.ParseRaw(evt.Type); err != nil {
+			return nil, err
+		}
+	}
+	return evt, nil
+}
+
+// threadRoot returns the root of the thread which the event belongs to, or the event itself.
+func (a *App) threadRoot(ctx context.Context, roomID, eventID string) string {
+	a.lock.RLock()
+	root, ok := a.eventThread[eventID]
+	a.lock.RUnlock()
+	if ok {
+		return root
+	}
+	evt, err := a.getEvent(ctx, roomID, eventID)
+	if err != nil {
+		return eventID
+	}
+	if root := evt.Content.AsMessage().RelatesTo.GetThreadParent(); len(root) != 0 {
+		a.SetEventThread(eventID, root.String())
+		return root.String()
+	}
+	return eventID
+}
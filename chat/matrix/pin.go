@@ -0,0 +1,62 @@
+package matrix
+
+import (
+	"chatroom/model"
+	"context"
+	"errors"
+	"slices"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// pinEvent bridges the changes of the pinned events of the bridged rooms, the state holds the whole list
+// and is compared with the previous one.
+func (a *App) pinEvent(_ context.Context, evt *event.Event) {
+	roomID := evt.RoomID.String()
+	if evt.Sender.String() == a.SelfID {
+		return
+	}
+	var prev []id.EventID
+	if p := evt.Unsigned.PrevContent; p != nil {
+		if err := p.ParseRaw(evt.Type); err == nil || errors.Is(err, event.ErrContentAlreadyParsed) {
+			prev = p.AsPinnedEvents().Pinned
+		}
+	}
+	pinned := evt.Content.AsPinnedEvents().Pinned
+	channel := a.getChannelInfo(roomID)
+	user := a.getUserInfo(roomID, evt.Sender.String())
+	for _, v := range []struct {
+		from, to []id.EventID
+		tp       model.MessageType
+	}{{pinned, prev, model.MessageTypePin}, {prev, pinned, model.MessageTypeUnpin}} {
+		for _, eventID := range v.from {
+			if slices.Contains(v.to, eventID) {
+				continue
+			}
+			a.ReceiveMessage(&model.MatrixMessage{ID: eventID.String(), Type: v.tp, Channel: channel, User: user})
+		}
+	}
+}
+
+// setPinned adds or removes the event in the pinned events of the room.
+func setPinned(roomID, eventID string, pinned bool) error {
+	ctx := context.Background()
+	var content event.PinnedEventsEventContent
+	// 房间还没有置顶时没有这个状态
+	if err := app.cli.StateEvent(ctx, id.RoomID(roomID), event.StatePinnedEvents, "", &content); err != nil && !errors.Is(err, mautrix.MNotFound) {
+		return err
+	}
+	has := slices.Contains(content.Pinned, id.EventID(eventID))
+	if has == pinned {
+		return nil
+	}
+	if pinned {
+		content.Pinned = append(content.Pinned, id.EventID(eventID))
+	} else {
+		content.Pinned = slices.DeleteFunc(content.Pinned, func(v id.EventID) bool { return v == id.EventID(eventID) })
+	}
+	_, err := app.cli.SendStateEvent(ctx, id.RoomID(roomID), event.StatePinnedEvents, "", &content)
+	return err
+}
@@ -0,0 +1,154 @@
+package matrix
+
+import (
+	"chatroom/model"
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// pollEvent bridges the MSC3381 polls and their responses.
+func (a *App) pollEvent(ctx context.Context, evt *event.Event) {
+	roomID := evt.RoomID.String()
+	a.substrateLock.RLock()
+	_, ok := a.SubscriptMessage[roomID]
+	a.substrateLock.RUnlock()
+	if !ok {
+		return
+	}
+	switch evt.Type {
+	case event.EventUnstablePollStart:
+		content, ok := evt.Content.Parsed.(*event.PollStartEventContent)
+		if !ok {
+			return
+		}
+		poll, answers := pollOf(content)
+		a.setPollAnswers(evt.ID.String(), answers)
+		a.intake.Push(roomID, &model.PollMessage{
+			ID:      evt.ID.String(),
+			Type:    model.MessageTypePoll,
+			From:    model.MatrixType,
+			Channel: a.getChannelInfo(roomID),
+			User:    a.getUserInfo(roomID, evt.Sender.String()),
+			Poll:    poll,
+		})
+	case event.EventUnstablePollResponse:
+		content, ok := evt.Content.Parsed.(*event.PollResponseEventContent)
+		if !ok || len(content.RelatesTo.EventID) == 0 {
+			return
+		}
+		pollID := content.RelatesTo.EventID.String()
+		answers, err := a.pollAnswers(ctx, roomID, pollID)
+		if err != nil {
+			a.log.Printf("failed to get poll %s: %v", pollID, err)
+			return
+		}
+		var votes []int
+		for _, answer := range content.Response.Answers {
+			if i := slices.Index(answers, answer); i >= 0 {
+				votes = append(votes, i)
+			}
+		}
+		a.intake.Push(roomID, &model.PollMessage{
+			ID:      pollID,
+			Type:    model.MessageTypePollVote,
+			From:    model.MatrixType,
+			Channel: a.getChannelInfo(roomID),
+			User:    a.getUserInfo(roomID, evt.Sender.String()),
+			Votes:   votes,
+		})
+	}
+}
+
+// pollOf returns the poll and the answer ids in the order of the options.
+func pollOf(content *event.PollStartEventContent) (*model.Poll, []string) {
+	start := content.PollStart
+	poll := &model.Poll{Question: msc1767Text(start.Question), Multiple: start.MaxSelections > 1}
+	answers := make([]string, 0, len(start.Answers))
+	for _, answer := range start.Answers {
+		poll.Options = append(poll.Options, msc1767Text(answer.MSC1767Message))
+		answers = append(answers, answer.ID)
+	}
+	return poll, answers
+}
+
+func msc1767Text(m event.MSC1767Message) string {
+	if len(m.Text) != 0 || len(m.Message) == 0 {
+		return m.Text
+	}
+	return m.Message[0].Body
+}
+
+func (a *App) setPollAnswers(eventID string, answers []string) {
+	a.lock.Lock()
+	if len(a.pollAnswer) >= maxEventThread {
+		a.pollAnswer = make(map[string][]string)
+	}
+	a.pollAnswer[eventID] = answers
+	a.lock.Unlock()
+}
+
+// pollAnswers returns the answer ids of the poll, the polls started before this run are fetched.
+func (a *App) pollAnswers(ctx context.Context, roomID, eventID string) ([]string, error) {
+	a.lock.RLock()
+	answers, ok := a.pollAnswer[eventID]
+	a.lock.RUnlock()
+	if ok {
+		return answers, nil
+	}
+	evt, err := a.cli.GetEvent(ctx, id.RoomID(roomID), id.EventID(eventID))
+	if err != nil {
+		return nil, err
+	}
+	if err = evt.Content.ParseRaw(evt.Type); err != nil && !errors.Is(err, event.ErrContentAlreadyParsed) {
+		return nil, err
+	}
+	content, ok := evt.Content.Parsed.(*event.PollStartEventContent)
+	if !ok {
+		return nil, fmt.Errorf("event %s is not a poll", eventID)
+	}
+	_, answers = pollOf(content)
+	a.setPollAnswers(eventID, answers)
+	return answers, nil
+}
+
+// SendPoll starts a disclosed poll, the answer ids are the option numbers.
+func (c Chat) SendPoll(msg model.IChatMessage) (string, error) {
+	poll := model.PollOf(msg)
+	if poll == nil {
+		return c.SendMessage(msg)
+	}
+	question := fmt.Sprintf("[%s] %s: %s", msg.Source(), msg.BelongUser().UName(), poll.Question)
+	content := new(event.PollStartEventContent)
+	content.PollStart.Kind = "org.matrix.msc3381.poll.disclosed"
+	content.PollStart.MaxSelections = 1
+	if poll.Multiple {
+		content.PollStart.MaxSelections = len(poll.Options)
+	}
+	content.PollStart.Question.Text = question
+	answers := make([]string, 0, len(poll.Options))
+	fallback := []string{question}
+	for i, option := range poll.Options {
+		answer := strconv.Itoa(i)
+		content.PollStart.Answers = append(content.PollStart.Answers, struct {
+			ID string `json:"id"`
+			event.MSC1767Message
+		}{ID: answer, MSC1767Message: event.MSC1767Message{Text: option}})
+		answers = append(answers, answer)
+		fallback = append(fallback, fmt.Sprintf("%d. %s", i+1, option))
+	}
+	// 不支持投票的客户端显示文本
+	raw := map[string]any{"org.matrix.msc1767.text": strings.Join(fallback, "\n")}
+	rsp, err := app.cli.SendMessageEvent(context.Background(), id.RoomID(c.RoomId), event.EventUnstablePollStart, &event.Content{Parsed: content, Raw: raw})
+	if err != nil {
+		return "", err
+	}
+	app.setPollAnswers(rsp.EventID.String(), answers)
+	return rsp.EventID.String(), nil
+}
@@ -1,11 +1,15 @@
 package matrix
 
 import (
+	"chatroom/format"
+	"chatroom/identity"
 	"chatroom/model"
 	"context"
+	"errors"
 	"fmt"
-	"regexp"
+	"net/http"
 	"strings"
+	"time"
 
 	"maunium.net/go/mautrix"
 	"maunium.net/go/mautrix/event"
@@ -13,12 +17,13 @@ import (
 )
 
 type Chat struct {
-	RoomId string
+	RoomId   string
+	Template *format.Template
 }
 
-func NewMatrixChat(roomId string, receiveCh chan model.IChatMessage) *Chat {
+func NewMatrixChat(roomId string, receiveCh chan model.IChatMessage, tpl *format.Template) *Chat {
 	app.RegisterChannel(roomId, receiveCh)
-	return &Chat{RoomId: roomId}
+	return &Chat{RoomId: roomId, Template: tpl}
 }
 
 func (c Chat) ChannelID() string {
@@ -29,21 +34,35 @@ func (c Chat) Source() model.TypeSource {
 	return model.MatrixType
 }
 
-func (c Chat) mentionParsing(text string) string {
-	rgx := regexp.MustCompile(`@([^@\\s]*)\\s`)
-	userID := rgx.FindAllStringSubmatch(text, -1)
-	var args []string
-	for _, id := range userID {
-		if len(id) != 2 {
-			continue
-		}
-		user := app.SearchUserName(id[1])
-		if user == nil {
-			continue
+func (c Chat) Connected() bool {
+	return Connected()
+}
+
+func (c Chat) Members() []string {
+	var result []string
+	for _, uid := range app.getChannelInfo(c.RoomId).Members {
+		if uid != app.SelfID {
+			result = append(result, app.getUserInfo(c.RoomId, uid).UName())
 		}
-		args = append(args, id[0], "<@"+user.UID()+">")
 	}
-	return strings.NewReplacer(args...).Replace(text)
+	return result
+}
+
+// mentionParsing replaces the mentions with the display names of the linked matrix users, clients
+// highlight the display name in the body. The others are kept as they are.
+func (c Chat) mentionParsing(msg model.IChatMessage) string {
+	return identity.Translate(msg.Text(), msg.Mentions(), model.MatrixType, func(userID string) string {
+		return app.getUserInfo(c.RoomId, userID).UName()
+	})
+}
+
+// typingTimeout is how long the homeserver shows the bot typing unless it sends earlier.
+const typingTimeout = 5 * time.Second
+
+// Typing shows the bot typing in the room.
+func (c Chat) Typing() error {
+	_, err := app.cli.UserTyping(context.Background(), id.RoomID(c.RoomId), true, typingTimeout)
+	return err
 }
 
 func (c Chat) SendMessage(msg model.IChatMessage) (string, error) {
@@ -51,6 +70,7 @@ func (c Chat) SendMessage(msg model.IChatMessage) (string, error) {
 	if err != nil {
 		return "", err
 	}
+	c.sendMedia(msg.Attachment())
 	if rsp != nil {
 		return rsp.EventID.String(), nil
 	}
@@ -62,25 +82,57 @@ func (c Chat) SendReplyMessage(parentID string, msg model.IChatMessage) (string,
 	var err error
 	if len(parentID) == 0 {
 		rsp, err = app.cli.SendText(context.Background(), id.RoomID(c.RoomId), fmt.Sprintf("%s\n[Reply Message, Parent message not found]", c.formatText(msg)))
-	} else {
+	} else if msg.InThread() {
+		root := app.threadRoot(context.Background(), c.RoomId, parentID)
 		rsp, err = app.cli.SendMessageEvent(context.Background(), id.RoomID(c.RoomId), event.EventMessage, &event.MessageEventContent{
-			MsgType: event.MsgText,
-			Body:    c.formatText(msg),
-			RelatesTo: &event.RelatesTo{
-				Type:    event.RelThread,
-				EventID: id.EventID(parentID),
-			},
+			MsgType:   event.MsgText,
+			Body:      c.formatText(msg),
+			RelatesTo: (&event.RelatesTo{}).SetThread(id.EventID(root), id.EventID(parentID)),
 		})
+		if err == nil && rsp != nil {
+			app.SetEventThread(rsp.EventID.String(), root)
+		}
+	} else {
+		content := &event.MessageEventContent{
+			MsgType:   event.MsgText,
+			Body:      c.formatText(msg),
+			RelatesTo: (&event.RelatesTo{}).SetReplyTo(id.EventID(parentID)),
+		}
+		if parent, err := app.getEvent(context.Background(), c.RoomId, parentID); err == nil {
+			content.Body = replyFallback(parent) + content.Body
+		}
+		rsp, err = app.cli.SendMessageEvent(context.Background(), id.RoomID(c.RoomId), event.EventMessage, content)
 	}
 	if err != nil {
 		return "", err
 	}
+	c.sendMedia(msg.Attachment())
 	if rsp != nil {
 		return rsp.EventID.String(), nil
 	}
 	return "", nil
 }
 
+// replyFallback quotes the parent for clients which do not render m.in_reply_to.
+func replyFallback(parent *event.Event) string {
+	content := parent.Content.AsMessage()
+	content.RemoveReplyFallback()
+	if len(strings.TrimSpace(content.Body)) == 0 {
+		return ""
+	}
+	lines := strings.Split(strings.TrimSpace(content.Body), "\n")
+	var b strings.Builder
+	for i, line := range lines {
+		if i == 0 {
+			b.WriteString(fmt.Sprintf("> <%s> %s\n", parent.Sender, line))
+			continue
+		}
+		b.WriteString("> " + line + "\n")
+	}
+	b.WriteString("\n")
+	return b.String()
+}
+
 func (c Chat) UpdateMessage(messageID string, msg model.IChatMessage) error {
 	var rsp *mautrix.RespSendEvent
 	var err error
@@ -127,15 +179,35 @@ func (c Chat) RemoveReactionAll(messageID string) error {
 	return nil
 }
 
+// Pin adds the event to the pinned events of the room, the bot needs the power level to change the state.
+func (c Chat) Pin(messageID string) error {
+	return setPinned(c.RoomId, messageID, true)
+}
+
+func (c Chat) Unpin(messageID string) error {
+	return setPinned(c.RoomId, messageID, false)
+}
+
+// formatText renders the bridged text with the template of the chat.
 func (c Chat) formatText(msg model.IChatMessage) string {
-	var text string
-	if msg.Source() == c.Source() {
-		text = fmt.Sprintf("From: [%s] User: [%s] Send: \n%s", msg.BelongChannel().CName(), msg.BelongUser().UName(), msg.RawText())
-	} else {
-		text = fmt.Sprintf("From: [%s] User: [%s] Send: \n%s", msg.Source(), msg.BelongUser().UName(), c.mentionParsing(msg.Text()))
+	return c.Template.Render(msg, c.Source(), c.mentionParsing(msg))
+}
+
+// RetryAfter reports the rate limit delay of the homeserver, server errors are retried with the outbox backoff.
+func (c Chat) RetryAfter(err error) (time.Duration, bool) {
+	var httpErr mautrix.HTTPError
+	if !errors.As(err, &httpErr) {
+		return 0, false
+	}
+	if httpErr.RespError != nil && httpErr.RespError.ErrCode == mautrix.MLimitExceeded.ErrCode {
+		if ms, ok := httpErr.RespError.ExtraData["retry_after_ms"].(float64); ok {
+			return time.Duration(ms) * time.Millisecond, true
+		}
+		return 0, true
 	}
-	if att := msg.Attachment(); len(att) != 0 {
-		text += model.Attachments(att).String()
+	if httpErr.Response != nil {
+		code := httpErr.Response.StatusCode
+		return 0, code == http.StatusTooManyRequests || code >= http.StatusInternalServerError
 	}
-	return text
+	return 0, false
 }
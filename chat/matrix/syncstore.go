@@ -0,0 +1,47 @@
+package matrix
+
+import (
+	"chatroom/model"
+	"chatroom/store"
+	"context"
+	"fmt"
+	"sync"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
+)
+
+// syncStore keeps the sync token in the bridge state, the token is saved before the response is processed,
+// so the bridge stores the previous one and replays the last response after a crash, duplicates are skipped by the rooms.
+type syncStore struct {
+	mautrix.SyncStore
+	lock sync.Mutex
+	prev string
+}
+
+func nextBatchKey(userID id.UserID) string {
+	return fmt.Sprintf("%s:%s:nextBatch", model.MatrixType, userID)
+}
+
+func (s *syncStore) SaveNextBatch(ctx context.Context, userID id.UserID, nextBatchToken string) error {
+	if err := s.SyncStore.SaveNextBatch(ctx, userID, nextBatchToken); err != nil {
+		return err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if len(s.prev) != 0 {
+		if err := store.Put(cursorBucket, nextBatchKey(userID), s.prev); err != nil {
+			return err
+		}
+	}
+	s.prev = nextBatchToken
+	return nil
+}
+
+func (s *syncStore) LoadNextBatch(ctx context.Context, userID id.UserID) (string, error) {
+	var token string
+	if store.Get(cursorBucket, nextBatchKey(userID), &token) {
+		return token, nil
+	}
+	return s.SyncStore.LoadNextBatch(ctx, userID)
+}
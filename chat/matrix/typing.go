@@ -0,0 +1,27 @@
+package matrix
+
+import (
+	"chatroom/model"
+
+	"maunium.net/go/mautrix/event"
+)
+
+// typingEvent bridges the users starting to type, m.typing lists every user typing in the room
+// and is sent again whenever the list changes.
+func (a *App) typingEvent(evt *event.Event) {
+	roomID := evt.RoomID.String()
+	a.substrateLock.RLock()
+	_, ok := a.SubscriptMessage[roomID]
+	a.substrateLock.RUnlock()
+	if !ok {
+		return
+	}
+	content := evt.Content.AsTyping()
+	channel := a.getChannelInfo(roomID)
+	for _, userID := range content.UserIDs {
+		if userID.String() == a.SelfID {
+			continue
+		}
+		a.intake.Push(roomID, model.NewTypingMessage(model.MatrixType, channel, a.getUserInfo(roomID, userID.String())))
+	}
+}
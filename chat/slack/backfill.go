@@ -0,0 +1,135 @@
+package slack
+
+import (
+	"chatroom/conf"
+	"chatroom/model"
+	"chatroom/store"
+	"chatroom/utils"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/slack-go/slack"
+)
+
+const cursorBucket = "cursor"
+
+// cursor returns the timestamp of the last message seen in the channel.
+func (c *App) cursor(channelID string) string {
+	var ts string
+	store.Get(cursorBucket, fmt.Sprintf("%s:%s", model.SlackType, channelID), &ts)
+	return ts
+}
+
+// advance moves the cursor of the channel forward.
+func (c *App) advance(channelID, ts string) {
+	c.cursorLock.Lock()
+	defer c.cursorLock.Unlock()
+	if utils.ParseSlackTimestamp(ts) <= utils.ParseSlackTimestamp(c.cursor(channelID)) {
+		return
+	}
+	if err := store.Put(cursorBucket, fmt.Sprintf("%s:%s", model.SlackType, channelID), ts); err != nil {
+		c.log.Printf("failed to save cursor of channel %s: %v", channelID, err)
+	}
+}
+
+// track advances the cursor of the channel once the rooms consumed the message.
+func (c *App) track(msg *model.SlackMessage) {
+	if msg.Type == model.MessageTypeTextCreate || msg.Type == model.MessageTypeTextReply {
+		channelID, ts := msg.Channel.CID(), msg.ID
+		msg.OnAck(func() { c.advance(channelID, ts) })
+	}
+}
+
+// backfill replays the messages posted after the cursor, the rooms skip the ones already bridged. The caller holds
+// the intake of the channel, the live events received meanwhile are queued after the history.
+func (c *App) backfill(channelID, since string) {
+	var history []model.IChatMessage
+	defer func() { c.intake.Release(channelID, history...) }()
+	limit := utils.Default(conf.Conf.Backfill.Limit, func(v int) bool { return v != 0 }, 100)
+	if len(since) == 0 || limit < 0 {
+		return
+	}
+	maxAge := utils.Default(conf.Conf.Backfill.MaxAge, func(v time.Duration) bool { return v > 0 }, 24*time.Hour)
+	if oldest := time.Now().Add(-maxAge); utils.ParseSlackTimestamp(since) < oldest.UnixNano() {
+		since = fmt.Sprintf("%d.000000", oldest.Unix())
+	}
+	var messages []slack.Message
+	params := &slack.GetConversationHistoryParameters{ChannelID: channelID, Oldest: since, Limit: 100}
+	for len(messages) < limit {
+		rsp, err := c.cli.GetConversationHistory(params)
+		if err != nil {
+			c.log.Printf("failed to get history of channel %s: %v", channelID, err)
+			break
+		}
+		messages = append(messages, rsp.Messages...)
+		if !rsp.HasMore || len(rsp.ResponseMetaData.NextCursor) == 0 {
+			break
+		}
+		params.Cursor = rsp.ResponseMetaData.NextCursor
+	}
+	// 历史记录只有线程的父消息, 线程内的新回复需要单独获取
+	for _, m := range messages {
+		if m.ReplyCount == 0 || utils.ParseSlackTimestamp(m.LatestReply) <= utils.ParseSlackTimestamp(since) {
+			continue
+		}
+		replies, _, _, err := c.cli.GetConversationReplies(&slack.GetConversationRepliesParameters{ChannelID: channelID, Timestamp: m.Timestamp, Oldest: since, Limit: 100})
+		if err != nil {
+			c.log.Printf("failed to get replies of message %s in channel %s: %v", m.Timestamp, channelID, err)
+			continue
+		}
+		for _, reply := range replies {
+			if reply.Timestamp != m.Timestamp {
+				messages = append(messages, reply)
+			}
+		}
+	}
+	sort.Slice(messages, func(i, j int) bool {
+		return utils.ParseSlackTimestamp(messages[i].Timestamp) < utils.ParseSlackTimestamp(messages[j].Timestamp)
+	})
+	if len(messages) > limit {
+		messages = messages[len(messages)-limit:]
+	}
+	c.log.Printf("backfill %d messages of channel %s since %s", len(messages), channelID, since)
+	for _, m := range messages {
+		if msg := c.historyMessage(channelID, m); msg != nil {
+			c.track(msg)
+			history = append(history, msg)
+		}
+	}
+}
+
+func (c *App) historyMessage(channelID string, m slack.Message) *model.SlackMessage {
+	switch m.SubType {
+	case "", "file_share", "thread_broadcast":
+	default:
+		return nil
+	}
+	if m.User == c.SelfID || (len(m.BotID) != 0 && m.BotID == c.BotID) {
+		return nil // 跳过服务自身消息
+	}
+	msg := new(model.SlackMessage)
+	msg.Channel = utils.Default(c.GetChannelInfo(channelID), func(v *model.ChannelInfo) bool { return v != nil }, model.NewChannelInfo(channelID))
+	msg.ID = m.Timestamp
+	msg.Type = model.MessageTypeTextCreate
+	msg.User = utils.Default(c.GetUserInfo(m.User), func(v *model.User) bool { return v != nil }, model.NewUserInfo(m.User))
+	msg.Message, msg.Mentioned = c.ContentWithMentionsReplaced(m.Text)
+	msg.Message = c.ContentWithEmojiReplaced(msg.Message)
+	msg.RawMessage = m.Text
+	msg.SendTime = utils.ParseSlackTimestamp(m.Timestamp)
+	if len(m.ThreadTimestamp) != 0 && m.ThreadTimestamp != m.Timestamp {
+		msg.Type = model.MessageTypeTextReply
+		msg.ParentID = m.ThreadTimestamp
+	}
+	for _, file := range m.Files {
+		msg.Attachments = append(msg.Attachments, model.Attachment{
+			Name:      file.Name,
+			Type:      file.Mimetype,
+			URL:       file.URLPrivate,
+			Width:     file.OriginalW,
+			Height:    file.OriginalH,
+			Thumbnail: file.Thumb360,
+		})
+	}
+	return msg
+}
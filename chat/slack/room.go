@@ -1,21 +1,26 @@
 package slack
 
 import (
+	"chatroom/format"
+	"chatroom/identity"
 	"chatroom/model"
+	"errors"
 	"fmt"
-	"regexp"
-	"strings"
+	"net/http"
+	"time"
 
 	"github.com/slack-go/slack"
 )
 
+// Chat does not show typing, slack only has typing indicators on the rtm api.
 type Chat struct {
-	Channel string
+	Channel  string
+	Template *format.Template
 }
 
-func NewSlackChat(channelID string, receiveCh chan model.IChatMessage) *Chat {
+func NewSlackChat(channelID string, receiveCh chan model.IChatMessage, tpl *format.Template) *Chat {
 	app.RegisterChannel(channelID, receiveCh)
-	return &Chat{Channel: channelID}
+	return &Chat{Channel: channelID, Template: tpl}
 }
 
 func (c Chat) ChannelID() string {
@@ -26,21 +31,35 @@ func (c Chat) Source() model.TypeSource {
 	return model.SlackType
 }
 
-func (c Chat) mentionParsing(text string) string {
-	rgx := regexp.MustCompile(`@([^@\\s]*)\\s`)
-	userID := rgx.FindAllStringSubmatch(text, -1)
-	var args []string
-	for _, id := range userID {
-		if len(id) != 2 {
-			continue
-		}
-		user := app.SearchUserName(id[1])
-		if user == nil {
-			continue
+func (c Chat) Connected() bool {
+	return Connected()
+}
+
+func (c Chat) Members() []string {
+	info := app.GetChannelInfo(c.Channel)
+	if info == nil {
+		return nil
+	}
+	var result []string
+	for _, user := range app.GetUsersInfo(info.Members...) {
+		if !user.IsBot() {
+			result = append(result, user.UName())
 		}
-		args = append(args, id[0], "<@"+user.UID()+">")
 	}
-	return strings.NewReplacer(args...).Replace(text)
+	return result
+}
+
+// mentionParsing replaces the mentions with the linked slack users, the others are kept as they are.
+func (c Chat) mentionParsing(msg model.IChatMessage) string {
+	return identity.Translate(msg.Text(), msg.Mentions(), model.SlackType, func(userID string) string {
+		return "<@" + userID + ">"
+	})
+}
+
+// Whisper sends an ephemeral message which only the user sees.
+func (c Chat) Whisper(userID, text string) error {
+	_, err := app.cli.PostEphemeral(c.Channel, userID, slack.MsgOptionText(text, false))
+	return err
 }
 
 func (c Chat) SendMessage(msg model.IChatMessage) (string, error) {
@@ -90,15 +109,28 @@ func (c Chat) RemoveReactionAll(messageID string) error {
 	return err
 }
 
+func (c Chat) Pin(messageID string) error {
+	return app.cli.AddPin(c.Channel, slack.ItemRef{Channel: c.Channel, Timestamp: messageID})
+}
+
+func (c Chat) Unpin(messageID string) error {
+	return app.cli.RemovePin(c.Channel, slack.ItemRef{Channel: c.Channel, Timestamp: messageID})
+}
+
+// formatText renders the bridged text with the template of the chat.
 func (c Chat) formatText(msg model.IChatMessage) string {
-	var text string
-	if msg.Source() == c.Source() {
-		text = fmt.Sprintf("From: [%s] User: [%s] Send: \n%s", msg.BelongChannel().CName(), msg.BelongUser().UName(), msg.RawText())
-	} else {
-		text = fmt.Sprintf("From: [%s] User: [%s] Send: \n%s", msg.Source(), msg.BelongUser().UName(), c.mentionParsing(msg.Text()))
+	return c.Template.Render(msg, c.Source(), c.mentionParsing(msg))
+}
+
+// RetryAfter reports the rate limit delay of slack, server errors are retried with the outbox backoff.
+func (c Chat) RetryAfter(err error) (time.Duration, bool) {
+	var rateErr *slack.RateLimitedError
+	if errors.As(err, &rateErr) {
+		return rateErr.RetryAfter, true
 	}
-	if att := msg.Attachment(); len(att) != 0 {
-		text += model.Attachments(att).String()
+	var statusErr slack.StatusCodeError
+	if errors.As(err, &statusErr) && statusErr.Code >= http.StatusInternalServerError {
+		return 0, true
 	}
-	return text
+	return 0, false
 }
@@ -5,13 +5,17 @@ import (
 	"chatroom/emoji"
 	"chatroom/model"
 	"chatroom/utils"
+	"chatroom/utils/queue"
 	"context"
 	"encoding/json"
+	"errors"
 	"log"
 	"os"
 	"regexp"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/slack-go/slack"
 	"github.com/slack-go/slack/slackevents"
@@ -27,17 +31,28 @@ type baseInfo struct {
 
 	SubscriptMessage map[string][]chan model.IChatMessage
 	substrateLock    sync.RWMutex
+	cursorLock       sync.Mutex
+	intake           *queue.Serial[model.IChatMessage]
 	lock             sync.RWMutex
 }
 
 type App struct {
 	baseInfo
 	cli *socketmode.Client
-	log *log.Logger
+	// done 在 socket mode 连接关闭后关闭
+	done      chan struct{}
+	connected atomic.Int32
+	online    atomic.Bool
+	log       *log.Logger
 }
 
 var app *App
 
+var (
+	mentionPrefix = regexp.MustCompile(`^\s*<@([UW][A-Z0-9]+)(?:\|[^>]*)?>`)
+	userMention   = regexp.MustCompile(`<@([UW][A-Z0-9]+)(?:\|[^>]*)?>`)
+)
+
 func NewClient(ctx context.Context, conf conf.Slack) {
 	if len(conf.Token) == 0 {
 		return
@@ -69,6 +84,12 @@ func NewClient(ctx context.Context, conf conf.Slack) {
 }
 
 func (c *App) init() {
+	c.intake = queue.NewSerial(conf.Conf.Receive.QueueSize, c.publish)
+	c.syncInfo()
+}
+
+// syncInfo loads the bridged channels and their members into the cache.
+func (c *App) syncInfo() {
 	channelIds := conf.Conf.GetSlackChat()
 	var userIds []string
 	for _, info := range c.GetChannelsInfo(channelIds...) {
@@ -80,71 +101,203 @@ func (c *App) init() {
 	c.GetUsersInfo(userIds...)
 }
 
+// eventLoop handles the socket mode events one by one, the socketmode handler runs every event
+// in its own goroutine and loses the order of the messages.
 func (c *App) eventLoop(ctx context.Context) error {
-	handler := socketmode.NewSocketmodeHandler(c.cli)
-	handler.Handle(socketmode.EventTypeConnecting, func(_ *socketmode.Event, _ *socketmode.Client) {
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case event, ok := <-c.cli.Events:
+				if !ok {
+					return
+				}
+				c.handlerEvent(event)
+			}
+		}
+	}()
+	c.done = make(chan struct{})
+	go func() {
+		defer close(c.done)
+		if err := c.cli.RunContext(ctx); err != nil && !errors.Is(err, context.Canceled) {
+			c.log.Println(err.Error())
+		}
+	}()
+	return nil
+}
+
+// Connected reports whether the socket mode connection is up.
+func Connected() bool {
+	return app != nil && app.online.Load()
+}
+
+// Refresh drops the cached users and channels and loads them again.
+func Refresh() {
+	if app == nil {
+		return
+	}
+	app.lock.Lock()
+	app.Users = make(map[string]*model.User)
+	app.ChannelInfo = make(map[string]*model.ChannelInfo)
+	app.lock.Unlock()
+	app.syncInfo()
+}
+
+// StopIntake stops queuing the platform events, the events already queued still reach the rooms.
+func StopIntake() {
+	if app == nil || app.intake == nil {
+		return
+	}
+	app.intake.Stop()
+}
+
+// Close waits for the socket mode connection to be closed, it is closed when the context is done.
+func Close() {
+	if app == nil || app.done == nil {
+		return
+	}
+	select {
+	case <-app.done:
+	case <-time.After(5 * time.Second):
+		app.log.Println("timeout waiting for socket mode connection to close")
+	}
+}
+
+func (c *App) handlerEvent(event socketmode.Event) {
+	switch event.Type {
+	case socketmode.EventTypeConnecting:
 		c.log.Println("connecting")
-	})
-	handler.Handle(socketmode.EventTypeConnectionError, func(_ *socketmode.Event, _ *socketmode.Client) {
+	case socketmode.EventTypeConnectionError:
 		c.log.Println("Connection failed. Retrying later...")
-	})
-	handler.Handle(socketmode.EventTypeHello, func(_ *socketmode.Event, _ *socketmode.Client) {
+		c.online.Store(false)
+	case socketmode.EventTypeDisconnect:
+		c.log.Println("Disconnected")
+		c.online.Store(false)
+	case socketmode.EventTypeHello:
 		//for _, id := range c.getChannelIds() {
 		//	if channel, _, err := client.PostMessage(id, slack.MsgOptionText("sync message online", true)); err != nil {
 		//		log.Printf("failed to send message. channel [%s], err: %s", channel, err.Error())
 		//	}
 		//}
 		c.log.Println("success receive message.")
-	})
-	handler.Handle(socketmode.EventTypeConnected, func(_ *socketmode.Event, _ *socketmode.Client) {
+	case socketmode.EventTypeConnected:
 		c.log.Println("Connected")
-	})
-	handler.Handle(socketmode.EventTypeEventsAPI, func(event *socketmode.Event, _ *socketmode.Client) {
+		c.online.Store(true)
+		// 重连后补齐断线期间的消息
+		if c.connected.Add(1) > 1 {
+			for _, channelID := range c.channels() {
+				c.intake.Hold(channelID)
+				go c.backfill(channelID, c.cursor(channelID))
+			}
+		}
+	case socketmode.EventTypeEventsAPI:
 		apiEvent, ok := event.Data.(slackevents.EventsAPIEvent)
 		if !ok {
 			return
 		}
 		c.cli.Ack(*event.Request)
 		c.handlerMessage(apiEvent)
-	})
-	handler.Handle(socketmode.EventTypeSlashCommand, func(event *socketmode.Event, client *socketmode.Client) {
+	case socketmode.EventTypeSlashCommand:
 		cmd, ok := event.Data.(slack.SlashCommand)
 		if !ok {
 			c.log.Printf("Ignored %+v\n", event)
 			return
 		}
-		client.Debugf("Slash command received: %+v", cmd)
-	})
-	//handler.HandleSlashCommand("/users", func(event *socketmode.Event, client *socketmode.Client) {
-	//	cmd, ok := event.Data.(slack.SlashCommand)
-	//	if !ok {
-	//		log.Printf("Ignored %+v\n", event)
-	//		return
-	//	}
-	//	client.Debugf("Slash command received: %+v", cmd)
-	//})
-	go func() {
-		if err := handler.RunEventLoopContext(ctx); err != nil {
-			c.log.Println(err.Error())
-		}
-	}()
-	return nil
+		c.cli.Ack(*event.Request)
+		c.cli.Debugf("Slash command received: %+v", cmd)
+		// 斜杠命令按文本命令执行, /bridge status 等同于 !bridge status
+		c.command(cmd.ChannelID, cmd.UserID, cmd.Text)
+	}
+}
+
+// command queues a bridge command of the user to the rooms of the channel.
+func (c *App) command(channelID, userID, args string) {
+	msg := new(model.SlackMessage)
+	msg.Type = model.MessageTypeTextCreate
+	msg.Channel = utils.Default(c.GetChannelInfo(channelID), func(v *model.ChannelInfo) bool { return v != nil }, model.NewChannelInfo(channelID))
+	msg.User = utils.Default(c.GetUserInfo(userID), func(v *model.User) bool { return v != nil }, model.NewUserInfo(userID))
+	msg.Message = model.CommandText(args)
+	msg.RawMessage = msg.Message
+	c.ReceiveMessage(msg)
 }
 
+// mentionCommand returns the arguments of a message which starts with a mention of the bot and a bridge command,
+// e.g. "@bridge status". A mention followed by other text is an ordinary message.
+func (c *App) mentionCommand(text string) (string, bool) {
+	m := mentionPrefix.FindStringSubmatchIndex(text)
+	if m == nil || text[m[2]:m[3]] != c.SelfID {
+		return "", false
+	}
+	args := text[m[1]:]
+	if fields := strings.Fields(args); len(fields) == 0 || !model.IsCommandName(fields[0]) {
+		return "", false
+	}
+	return args, true
+}
+
+// memberEvent updates the members of the channel and queues the join or leave to the rooms.
+// The slack api of this version has no user_change event, renames are not bridged.
+func (c *App) memberEvent(channelID, userID string, tp model.MessageType) {
+	c.substrateLock.RLock()
+	_, ok := c.SubscriptMessage[channelID]
+	c.substrateLock.RUnlock()
+	if !ok || userID == c.SelfID {
+		return
+	}
+	channel := utils.Default(c.GetChannelInfo(channelID), func(v *model.ChannelInfo) bool { return v != nil }, model.NewChannelInfo(channelID))
+	c.lock.Lock()
+	channel.Members = model.SetMember(channel.Members, userID, tp == model.MessageTypeMemberJoin)
+	c.lock.Unlock()
+	user := utils.Default(c.GetUserInfo(userID), func(v *model.User) bool { return v != nil }, model.NewUserInfo(userID))
+	c.intake.Push(channelID, model.NewMemberMessage(model.SlackType, channel, user, tp))
+}
+
+// ReceiveMessage queues the message by channel, the messages of a channel reach the rooms in order.
 func (c *App) ReceiveMessage(msg *model.SlackMessage) {
+	c.substrateLock.RLock()
+	_, ok := c.SubscriptMessage[msg.Channel.CID()]
+	c.substrateLock.RUnlock()
+	if !ok {
+		return
+	}
+	c.track(msg)
+	c.intake.Push(msg.Channel.CID(), msg)
+}
+
+func (c *App) channels() []string {
+	c.substrateLock.RLock()
+	defer c.substrateLock.RUnlock()
+	var result []string
+	for channelID := range c.SubscriptMessage {
+		result = append(result, channelID)
+	}
+	return result
+}
+
+func (c *App) publish(msg model.IChatMessage) {
 	var chs []chan model.IChatMessage
 	c.substrateLock.RLock()
-	chs = append(chs, c.SubscriptMessage[msg.Channel.CID()]...)
+	chs = append(chs, c.SubscriptMessage[msg.BelongChannel().CID()]...)
 	c.substrateLock.RUnlock()
+	if r, ok := msg.(model.Acked); ok {
+		r.Expect(len(chs))
+	}
 	for _, ch := range chs {
 		ch <- msg
 	}
 }
 
 func (c *App) RegisterChannel(channelID string, ch chan model.IChatMessage) {
+	since := c.cursor(channelID)
 	c.substrateLock.Lock()
+	first := len(c.SubscriptMessage[channelID]) == 0
 	c.SubscriptMessage[channelID] = append(c.SubscriptMessage[channelID], ch)
 	c.substrateLock.Unlock()
+	if first {
+		c.intake.Hold(channelID)
+		go c.backfill(channelID, since)
+	}
 }
 
 func (c *App) handlerMessage(event slackevents.EventsAPIEvent) {
@@ -153,12 +306,13 @@ func (c *App) handlerMessage(event slackevents.EventsAPIEvent) {
 		innerEvent := event.InnerEvent
 		switch ev := innerEvent.Data.(type) {
 		case *slackevents.AppMentionEvent:
-			_, _, err := c.cli.PostMessage(ev.Channel, slack.MsgOptionText("Yes, hello.", false))
-			if err != nil {
-				c.log.Printf("failed posting message: %v", err)
-			}
+			// 同一条消息还会收到 MessageEvent, 以提及开头的命令在那里执行
 		case *slackevents.MemberJoinedChannelEvent:
 			c.log.Printf("user %q joined to channel %q", ev.User, ev.Channel)
+			c.memberEvent(ev.Channel, ev.User, model.MessageTypeMemberJoin)
+		case *slackevents.MemberLeftChannelEvent:
+			c.log.Printf("user %q left channel %q", ev.User, ev.Channel)
+			c.memberEvent(ev.Channel, ev.User, model.MessageTypeMemberLeave)
 		case *slackevents.ChannelLeftEvent:
 			c.log.Printf(" %q left to channel %q", ev.EventTimestamp, ev.Channel)
 		case *slackevents.MessageEvent:
@@ -178,15 +332,16 @@ func (c *App) handlerMessage(event slackevents.EventsAPIEvent) {
 					}
 					msg.ID = ev.Message.TimeStamp
 					msg.User = utils.Default(c.GetUserInfo(ev.Message.User), func(v *model.User) bool { return v != nil }, model.NewUserInfo(ev.User))
-					msg.Message = c.ContentWithEmojiReplaced(c.ContentWithMentionsReplaced(ev.Message.Text))
+					msg.Message, msg.Mentioned = c.ContentWithMentionsReplaced(ev.Message.Text)
+					msg.Message = c.ContentWithEmojiReplaced(msg.Message)
 					msg.RawMessage = ev.Message.Text
 					for _, file := range ev.Message.Files {
-						msg.Attachments = append(msg.Attachments, model.Attachment{
-							Name: file.Name,
-							Type: file.Mimetype,
-							URL:  file.URLPrivate,
-						})
+						msg.Attachments = append(msg.Attachments, fileAttachment(file))
 					}
+				case "channel_join", "channel_leave":
+					return // 由 member_joined_channel 和 member_left_channel 桥接
+				case "pinned_item", "unpinned_item":
+					return // 由 pin_added 和 pin_removed 桥接
 				case "message_deleted":
 					msg.Type = model.MessageTypeTextDelete
 					if ev.PreviousMessage == nil {
@@ -204,22 +359,24 @@ func (c *App) handlerMessage(event slackevents.EventsAPIEvent) {
 					msg.ID = ev.TimeStamp
 					msg.Type = model.MessageTypeTextCreate
 					msg.User = utils.Default(c.GetUserInfo(ev.User), func(v *model.User) bool { return v != nil }, model.NewUserInfo(ev.User))
-					msg.Message = c.ContentWithEmojiReplaced(c.ContentWithMentionsReplaced(ev.Text))
+					msg.Message, msg.Mentioned = c.ContentWithMentionsReplaced(ev.Text)
+					msg.Message = c.ContentWithEmojiReplaced(msg.Message)
 					msg.RawMessage = ev.Text
+					// @bridge status 按命令执行, 不再作为普通消息桥接
+					if args, ok := c.mentionCommand(ev.Text); ok {
+						msg.Message = model.CommandText(args)
+						msg.RawMessage = msg.Message
+					}
 					msg.SendTime = utils.ParseSlackTimestamp(ev.TimeStamp)
 					if len(ev.ThreadTimeStamp) != 0 {
 						msg.Type = model.MessageTypeTextReply
 						msg.ParentID = ev.ThreadTimeStamp
 					}
 					for _, file := range ev.Files {
-						msg.Attachments = append(msg.Attachments, model.Attachment{
-							Name: file.Name,
-							Type: file.Mimetype,
-							URL:  file.URLPrivate,
-						})
+						msg.Attachments = append(msg.Attachments, fileAttachment(file))
 					}
 				}
-				go c.ReceiveMessage(msg)
+				c.ReceiveMessage(msg)
 			default: // im | mim
 				return
 			}
@@ -239,7 +396,7 @@ func (c *App) handlerMessage(event slackevents.EventsAPIEvent) {
 			msg.Reaction = &model.SlackReaction{
 				Data: ev.Reaction,
 			}
-			go c.ReceiveMessage(msg)
+			c.ReceiveMessage(msg)
 			c.log.Printf("receive reaction add: %+#v\n", ev)
 		case *slackevents.ReactionRemovedEvent:
 			if ev.User == c.SelfID {
@@ -253,8 +410,12 @@ func (c *App) handlerMessage(event slackevents.EventsAPIEvent) {
 			msg.Reaction = &model.SlackReaction{
 				Data: ev.Reaction,
 			}
-			go c.ReceiveMessage(msg)
+			c.ReceiveMessage(msg)
 			c.log.Printf("receive reaction remove: %+#v\n", ev)
+		case *slackevents.PinAddedEvent:
+			c.pinEvent(slackevents.PinAddedEvent(*ev), model.MessageTypePin)
+		case *slackevents.PinRemovedEvent:
+			c.pinEvent(slackevents.PinAddedEvent(*ev), model.MessageTypeUnpin)
 		default:
 			c.cli.Debugf("unsupported Callback Events API %s received", innerEvent.Type)
 		}
@@ -265,6 +426,27 @@ func (c *App) handlerMessage(event slackevents.EventsAPIEvent) {
 	}
 }
 
+// pinEvent bridges a message pinned or unpinned in a channel, other pinned items like files are ignored.
+func (c *App) pinEvent(ev slackevents.PinAddedEvent, tp model.MessageType) {
+	if ev.User == c.SelfID {
+		return // 跳过服务自身的置顶
+	}
+	if ev.Item.Type != "message" {
+		return
+	}
+	msg := new(model.SlackMessage)
+	msg.ID = ev.Item.Timestamp
+	if ev.Item.Message != nil {
+		msg.ID = ev.Item.Message.Timestamp
+	}
+	msg.Type = tp
+	channelID := utils.Default(ev.Item.Channel, func(v string) bool { return len(v) != 0 }, ev.Channel)
+	msg.Channel = utils.Default(c.GetChannelInfo(channelID), func(v *model.ChannelInfo) bool { return v != nil }, model.NewChannelInfo(channelID))
+	msg.User = utils.Default(c.GetUserInfo(ev.User), func(v *model.User) bool { return v != nil }, model.NewUserInfo(ev.User))
+	c.ReceiveMessage(msg)
+	c.log.Printf("receive pin event %d: %+#v\n", tp, ev)
+}
+
 func (c *App) getChannelIds() []string {
 	c.lock.RLock()
 	result := make([]string, 0, len(c.ChannelInfo))
@@ -332,18 +514,6 @@ func (c *App) GetChannelsInfo(channelIds ...string) map[string]*model.ChannelInf
 	return result
 }
 
-func (c *App) SearchUserName(name string) *model.User {
-	var result *model.User
-	c.lock.RLock()
-	for _, user := range c.Users {
-		if strings.EqualFold(user.UName(), name) {
-			result = user
-		}
-	}
-	c.lock.RUnlock()
-	return result
-}
-
 func (c *App) GetUserInfo(userID string) *model.User {
 	if v := c.GetUsersInfo(userID); len(v) != 0 {
 		return v[userID]
@@ -392,21 +562,19 @@ func (c *App) GetUsersInfo(userIds ...string) map[string]*model.User {
 	return result
 }
 
-func (c *App) ContentWithMentionsReplaced(text string) string {
-	rgx := regexp.MustCompile(`<@([^@\\s]*)\\s>`)
-	userID := rgx.FindAllStringSubmatch(text, -1)
+// ContentWithMentionsReplaced replaces <@U0123> with @name and returns the mentioned users.
+func (c *App) ContentWithMentionsReplaced(text string) (string, []model.Mention) {
 	var args []string
-	for _, id := range userID {
-		if len(id) != 2 {
-			continue
-		}
+	var mentions []model.Mention
+	for _, id := range userMention.FindAllStringSubmatch(text, -1) {
 		user := c.GetUserInfo(id[1])
 		if user == nil {
 			user = model.NewUserInfo(id[1])
 		}
 		args = append(args, id[0], "@"+user.UName())
+		mentions = append(mentions, model.Mention{Source: model.SlackType, UserID: id[1], Name: "@" + user.UName()})
 	}
-	return strings.NewReplacer(args...).Replace(text)
+	return strings.NewReplacer(args...).Replace(text), mentions
 }
 
 func (c *App) ContentWithEmojiReplaced(text string) string {
@@ -423,3 +591,15 @@ func (c *App) ContentWithEmojiReplaced(text string) string {
 	}
 	return strings.NewReplacer(args...).Replace(text)
 }
+
+// fileAttachment maps the shared file, the private url needs the token and the others can only show its name.
+func fileAttachment(file slackevents.File) model.Attachment {
+	return model.Attachment{
+		Name:      file.Name,
+		Type:      file.Mimetype,
+		URL:       file.URLPrivate,
+		Width:     file.OriginalW,
+		Height:    file.OriginalH,
+		Thumbnail: file.Thumb360,
+	}
+}
@@ -1,11 +1,20 @@
 package telegram
 
 import (
+	"chatroom/conf"
 	"chatroom/model"
+	"chatroom/store"
 	"chatroom/utils"
+	"context"
 	"encoding/json"
-	"sort"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
 	"strconv"
+	"strings"
+	"time"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
 )
@@ -18,12 +27,7 @@ func (a *App) getUserInfo(chatID string, userID ...string) (data []model.User) {
 		if member, err := a.cli.GetChatMember(param); err == nil && member.User != nil {
 			d, _ := json.Marshal(member)
 			a.log.Printf("userid: %s info: %s", id, string(d))
-			data = append(data, model.User{
-				ID:          strconv.FormatInt(member.User.ID, 10),
-				Name:        member.User.String(),
-				DisplayName: member.User.String(),
-				BotID:       utils.IfElse(member.User.IsBot, strconv.FormatInt(member.User.ID, 10), ""),
-			})
+			data = append(data, newUser(member.User))
 		}
 	}
 	return
@@ -37,10 +41,10 @@ func (a *App) ConvictionChannel(channelID string) int64 {
 func (a *App) getChannelInfo(channelID ...string) (data []model.ChannelInfo) {
 	param := tgbotapi.ChatInfoConfig{}
 	for _, id := range channelID {
-		param.ChatID = a.ConvictionChannel(id)
+		param.ChatID, _ = parseChannel(id)
 		if chat, err := a.cli.GetChat(param); err == nil {
 			data = append(data, model.ChannelInfo{
-				ID:   strconv.FormatInt(chat.ID, 10),
+				ID:   id,
 				Name: chat.Title,
 			})
 		}
@@ -48,27 +52,221 @@ func (a *App) getChannelInfo(channelID ...string) (data []model.ChannelInfo) {
 	return
 }
 
+// topicMessage holds the forum fields which the bot api library does not decode.
+type topicMessage struct {
+	MessageThreadID int  `json:"message_thread_id"`
+	IsTopicMessage  bool `json:"is_topic_message"`
+}
+
+type topicUpdate struct {
+	Message           *topicMessage `json:"message"`
+	EditedMessage     *topicMessage `json:"edited_message"`
+	ChannelPost       *topicMessage `json:"channel_post"`
+	EditedChannelPost *topicMessage `json:"edited_channel_post"`
+}
+
+func (t topicUpdate) topic() int {
+	for _, m := range []*topicMessage{t.Message, t.EditedMessage, t.ChannelPost, t.EditedChannelPost} {
+		if m != nil && m.IsTopicMessage {
+			return m.MessageThreadID
+		}
+	}
+	return 0
+}
+
+func (a *App) getUpdates(config tgbotapi.UpdateConfig) ([]tgbotapi.Update, []topicUpdate, error) {
+	rsp, err := a.cli.Request(config)
+	if err != nil {
+		return nil, nil, err
+	}
+	var updates []tgbotapi.Update
+	if err = json.Unmarshal(rsp.Result, &updates); err != nil {
+		return nil, nil, err
+	}
+	topics := make([]topicUpdate, len(updates))
+	if err = json.Unmarshal(rsp.Result, &topics); err != nil {
+		return nil, nil, err
+	}
+	return updates, topics, nil
+}
+
+// request calls a send method with raw params, the library configs have no message_thread_id.
+func (a *App) request(method string, params tgbotapi.Params) (tgbotapi.Message, error) {
+	var message tgbotapi.Message
+	rsp, err := a.cli.MakeRequest(method, params)
+	if err != nil {
+		return message, err
+	}
+	err = json.Unmarshal(rsp.Result, &message)
+	return message, err
+}
+
+func channelKey(chatID int64, topic int) string {
+	return fmt.Sprintf("%d:%d", chatID, topic)
+}
+
+// parseChannel splits the configured "chatID:topicID" channel.
+func parseChannel(channelID string) (int64, int) {
+	chat, topic, _ := strings.Cut(channelID, ":")
+	t, _ := strconv.Atoi(topic)
+	return stringToInt(chat), t
+}
+
+// Attachment maps the media of the message. The download url of telegram contains the bot token,
+// so the files are linked through the media proxy of the admin api.
 func (a *App) Attachment(msg *tgbotapi.Message) []model.Attachment {
 	var result []model.Attachment
-	fieldDict := make(map[string]struct{})
-	sort.Slice(msg.Photo, func(i, j int) bool {
-		return msg.Photo[i].Height*msg.Photo[i].Width > msg.Photo[j].Height*msg.Photo[j].Width
-	})
-	for _, info := range msg.Photo {
-		if _, exist := fieldDict[info.FileID]; exist {
-			continue
-		}
-		fieldDict[info.FileID] = struct{}{}
-		result = append(result, model.Attachment{
-			Name: info.FileUniqueID,
-			Type: "Photo",
-		})
+	// 同一张图片有多个尺寸, 只取最大的
+	if len(msg.Photo) != 0 {
+		photo := slices.MaxFunc(msg.Photo, func(x, y tgbotapi.PhotoSize) int { return x.Width*x.Height - y.Width*y.Height })
+		result = append(result, model.Attachment{Name: photo.FileUniqueID, Type: "image/jpeg", URL: fileURL(photo.FileID), Kind: model.AttachmentImage, Width: photo.Width, Height: photo.Height})
 	}
-	if msg.Document != nil {
+	if v := msg.Sticker; v != nil {
 		result = append(result, model.Attachment{
-			Name: msg.Document.FileName,
-			Type: utils.IfElse(len(msg.Document.MimeType) == 0, "Doc", msg.Document.MimeType),
+			Name:   strings.TrimSpace(fmt.Sprintf("%s %s", v.Emoji, v.SetName)),
+			Type:   utils.IfElse(v.IsAnimated, "application/x-tgsticker", "image/webp"),
+			URL:    fileURL(v.FileID),
+			Kind:   model.AttachmentSticker,
+			Width:  v.Width,
+			Height: v.Height,
 		})
 	}
+	if v := msg.Animation; v != nil {
+		result = append(result, model.Attachment{Name: v.FileName, Type: v.MimeType, URL: fileURL(v.FileID), Kind: model.AttachmentAnimation, Width: v.Width, Height: v.Height, Duration: seconds(v.Duration)})
+	} else if v := msg.Document; v != nil {
+		// 动图同时带有 document
+		result = append(result, model.Attachment{Name: v.FileName, Type: utils.IfElse(len(v.MimeType) == 0, "Doc", v.MimeType), URL: fileURL(v.FileID), Kind: model.AttachmentFile})
+	}
+	if v := msg.Video; v != nil {
+		result = append(result, model.Attachment{Name: v.FileName, Type: v.MimeType, URL: fileURL(v.FileID), Kind: model.AttachmentVideo, Width: v.Width, Height: v.Height, Duration: seconds(v.Duration)})
+	}
+	if v := msg.VideoNote; v != nil {
+		result = append(result, model.Attachment{Type: "video/mp4", URL: fileURL(v.FileID), Kind: model.AttachmentVideoNote, Width: v.Length, Height: v.Length, Duration: seconds(v.Duration)})
+	}
+	if v := msg.Voice; v != nil {
+		result = append(result, model.Attachment{Type: v.MimeType, URL: fileURL(v.FileID), Kind: model.AttachmentVoice, Duration: seconds(v.Duration)})
+	}
+	if v := msg.Audio; v != nil {
+		name := utils.IfElse(len(v.Title) != 0, strings.TrimSpace(fmt.Sprintf("%s %s", v.Performer, v.Title)), v.FileName)
+		result = append(result, model.Attachment{Name: name, Type: v.MimeType, URL: fileURL(v.FileID), Kind: model.AttachmentAudio, Duration: seconds(v.Duration)})
+	}
+	if v := msg.Venue; v != nil {
+		result = append(result, model.NewLocation(strings.TrimSpace(fmt.Sprintf("%s %s", v.Title, v.Address)), v.Location.Latitude, v.Location.Longitude))
+	} else if v := msg.Location; v != nil {
+		result = append(result, model.NewLocation("", v.Latitude, v.Longitude))
+	}
+	if v := msg.Contact; v != nil {
+		result = append(result, model.Attachment{Name: strings.TrimSpace(fmt.Sprintf("%s %s", v.FirstName, v.LastName)), URL: "tel:" + v.PhoneNumber, Kind: model.AttachmentContact})
+	}
 	return result
 }
+
+func seconds(n int) time.Duration {
+	return time.Duration(n) * time.Second
+}
+
+// fileClient downloads the files for the media proxy, the bot api serves files up to 20MB.
+var fileClient = &http.Client{Timeout: 2 * time.Minute}
+
+// fileURL returns the signed link of the file on the media proxy, empty without a public url.
+func fileURL(fileID string) string {
+	admin := conf.Conf.Admin
+	if len(fileID) == 0 || len(admin.PublicURL) == 0 || len(admin.Token) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%s/media/telegram/%s?sig=%s", strings.TrimSuffix(admin.PublicURL, "/"), url.PathEscape(fileID), utils.Sign(admin.Token, fileID))
+}
+
+// File resolves the file with getFile and downloads it, the caller closes the body.
+func File(ctx context.Context, fileID string) (*http.Response, error) {
+	if app == nil {
+		return nil, errors.New("telegram is not configured")
+	}
+	file, err := app.cli.GetFile(tgbotapi.FileConfig{FileID: fileID})
+	if err != nil {
+		return nil, redact(err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, file.Link(app.cli.Token), nil)
+	if err != nil {
+		return nil, redact(err)
+	}
+	resp, err := fileClient.Do(req)
+	if err != nil {
+		return nil, redact(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("failed to download the file: %s", resp.Status)
+	}
+	return resp, nil
+}
+
+// redact drops the request url from the error, the urls of the bot api contain the bot token.
+func redact(err error) error {
+	var ue *url.Error
+	if errors.As(err, &ue) {
+		return fmt.Errorf("%s: %w", ue.Op, ue.Err)
+	}
+	return err
+}
+
+const cursorBucket = "cursor"
+
+// offset returns the next update to fetch, the updates before it were handled by the previous run.
+func (a *App) offset() int {
+	var offset int
+	store.Get(cursorBucket, fmt.Sprintf("%s:offset", model.TelegramType), &offset)
+	return offset
+}
+
+func (a *App) saveOffset(offset int) {
+	if err := store.Put(cursorBucket, fmt.Sprintf("%s:offset", model.TelegramType), offset); err != nil {
+		a.log.Printf("failed to save update offset %d: %v", offset, err)
+	}
+}
+
+type updateBatch struct {
+	offset int
+	// left 未确认的消息数, 批次排队完成之前多计一个
+	left int
+}
+
+// beginBatch tracks the messages queued from the fetched updates, endBatch is called once they are all queued.
+func (a *App) beginBatch() *updateBatch {
+	b := &updateBatch{left: 1}
+	a.ackLock.Lock()
+	a.batches = append(a.batches, b)
+	a.ackLock.Unlock()
+	return b
+}
+
+// endBatch records the offset after the updates of the batch.
+func (a *App) endBatch(b *updateBatch, offset int) {
+	a.ackLock.Lock()
+	b.offset = offset
+	a.ackLock.Unlock()
+	a.ackBatch(b)
+}
+
+// expect counts a message queued from the batch, the returned function acks it.
+func (a *App) expect(b *updateBatch) func() {
+	a.ackLock.Lock()
+	b.left++
+	a.ackLock.Unlock()
+	return func() { a.ackBatch(b) }
+}
+
+// ackBatch saves the offset of the batches whose messages were all consumed, in fetch order.
+func (a *App) ackBatch(b *updateBatch) {
+	a.ackLock.Lock()
+	defer a.ackLock.Unlock()
+	b.left--
+	offset := 0
+	for len(a.batches) != 0 && a.batches[0].left == 0 {
+		offset = a.batches[0].offset
+		a.batches = a.batches[1:]
+	}
+	if offset != 0 {
+		a.saveOffset(offset)
+	}
+}
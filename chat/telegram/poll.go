@@ -0,0 +1,101 @@
+package telegram
+
+import (
+	"chatroom/format"
+	"chatroom/model"
+	"chatroom/store"
+	"fmt"
+	"strconv"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+const pollBucket = "telegram-poll"
+
+// maxPollOptions is the most options telegram allows, the rest are not shown in the native poll.
+const maxPollOptions = 10
+
+// pollRef is the message of a poll, the poll answers only carry the poll id.
+type pollRef struct {
+	Channel   string `json:"channel"`
+	MessageID int    `json:"messageID"`
+}
+
+func (a *App) setPoll(pollID string, ref pollRef) {
+	if err := store.Put(pollBucket, pollID, ref); err != nil {
+		a.log.Printf("failed to save poll %s: %v", pollID, err)
+	}
+}
+
+// receivePoll bridges a poll created in a chat.
+func (a *App) receivePoll(m *tgbotapi.Message, topic int) {
+	channelID := a.channelKey(m.Chat.ID, topic)
+	a.setPoll(m.Poll.ID, pollRef{Channel: channelID, MessageID: m.MessageID})
+	poll := &model.Poll{Question: m.Poll.Question, Multiple: m.Poll.AllowsMultipleAnswers}
+	for _, option := range m.Poll.Options {
+		poll.Options = append(poll.Options, option.Text)
+	}
+	a.push(&model.PollMessage{
+		ID:      strconv.Itoa(m.MessageID),
+		Type:    model.MessageTypePoll,
+		From:    model.TelegramType,
+		Channel: &model.ChannelInfo{ID: channelID, Name: m.Chat.Title},
+		User:    a.sender(m),
+		Poll:    poll,
+	})
+}
+
+// pollAnswer bridges a vote. Telegram only sends the answers of the non-anonymous polls sent by the bot,
+// the votes on the polls of the users are not known.
+func (a *App) pollAnswer(answer *tgbotapi.PollAnswer) {
+	var ref pollRef
+	if !store.Get(pollBucket, answer.PollID, &ref) {
+		a.log.Printf("answer of unknown poll %s", answer.PollID)
+		return
+	}
+	user := newUser(&answer.User)
+	a.push(&model.PollMessage{
+		ID:      strconv.Itoa(ref.MessageID),
+		Type:    model.MessageTypePollVote,
+		From:    model.TelegramType,
+		Channel: model.NewChannelInfo(ref.Channel),
+		User:    &user,
+		Votes:   answer.OptionIDs,
+	})
+}
+
+// push queues the message when its channel is bridged.
+func (a *App) push(msg model.IChatMessage) {
+	a.substrateLock.RLock()
+	_, ok := a.SubscriptMessage[msg.BelongChannel().CID()]
+	a.substrateLock.RUnlock()
+	if ok {
+		a.queue(msg.BelongChannel().CID(), msg)
+	}
+}
+
+// SendPoll sends a non-anonymous native poll so that the votes are bridged, the question shows who asked.
+func (c Chat) SendPoll(msg model.IChatMessage) (string, error) {
+	poll := model.PollOf(msg)
+	if poll == nil || len(poll.Options) < 2 {
+		return c.SendMessage(msg)
+	}
+	params := tgbotapi.Params{}
+	params.AddNonZero64("chat_id", c.ChatID)
+	params.AddNonZero("message_thread_id", c.TopicID)
+	params["question"] = format.Truncate(250, fmt.Sprintf("[%s] %s: %s", msg.Source(), msg.BelongUser().UName(), poll.Question))
+	if err := params.AddInterface("options", poll.Options[:min(len(poll.Options), maxPollOptions)]); err != nil {
+		return "", err
+	}
+	params["is_anonymous"] = "false"
+	params.AddBool("allows_multiple_answers", poll.Multiple)
+	rsp, err := app.request("sendPoll", params)
+	if err != nil {
+		return "", err
+	}
+	app.SetMessageMeta(c.ChatID, rsp.MessageID, messageMeta{Topic: c.TopicID})
+	if rsp.Poll != nil {
+		app.setPoll(rsp.Poll.ID, pollRef{Channel: c.Channel, MessageID: rsp.MessageID})
+	}
+	return strconv.Itoa(rsp.MessageID), nil
+}
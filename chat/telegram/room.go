@@ -1,20 +1,34 @@
 package telegram
 
 import (
+	"chatroom/format"
+	"chatroom/identity"
 	"chatroom/model"
+	"chatroom/utils"
+	"errors"
 	"fmt"
+	"net/http"
 	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
 )
 
 type Chat struct {
 	Channel string
+	ChatID  int64
+	// TopicID 论坛话题, 0 表示整个群组
+	TopicID  int
+	Template *format.Template
 }
 
-func NewTelegramChat(channelID string, receiveCh chan model.IChatMessage) *Chat {
+// NewTelegramChat accepts a chat id or "chatID:topicID" for a forum topic.
+func NewTelegramChat(channelID string, receiveCh chan model.IChatMessage, tpl *format.Template) *Chat {
 	app.RegisterChannel(channelID, receiveCh)
-	return &Chat{Channel: channelID}
+	chatID, topic := parseChannel(channelID)
+	return &Chat{Channel: channelID, ChatID: chatID, TopicID: topic, Template: tpl}
 }
 
 func (c Chat) ChannelID() string {
@@ -25,46 +39,168 @@ func (c Chat) Source() model.TypeSource {
 	return model.TelegramType
 }
 
-func (c Chat) SendMessage(msg model.IChatMessage) (string, error) {
-	rsp, err := app.cli.Send(tgbotapi.NewMessage(stringToInt(c.Channel), c.formatText(msg)))
-	if err != nil {
-		return "", err
+func (c Chat) Connected() bool {
+	return Connected()
+}
+
+func (c Chat) Members() []string {
+	info := app.GetChannelInfo(c.Channel)
+	if info == nil {
+		return nil
 	}
-	return strconv.Itoa(rsp.MessageID), nil
+	var result []string
+	for _, user := range app.GetUsersInfo(c.Channel, info.Members...) {
+		if !user.IsBot() {
+			result = append(result, user.UName())
+		}
+	}
+	return result
+}
+
+// Whisper sends a private message to the user, it fails until the user starts a chat with the bot.
+func (c Chat) Whisper(userID, text string) error {
+	_, err := app.cli.Send(tgbotapi.NewMessage(stringToInt(userID), text))
+	return err
+}
+
+// Typing sends the typing chat action, telegram clears it after 5 seconds or when the bot sends.
+// The bot api does not tell the bot when users type, typing is only shown here.
+func (c Chat) Typing() error {
+	params := tgbotapi.Params{}
+	params.AddNonZero64("chat_id", c.ChatID)
+	params.AddNonZero("message_thread_id", c.TopicID)
+	params["action"] = tgbotapi.ChatTyping
+	_, err := app.cli.MakeRequest("sendChatAction", params)
+	return err
+}
+
+func (c Chat) SendMessage(msg model.IChatMessage) (string, error) {
+	return c.send(msg, c.formatText(msg), "", c.TopicID)
 }
 
 func (c Chat) SendReplyMessage(parentID string, msg model.IChatMessage) (string, error) {
-	var rsp tgbotapi.Message
-	var err error
 	if len(parentID) == 0 {
-		rsp, err = app.cli.Send(tgbotapi.NewMessage(stringToInt(c.Channel), fmt.Sprintf("%s\n[Reply Message, Parent message not found]", c.formatText(msg))))
-	} else {
-		rsp, err = app.cli.Send(tgbotapi.MessageConfig{
-			BaseChat: tgbotapi.BaseChat{
-				ChatID:           stringToInt(c.Channel),
-				ReplyToMessageID: int(stringToInt(parentID)),
-			},
-			Text:                  c.formatText(msg),
-			DisableWebPagePreview: false,
-		})
+		return c.send(msg, fmt.Sprintf("%s\n[Reply Message, Parent message not found]", c.formatText(msg)), "", c.TopicID)
+	}
+	// 回复留在原消息所在的话题
+	topic := utils.IfElse(c.TopicID != 0, c.TopicID, app.GetMessageMeta(c.ChatID, parentID).Topic)
+	return c.send(msg, c.formatText(msg), parentID, topic)
+}
+
+func (c Chat) send(msg model.IChatMessage, text, replyTo string, topic int) (string, error) {
+	params := tgbotapi.Params{}
+	params.AddNonZero64("chat_id", c.ChatID)
+	params.AddNonZero("message_thread_id", topic)
+	params.AddNonEmpty("reply_to_message_id", replyTo)
+	if media := mediaAttachment(msg.Attachment()); media != nil && captionLength(text) <= captionLimit {
+		method := mediaMethods[media.MediaKind()]
+		params[method.field] = media.URL
+		params["caption"] = text
+		if media.Width > 0 && media.Height > 0 && method.field != "photo" {
+			params.AddNonZero("width", media.Width)
+			params.AddNonZero("height", media.Height)
+		}
+		params.AddNonZero("duration", int(media.Duration.Seconds()))
+		rsp, err := app.request(method.name, params)
+		if err == nil {
+			app.SetMessageMeta(c.ChatID, rsp.MessageID, messageMeta{Media: true, Topic: topic})
+			c.sendPlaces(msg.Attachment(), rsp.MessageID, topic)
+			return strconv.Itoa(rsp.MessageID), nil
+		}
+		app.log.Printf("failed to %s %s, fall back to text: %v", method.name, media.URL, err)
+		for _, key := range []string{method.field, "caption", "width", "height", "duration"} {
+			delete(params, key)
+		}
 	}
+	params["text"] = text
+	rsp, err := app.request("sendMessage", params)
 	if err != nil {
 		return "", err
 	}
+	app.SetMessageMeta(c.ChatID, rsp.MessageID, messageMeta{Topic: topic})
+	c.sendPlaces(msg.Attachment(), rsp.MessageID, topic)
 	return strconv.Itoa(rsp.MessageID), nil
 }
 
+// sendPlaces sends the locations and contacts as replies to the bridged message, their links stay in the text
+// when sending fails.
+func (c Chat) sendPlaces(attachments []model.Attachment, replyTo, topic int) {
+	for _, att := range attachments {
+		params := tgbotapi.Params{}
+		params.AddNonZero64("chat_id", c.ChatID)
+		params.AddNonZero("message_thread_id", topic)
+		params.AddNonZero("reply_to_message_id", replyTo)
+		params.AddBool("disable_notification", true)
+		var method string
+		switch att.MediaKind() {
+		case model.AttachmentLocation:
+			latitude, longitude, ok := att.Location()
+			if !ok {
+				continue
+			}
+			method = "sendLocation"
+			params.AddNonZeroFloat("latitude", latitude)
+			params.AddNonZeroFloat("longitude", longitude)
+		case model.AttachmentContact:
+			phone, ok := strings.CutPrefix(att.URL, "tel:")
+			if !ok {
+				continue
+			}
+			method = "sendContact"
+			params["phone_number"] = phone
+			params["first_name"] = utils.IfElse(len(att.Name) != 0, att.Name, phone)
+		default:
+			continue
+		}
+		if _, err := app.request(method, params); err != nil {
+			app.log.Printf("failed to %s: %v", method, err)
+		}
+	}
+}
+
 func (c Chat) UpdateMessage(messageID string, msg model.IChatMessage) error {
 	if len(messageID) == 0 {
-		_, err := app.cli.Send(tgbotapi.NewMessage(stringToInt(c.Channel), fmt.Sprintf("%s\n[Edit Message, Original message not found]", c.formatText(msg))))
+		_, err := c.send(msg, fmt.Sprintf("%s\n[Edit Message, Original message not found]", c.formatText(msg)), "", c.TopicID)
 		return err
 	}
-	_, err := app.cli.Send(tgbotapi.NewEditMessageText(stringToInt(c.Channel), int(stringToInt(messageID)), c.formatText(msg)))
+	if !app.GetMessageMeta(c.ChatID, messageID).Media {
+		_, err := app.cli.Send(tgbotapi.NewEditMessageText(c.ChatID, int(stringToInt(messageID)), c.formatText(msg)))
+		return err
+	}
+	text := truncateCaption(c.formatText(msg))
+	if photo := photoAttachment(msg.Attachment()); photo != nil {
+		media := tgbotapi.NewInputMediaPhoto(tgbotapi.FileURL(photo.URL))
+		media.Caption = text
+		_, err := app.cli.Send(tgbotapi.EditMessageMediaConfig{
+			BaseEdit: tgbotapi.BaseEdit{ChatID: c.ChatID, MessageID: int(stringToInt(messageID))},
+			Media:    media,
+		})
+		return err
+	}
+	_, err := app.cli.Send(tgbotapi.NewEditMessageCaption(c.ChatID, int(stringToInt(messageID)), text))
 	return err
 }
 
 func (c Chat) DeleteMessage(messageID string) error {
-	_, err := app.cli.Send(tgbotapi.NewDeleteMessage(stringToInt(c.Channel), int(stringToInt(messageID))))
+	_, err := app.cli.Send(tgbotapi.NewDeleteMessage(c.ChatID, int(stringToInt(messageID))))
+	return err
+}
+
+// Pin pins the message without notifying the members, the bot needs the pin messages right.
+func (c Chat) Pin(messageID string) error {
+	params := tgbotapi.Params{}
+	params.AddNonZero64("chat_id", c.ChatID)
+	params["message_id"] = messageID
+	params.AddBool("disable_notification", true)
+	_, err := app.cli.MakeRequest("pinChatMessage", params)
+	return err
+}
+
+func (c Chat) Unpin(messageID string) error {
+	params := tgbotapi.Params{}
+	params.AddNonZero64("chat_id", c.ChatID)
+	params["message_id"] = messageID
+	_, err := app.cli.MakeRequest("unpinChatMessage", params)
 	return err
 }
 
@@ -72,6 +208,11 @@ func (c Chat) SendReaction(_ string, _ string) error {
 	return nil
 }
 
+// CanReact reports that the bot can not add reactions, the delivery reports are sent as notices.
+func (c Chat) CanReact() bool {
+	return false
+}
+
 func (c Chat) RemoveReaction(_ string, _ string) error {
 	return nil
 }
@@ -81,10 +222,92 @@ func (c Chat) RemoveReactionAll(_ string) error {
 	return nil
 }
 
+// mentionParsing replaces the mentions with the usernames of the linked telegram users, users without
+// a username and users without a link are kept as they are.
+func (c Chat) mentionParsing(msg model.IChatMessage) string {
+	return identity.Translate(msg.Text(), msg.Mentions(), model.TelegramType, func(userID string) string {
+		if user := app.GetUserInfo(c.Channel, userID); user != nil && len(user.Name) != 0 {
+			return "@" + user.Name
+		}
+		return ""
+	})
+}
+
+// formatText renders the bridged text with the template of the chat.
 func (c Chat) formatText(msg model.IChatMessage) string {
-	text := fmt.Sprintf("From: [%s] User:[%s] Send: \n%s", msg.Source(), msg.BelongUser().UName(), msg.Text())
-	if att := msg.Attachment(); len(att) != 0 {
-		text += model.Attachments(att).String()
+	return c.Template.Render(msg, c.Source(), c.mentionParsing(msg))
+}
+
+const captionLimit = 1024
+
+// captionLength counts the text like telegram, in utf-16 code units.
+func captionLength(text string) int {
+	n := 0
+	for _, r := range text {
+		n += utf16.RuneLen(r)
+	}
+	return n
+}
+
+// truncateCaption shortens the text to the caption limit without splitting a character.
+func truncateCaption(text string) string {
+	if captionLength(text) <= captionLimit {
+		return text
+	}
+	n := 0
+	for i, r := range text {
+		if n += utf16.RuneLen(r); n > captionLimit-1 {
+			return text[:i] + "…"
+		}
 	}
 	return text
 }
+
+// photoAttachment returns the first image which telegram could download by url.
+func photoAttachment(attachments []model.Attachment) *model.Attachment {
+	for i := range attachments {
+		if kind := attachments[i].MediaKind(); (kind == model.AttachmentImage || kind == model.AttachmentSticker) && strings.HasPrefix(attachments[i].URL, "http") {
+			return &attachments[i]
+		}
+	}
+	return nil
+}
+
+type mediaMethod struct {
+	name  string
+	field string
+}
+
+// mediaMethods are the send methods of the kinds, the kinds telegram can not send by url are sent as the closest one.
+var mediaMethods = map[string]mediaMethod{
+	model.AttachmentImage: {"sendPhoto", "photo"},
+	// 贴纸不能带文字, 按图片发送
+	model.AttachmentSticker:   {"sendPhoto", "photo"},
+	model.AttachmentAnimation: {"sendAnimation", "animation"},
+	model.AttachmentVideo:     {"sendVideo", "video"},
+	model.AttachmentVideoNote: {"sendVideo", "video"},
+	model.AttachmentVoice:     {"sendVoice", "voice"},
+	model.AttachmentAudio:     {"sendAudio", "audio"},
+}
+
+// mediaAttachment returns the first media which telegram could download by url.
+func mediaAttachment(attachments []model.Attachment) *model.Attachment {
+	for i := range attachments {
+		if _, ok := mediaMethods[attachments[i].MediaKind()]; ok && strings.HasPrefix(attachments[i].URL, "http") {
+			return &attachments[i]
+		}
+	}
+	return nil
+}
+
+// RetryAfter reports the flood wait of telegram, server errors are retried with the outbox backoff.
+func (c Chat) RetryAfter(err error) (time.Duration, bool) {
+	var apiErr *tgbotapi.Error
+	if !errors.As(err, &apiErr) {
+		return 0, false
+	}
+	if apiErr.RetryAfter > 0 {
+		return time.Duration(apiErr.RetryAfter) * time.Second, true
+	}
+	return 0, apiErr.Code == http.StatusTooManyRequests || apiErr.Code >= http.StatusInternalServerError
+}
@@ -3,12 +3,19 @@ package telegram
 import (
 	"chatroom/conf"
 	"chatroom/model"
+	"chatroom/utils"
+	"chatroom/utils/queue"
 	"context"
 	"encoding/json"
+	"fmt"
 	"log"
 	"os"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf16"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
 )
@@ -17,17 +24,27 @@ type App struct {
 	cli         *tgbotapi.BotAPI
 	Users       map[string]*model.User
 	ChannelInfo map[string]*model.ChannelInfo
-	lock        sync.RWMutex
+	// 已知消息的话题和类型, 编辑图片消息需要修改 caption, 回复需要留在原话题
+	messages map[string]messageMeta
+	lock     sync.RWMutex
 
 	SubscriptMessage map[string][]chan model.IChatMessage
 	substrateLock    sync.RWMutex
+	intake           *queue.Serial[model.IChatMessage]
+	// batches 已拉取但房间还没处理完的更新; batch 为正在排队的批次, 只在拉取更新的 goroutine 中访问
+	batches []*updateBatch
+	batch   *updateBatch
+	ackLock sync.Mutex
 
-	log *log.Logger
+	online atomic.Bool
+	log    *log.Logger
 }
 
 var app *App
 
-func NewClient(_ context.Context, conf conf.Telegram) {
+const maxMessageMeta = 10000
+
+func NewClient(ctx context.Context, conf conf.Telegram) {
 	if len(conf.Token) == 0 {
 		return
 	}
@@ -41,73 +58,324 @@ func NewClient(_ context.Context, conf conf.Telegram) {
 	app.SubscriptMessage = make(map[string][]chan model.IChatMessage)
 	app.Users = make(map[string]*model.User)
 	app.ChannelInfo = make(map[string]*model.ChannelInfo)
+	app.messages = make(map[string]messageMeta)
 	//app.cli.Debug = true
 	app.log.Printf("Authorized on account %s", app.cli.Self.UserName)
-	go app.init()
+	go app.init(ctx)
 }
 
-func (a *App) init() {
-	channelIDs := conf.Conf.GetTelegramChat()
-	a.getChannelInfo(channelIDs...)
+func (a *App) init(ctx context.Context) {
+	a.intake = queue.NewSerial(conf.Conf.Receive.QueueSize, a.publish)
+	a.syncInfo()
+	a.registerCommand()
 	//a.getUserInfo()
-	u := tgbotapi.NewUpdate(0)
+	// 从上次处理到的 offset 继续, 重复的消息由房间按消息映射跳过
+	u := tgbotapi.NewUpdate(a.offset())
 	u.Timeout = 30
-	updates := a.cli.GetUpdatesChan(u)
-	for update := range updates {
-		d, _ := json.Marshal(update)
-		a.log.Printf("receive message: %s", string(d))
-		a.log.Printf("%+#v", update)
-		a.handlerMessage(update)
+	for ctx.Err() == nil {
+		updates, topics, err := a.getUpdates(u)
+		if err != nil {
+			a.log.Printf("failed to get updates, retrying in 3 seconds: %v", err)
+			a.online.Store(false)
+			select {
+			case <-ctx.Done():
+			case <-time.After(time.Second * 3):
+			}
+			continue
+		}
+		a.online.Store(true)
+		// 停止后不再处理, 未确认的 offset 下次启动会重新拉取
+		if ctx.Err() != nil {
+			break
+		}
+		if len(updates) == 0 {
+			continue
+		}
+		// 房间处理完这批更新的消息后才保存 offset, 中途退出时下次启动重新拉取
+		a.batch = a.beginBatch()
+		for i, update := range updates {
+			if update.UpdateID < u.Offset {
+				continue
+			}
+			u.Offset = update.UpdateID + 1
+			d, _ := json.Marshal(update)
+			a.log.Printf("receive message: %s", string(d))
+			a.handlerMessage(update, topics[i].topic())
+		}
+		a.endBatch(a.batch, u.Offset)
+		a.batch = nil
+	}
+	a.online.Store(false)
+	a.log.Println("stop receiving updates")
+}
+
+// syncInfo loads the bridged chats into the cache.
+func (a *App) syncInfo() {
+	a.GetChannelsInfo(conf.Conf.GetTelegramChat()...)
+}
+
+// registerCommand shows the /bridge command in the command menu of the chats.
+func (a *App) registerCommand() {
+	if _, err := a.cli.Request(tgbotapi.NewSetMyCommands(tgbotapi.BotCommand{Command: "bridge", Description: "Run a bridge command: status, who, pause, resume or help"})); err != nil {
+		a.log.Printf("failed to register bot command: %v", err)
+	}
+}
+
+// StopIntake stops queuing the platform events, the events already queued still reach the rooms.
+func StopIntake() {
+	if app == nil || app.intake == nil {
+		return
+	}
+	app.intake.Stop()
+}
+
+// Connected reports whether the last poll of the updates succeeded.
+func Connected() bool {
+	return app != nil && app.online.Load()
+}
+
+// Refresh drops the cached users and chats and loads them again.
+func Refresh() {
+	if app == nil {
+		return
+	}
+	app.lock.Lock()
+	app.Users = make(map[string]*model.User)
+	app.ChannelInfo = make(map[string]*model.ChannelInfo)
+	app.lock.Unlock()
+	app.syncInfo()
+}
+
+func (a *App) handlerMessage(msg tgbotapi.Update, topic int) {
+	// Bot API 不推送消息删除事件
+	switch {
+	case msg.Message != nil:
+		a.receive(msg.Message, model.MessageTypeTextCreate, topic)
+	case msg.EditedMessage != nil:
+		a.receive(msg.EditedMessage, model.MessageTypeTextUpdate, topic)
+	case msg.ChannelPost != nil:
+		a.receive(msg.ChannelPost, model.MessageTypeTextCreate, topic)
+	case msg.EditedChannelPost != nil:
+		a.receive(msg.EditedChannelPost, model.MessageTypeTextUpdate, topic)
+	case msg.PollAnswer != nil:
+		a.pollAnswer(msg.PollAnswer)
 	}
 }
 
-func (a *App) handlerMessage(msg tgbotapi.Update) {
-	if msg.Message != nil {
-		message := new(model.TelegramMessage)
-		if chat := msg.FromChat(); chat != nil {
-			message.Channel = &model.ChannelInfo{ID: intToString(chat.ID), Name: chat.Title}
+func (a *App) receive(m *tgbotapi.Message, tp model.MessageType, topic int) {
+	if m.From != nil && m.From.ID == a.cli.Self.ID {
+		return // 跳过服务自身消息
+	}
+	message := new(model.TelegramMessage)
+	if m.Chat == nil {
+		return
+	}
+	// 成员变化是服务消息, 不作为文本桥接
+	if len(m.NewChatMembers) != 0 || m.LeftChatMember != nil {
+		for i := range m.NewChatMembers {
+			a.memberEvent(m.Chat, &m.NewChatMembers[i], model.MessageTypeMemberJoin, "")
 		}
-		if user := msg.SentFrom(); user != nil {
-			message.User = &model.User{ID: intToString(user.ID), Name: user.String(), DisplayName: user.String()}
+		if m.LeftChatMember != nil {
+			a.memberEvent(m.Chat, m.LeftChatMember, model.MessageTypeMemberLeave, "")
 		}
-		message.ID = msg.Message.MessageID
-		message.Type = model.MessageTypeTextCreate
-		if reply := msg.Message.ReplyToMessage; reply != nil {
-			message.Type = model.MessageTypeTextReply
-			message.ParentID = msg.Message.ReplyToMessage.MessageID
+		return
+	}
+	if m.Poll != nil && tp == model.MessageTypeTextCreate {
+		a.receivePoll(m, topic)
+		return
+	}
+	message.Channel = &model.ChannelInfo{ID: a.channelKey(m.Chat.ID, topic), Name: m.Chat.Title}
+	message.User = a.sender(m)
+	// 置顶是服务消息, 桥接置顶的原消息; Bot API 不推送取消置顶
+	if m.PinnedMessage != nil {
+		message.ID = m.PinnedMessage.MessageID
+		message.Type = model.MessageTypePin
+		a.ReceiveMessage(message)
+		return
+	}
+	message.ID = m.MessageID
+	message.TopicID = topic
+	message.Type = tp
+	message.SendTime = int64(m.Date) * int64(time.Second)
+	a.SetMessageMeta(m.Chat.ID, m.MessageID, messageMeta{Media: len(m.Photo) != 0, Topic: topic})
+	// 话题内的消息都回复话题的创建消息, 不是真正的回复
+	if reply := m.ReplyToMessage; reply != nil && tp == model.MessageTypeTextCreate && reply.MessageID != topic {
+		message.Type = model.MessageTypeTextReply
+		message.ParentID = reply.MessageID
+	}
+	message.Message = m.Text
+	message.Mentioned = a.mentions(m.Text, m.Entities)
+	if len(message.Message) == 0 {
+		message.Message = m.Caption
+		message.Mentioned = a.mentions(m.Caption, m.CaptionEntities)
+	}
+	// /bridge 命令按文本命令执行
+	if m.IsCommand() && m.Command() == "bridge" {
+		message.Message = model.CommandText(m.CommandArguments())
+	}
+	message.RawMessage = message.Message
+	message.Attachments = a.Attachment(m)
+	a.ReceiveMessage(message)
+}
+
+// sender returns the user of the message, channel posts are sent on behalf of the chat.
+func (a *App) sender(m *tgbotapi.Message) model.IUserInfo {
+	if m.From != nil {
+		user := newUser(m.From)
+		a.lock.RLock()
+		old := a.Users[user.ID]
+		a.lock.RUnlock()
+		if old != nil && old.DisplayName != user.DisplayName && m.Chat != nil {
+			a.memberEvent(m.Chat, m.From, model.MessageTypeMemberRename, old.DisplayName)
 		}
-		message.Message = msg.Message.Text
-		message.Attachments = a.Attachment(msg.Message)
-		if len(message.Message) == 0 {
-			message.Message = msg.Message.Caption
+		a.SetUserInfo(user)
+		return &user
+	}
+	chat := m.SenderChat
+	if chat == nil {
+		chat = m.Chat
+	}
+	if chat == nil {
+		return model.NewUserInfo("")
+	}
+	name := utils.IfElse(len(m.AuthorSignature) != 0, m.AuthorSignature, chat.Title)
+	return &model.User{ID: intToString(chat.ID), Name: name, DisplayName: name}
+}
+
+// memberEvent updates the members of the chat and queues the change to the rooms of the chat and its topics.
+// The bot api has no rename event, a rename is noticed when the user sends a message with a new name.
+func (a *App) memberEvent(chat *tgbotapi.Chat, u *tgbotapi.User, tp model.MessageType, oldName string) {
+	if u.ID == a.cli.Self.ID {
+		return
+	}
+	user := newUser(u)
+	if tp == model.MessageTypeMemberJoin {
+		a.SetUserInfo(user)
+	}
+	for _, channelID := range a.chatChannels(chat.ID) {
+		channel := utils.Default(a.GetChannelInfo(channelID), func(v *model.ChannelInfo) bool { return v != nil }, &model.ChannelInfo{ID: channelID, Name: chat.Title})
+		if tp != model.MessageTypeMemberRename {
+			a.lock.Lock()
+			channel.Members = model.SetMember(channel.Members, user.ID, tp == model.MessageTypeMemberJoin)
+			a.lock.Unlock()
 		}
-		go a.ReceiveMessage(message)
+		msg := model.NewMemberMessage(model.TelegramType, channel, &user, tp)
+		msg.OldName = oldName
+		a.queue(channelID, msg)
 	}
-	if msg.EditedMessage != nil {
-		message := new(model.TelegramMessage)
-		if chat := msg.FromChat(); chat != nil {
-			message.Channel = &model.ChannelInfo{ID: intToString(chat.ID), Name: chat.Title}
+}
+
+// chatChannels returns the subscribed channels of the chat, the group itself and its topics.
+func (a *App) chatChannels(chatID int64) []string {
+	a.substrateLock.RLock()
+	defer a.substrateLock.RUnlock()
+	var result []string
+	for key := range a.SubscriptMessage {
+		if id, _ := parseChannel(key); id == chatID {
+			result = append(result, key)
 		}
-		if user := msg.SentFrom(); user != nil {
-			message.User = &model.User{ID: intToString(user.ID), Name: user.String(), DisplayName: user.String()}
+	}
+	return result
+}
+
+// newUser keeps the username in Name, it is empty for the users without a username.
+func newUser(u *tgbotapi.User) model.User {
+	return model.User{ID: intToString(u.ID), Name: u.UserName, DisplayName: u.String(), BotID: utils.IfElse(u.IsBot, intToString(u.ID), "")}
+}
+
+// mentions returns the mentioned users of the text, @username is resolved by the users seen before.
+func (a *App) mentions(text string, entities []tgbotapi.MessageEntity) []model.Mention {
+	var result []model.Mention
+	for _, e := range entities {
+		name := entityText(text, e)
+		switch {
+		case e.Type == "text_mention" && e.User != nil:
+			result = append(result, model.Mention{Source: model.TelegramType, UserID: intToString(e.User.ID), Name: name})
+		case e.Type == "mention":
+			if user := a.searchUsername(strings.TrimPrefix(name, "@")); user != nil {
+				result = append(result, model.Mention{Source: model.TelegramType, UserID: user.ID, Name: name})
+			}
 		}
-		message.ID = msg.EditedMessage.MessageID
-		message.Type = model.MessageTypeTextUpdate
-		message.Message = msg.EditedMessage.Text
-		go a.ReceiveMessage(message)
 	}
+	return result
+}
+
+// entityText returns the text of the entity, the offsets count utf-16 code units.
+func entityText(text string, e tgbotapi.MessageEntity) string {
+	u := utf16.Encode([]rune(text))
+	if e.Offset < 0 || e.Length <= 0 || e.Offset+e.Length > len(u) {
+		return ""
+	}
+	return string(utf16.Decode(u[e.Offset : e.Offset+e.Length]))
+}
+
+// messageMeta is what the bridge needs to know about a telegram message after sending it.
+type messageMeta struct {
+	Media bool
+	Topic int
+}
+
+func (a *App) SetMessageMeta(chatID int64, messageID int, meta messageMeta) {
+	a.lock.Lock()
+	if len(a.messages) >= maxMessageMeta {
+		a.messages = make(map[string]messageMeta)
+	}
+	a.messages[fmt.Sprintf("%d:%d", chatID, messageID)] = meta
+	a.lock.Unlock()
+}
+
+func (a *App) GetMessageMeta(chatID int64, messageID string) messageMeta {
+	a.lock.RLock()
+	meta := a.messages[fmt.Sprintf("%d:%s", chatID, messageID)]
+	a.lock.RUnlock()
+	return meta
 }
 
+// ReceiveMessage queues the message by channel, the messages of a channel reach the rooms in order.
 func (a *App) ReceiveMessage(msg *model.TelegramMessage) {
+	a.substrateLock.RLock()
+	_, ok := a.SubscriptMessage[msg.Channel.CID()]
+	a.substrateLock.RUnlock()
+	if ok {
+		a.queue(msg.Channel.CID(), msg)
+	}
+}
+
+// queue pushes the message to the intake, the update it came from counts as handled once the rooms consumed it.
+func (a *App) queue(channelID string, msg model.IChatMessage) {
+	if r, ok := msg.(model.Acked); ok && a.batch != nil {
+		r.OnAck(a.expect(a.batch))
+	}
+	a.intake.Push(channelID, msg)
+}
+
+func (a *App) publish(msg model.IChatMessage) {
 	var chs []chan model.IChatMessage
 	a.substrateLock.RLock()
-	chs = append(chs, a.SubscriptMessage[msg.Channel.CID()]...)
+	chs = append(chs, a.SubscriptMessage[msg.BelongChannel().CID()]...)
 	a.substrateLock.RUnlock()
+	if r, ok := msg.(model.Acked); ok {
+		r.Expect(len(chs))
+	}
 	for _, ch := range chs {
 		ch <- msg
 	}
 }
 
+// channelKey returns the subscribed channel of the message, a topic falls back to its group.
+func (a *App) channelKey(chatID int64, topic int) string {
+	if topic != 0 {
+		key := channelKey(chatID, topic)
+		a.substrateLock.RLock()
+		_, ok := a.SubscriptMessage[key]
+		a.substrateLock.RUnlock()
+		if ok {
+			return key
+		}
+	}
+	return intToString(chatID)
+}
+
 func (a *App) RegisterChannel(channelID string, ch chan model.IChatMessage) {
 	a.substrateLock.Lock()
 	a.SubscriptMessage[channelID] = append(a.SubscriptMessage[channelID], ch)
@@ -210,6 +478,27 @@ func (a *App) GetUsersInfo(channelID string, userIDs ...string) map[string]*mode
 	return result
 }
 
+func (a *App) SetUserInfo(user model.User) {
+	a.lock.Lock()
+	a.Users[user.ID] = &user
+	a.lock.Unlock()
+}
+
+// searchUsername returns the user with the username, usernames are unique on telegram.
+func (a *App) searchUsername(username string) *model.User {
+	if len(username) == 0 {
+		return nil
+	}
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	for _, user := range a.Users {
+		if strings.EqualFold(user.Name, username) {
+			return user
+		}
+	}
+	return nil
+}
+
 func intToString(id int64) string {
 	return strconv.FormatInt(id, 10)
 }
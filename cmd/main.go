@@ -7,7 +7,10 @@ import (
 	"chatroom/chat/telegram"
 	"chatroom/conf"
 	"chatroom/emoji"
+	"chatroom/identity"
 	"chatroom/room"
+	"chatroom/server"
+	"chatroom/store"
 	"context"
 	"log"
 	"os"
@@ -20,20 +23,43 @@ func main() {
 	// init config
 	conf.InitConf(ctx)
 	emoji.InitEmojiConvert()
+	store.InitStore(conf.Conf.Store)
+	identity.InitIdentity()
 
 	slack.NewClient(ctx, conf.Conf.Slack)
 	discord.NewClient(ctx, conf.Conf.Discord)
 	telegram.NewClient(ctx, conf.Conf.Telegram)
 	matrix.NewClient(ctx, conf.Conf.Matrix)
-	//handler := server.Route()
-	go listenExit(cancel)
-	room.NewMainRoom(ctx)
+	handler := server.Route()
+	go server.Run(ctx, conf.Conf.Admin, handler)
+	go listenExit(func() {
+		// 先停止接收新的事件, 房间才能在排空已收到的消息后退出
+		slack.StopIntake()
+		discord.StopIntake()
+		telegram.StopIntake()
+		matrix.StopIntake()
+		cancel()
+	})
+	clean := room.NewMainRoom(ctx)
+	// 房间排空后再关闭连接, 加密房间的投递依赖 crypto store
+	slack.Close()
+	discord.Close()
+	matrix.Close()
+	store.Close()
+	if !clean {
+		log.Println("unclean shutdown")
+		os.Exit(1)
+	}
+	log.Println("exit")
 }
 
-func listenExit(cancel context.CancelFunc) {
+func listenExit(stop func()) {
 	sign := make(chan os.Signal, 1)
 	signal.Notify(sign, os.Kill, os.Interrupt, syscall.SIGTERM)
 	s := <-sign
 	log.Printf("receive signal %s, exit...\n", s.String())
-	cancel()
+	stop()
+	s = <-sign
+	log.Printf("receive signal %s again, force exit\n", s.String())
+	os.Exit(2)
 }
@@ -5,6 +5,7 @@ import (
 	"flag"
 	"log"
 	"os"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
@@ -12,12 +13,25 @@ import (
 var Conf Config
 
 type Config struct {
-	Room     []Room   `yaml:"room"`
-	Slack    Slack    `yaml:"slack"`
-	Discord  Discord  `yaml:"discord"`
-	Matrix   Matrix   `yaml:"matrix"`
-	Telegram Telegram `yaml:"telegram"`
-	Emoji    []string `yaml:"emoji"`
+	Room     []Room     `yaml:"room"`
+	Slack    Slack      `yaml:"slack"`
+	Discord  Discord    `yaml:"discord"`
+	Matrix   Matrix     `yaml:"matrix"`
+	Telegram Telegram   `yaml:"telegram"`
+	Emoji    []string   `yaml:"emoji"`
+	Loop     Loop       `yaml:"loop"`
+	Store    Store      `yaml:"store"`
+	Outbox   Outbox     `yaml:"outbox"`
+	Receive  Receive    `yaml:"receive"`
+	Shutdown Shutdown   `yaml:"shutdown"`
+	Backfill Backfill   `yaml:"backfill"`
+	Admin    Admin      `yaml:"admin"`
+	Command  Command    `yaml:"command"`
+	Identity []Identity `yaml:"identity"`
+	Privacy  Privacy    `yaml:"privacy"`
+	Template Template   `yaml:"template"`
+	Typing   Typing     `yaml:"typing"`
+	Poll     Poll       `yaml:"poll"`
 
 	slackChat    []string `yaml:"-"`
 	discordChat  []string `yaml:"-"`
@@ -26,8 +40,72 @@ type Config struct {
 }
 
 type Room struct {
-	Name string     `yaml:"name"`
-	Chat []RoomChat `yaml:"chat"`
+	Name     string     `yaml:"name"`
+	Chat     []RoomChat `yaml:"chat"`
+	Filter   []Filter   `yaml:"filter"`
+	Privacy  Privacy    `yaml:"privacy"`
+	Template Template   `yaml:"template"`
+	Members  Members    `yaml:"members"`
+	Delivery Delivery   `yaml:"delivery"`
+}
+
+// Delivery reports to the sender whether a message reached the other chats of the room.
+type Delivery struct {
+	// Mode off 不报告 (默认), reaction 在源消息上添加表情, notice 投递失败时私下通知发送者
+	Mode string `yaml:"mode"`
+	// Success 全部送达时的表情, 为空时不添加; Failure 有目标失败时的表情
+	Success string `yaml:"success"`
+	Failure string `yaml:"failure"`
+}
+
+// Members configures the bridging of members joining, leaving and renamed in the chats of the room.
+type Members struct {
+	// Mode off 不桥接 (默认), forward 逐条转发, summary 每隔 Interval 汇总一次
+	Mode     string        `yaml:"mode"`
+	Interval time.Duration `yaml:"interval"`
+}
+
+// Poll is how often the shared results of the bridged polls are updated. Telegram, discord and matrix polls are
+// native, slack votes with reactions.
+type Poll struct {
+	// Interval 有新投票时每隔多久更新各处的结果
+	Interval time.Duration `yaml:"interval"`
+}
+
+// Template is the text/template of the bridged messages, the room template overrides the global one.
+type Template struct {
+	Text string `yaml:"text"`
+	// Chat 按目标覆盖, key 为平台 (slack) 或 平台:chatID (slack:C0123)
+	Chat map[string]string `yaml:"chat"`
+}
+
+type Privacy struct {
+	// OptOut 不桥接消息的用户, 格式 platform:userID, 用户也可以用 !bridge optout 自行退出
+	OptOut []string `yaml:"optOut"`
+	// Placeholder 为空时不桥接退出用户的消息, 否则用它代替消息内容
+	Placeholder string `yaml:"placeholder"`
+	// Anonymize 桥接消息中隐藏发送者的名称和头像
+	Anonymize bool `yaml:"anonymize"`
+}
+
+// Filter is one stage of the room message pipeline, stages run in order.
+type Filter struct {
+	Type     string   `yaml:"type"`
+	Pattern  string   `yaml:"pattern"`
+	Replace  string   `yaml:"replace"`
+	Users    []string `yaml:"users"`
+	Length   int      `yaml:"length"`
+	Keywords []string `yaml:"keywords"`
+	ChatID   []string `yaml:"chatID"`
+	// script filter, maxSteps bounds the starlark execution and maxSize the returned text. maxMemory (bytes) is
+	// approximate, it watches the heap growth of the whole process while the script runs, 0 disables it.
+	// onError is drop (default) or forward, what happens to the message when the script fails or hits a limit.
+	Script    string        `yaml:"script"`
+	Timeout   time.Duration `yaml:"timeout"`
+	MaxSteps  uint64        `yaml:"maxSteps"`
+	MaxSize   int           `yaml:"maxSize"`
+	MaxMemory uint64        `yaml:"maxMemory"`
+	OnError   string        `yaml:"onError"`
 }
 
 type RoomChat struct {
@@ -35,6 +113,82 @@ type RoomChat struct {
 	ChatID []string `yaml:"chatID"`
 }
 
+// Loop configures the detection of messages bouncing between bridges.
+type Loop struct {
+	MaxHops   int           `yaml:"maxHops"`
+	TTL       time.Duration `yaml:"ttl"`
+	Window    time.Duration `yaml:"window"`
+	Threshold int           `yaml:"threshold"`
+	Cooldown  time.Duration `yaml:"cooldown"`
+	// Bots 其他桥接机器人的用户 id 或名称, 它们重复的内容视为回环
+	Bots []string `yaml:"bots"`
+}
+
+// Store is the directory of the bridge state, empty keeps the state in memory.
+type Store struct {
+	Path string `yaml:"path"`
+	// FlushInterval batches the writes of the changed buckets
+	FlushInterval time.Duration `yaml:"flushInterval"`
+}
+
+// Outbox configures the delivery queue of every target and the retries before a delivery is dead-lettered.
+type Outbox struct {
+	QueueSize   int           `yaml:"queueSize"`
+	MaxAttempts int           `yaml:"maxAttempts"`
+	Backoff     time.Duration `yaml:"backoff"`
+	MaxBackoff  time.Duration `yaml:"maxBackoff"`
+	// MaxDeadLetters is the number of failed deliveries kept per target
+	MaxDeadLetters int `yaml:"maxDeadLetters"`
+}
+
+// Receive configures the intake of the platform events, every channel is queued in order.
+type Receive struct {
+	QueueSize int `yaml:"queueSize"`
+	// how long an edit, delete or reaction waits for the message it belongs to
+	PendingTTL time.Duration `yaml:"pendingTTL"`
+}
+
+// Shutdown bounds the time spent delivering the received messages on exit.
+type Shutdown struct {
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// Backfill bounds the catch-up of the messages missed while the bridge was down or disconnected.
+type Backfill struct {
+	// Limit is the number of messages replayed per channel, negative disables the backfill
+	Limit  int           `yaml:"limit"`
+	MaxAge time.Duration `yaml:"maxAge"`
+}
+
+// Typing bounds the typing indicators shown on every target.
+type Typing struct {
+	// Interval 每个目标最多每隔多久显示一次, 负数时不桥接
+	Interval time.Duration `yaml:"interval"`
+}
+
+type Admin struct {
+	Listen string `yaml:"listen"`
+	// Token 管理接口的 bearer token, 为空时不启动
+	Token string `yaml:"token"`
+	// PublicURL 管理接口对外的地址, telegram 的文件经 /media 代理后以此为链接, 为空时不带链接
+	PublicURL string `yaml:"publicURL"`
+}
+
+// Identity is the same person on every platform, empty platforms are not linked.
+type Identity struct {
+	// Name 桥接消息中使用的显示名称, 为空时使用各平台的名称
+	Name     string `yaml:"name"`
+	Slack    string `yaml:"slack"`
+	Discord  string `yaml:"discord"`
+	Telegram string `yaml:"telegram"`
+	Matrix   string `yaml:"matrix"`
+}
+
+type Command struct {
+	// Admins 可以执行 pause/resume 的用户, 格式 platform:userID, 例如 slack:U0123
+	Admins []string `yaml:"admins"`
+}
+
 type Matrix struct {
 	Host            string `yaml:"host"`
 	User            string `yaml:"user"`
@@ -45,6 +199,8 @@ type Matrix struct {
 
 type Discord struct {
 	Token string `yaml:"token"`
+	// MemberEvents 接收成员加入和离开, 需要在开发者后台打开 Server Members Intent
+	MemberEvents bool `yaml:"memberEvents"`
 }
 
 type Telegram struct {
@@ -0,0 +1,198 @@
+package format
+
+import (
+	"chatroom/conf"
+	"chatroom/model"
+	"chatroom/utils"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+	"unicode/utf8"
+)
+
+// DefaultTemplate is the header used when neither the room nor the global config sets one.
+const DefaultTemplate = "From: [{{.Platform}}] User: [{{.User}}] Send: \n{{.Text}}{{attachments .Attachments}}"
+
+// Data is what a template can use.
+type Data struct {
+	// Platform 消息来源的平台, Target 投递的平台
+	Platform string
+	Target   string
+	Channel  string
+	User     string
+	Time     time.Time
+	// Text 已转换提及的消息内容
+	Text string
+	// Reply 回复的原消息预览, 不是回复时为空
+	Reply       string
+	Attachments []model.Attachment
+}
+
+// Dated is implemented by messages which know when they were received.
+type Dated interface {
+	ReceivedAt() time.Time
+}
+
+// Replied is implemented by replies which carry a preview of the parent message.
+type Replied interface {
+	ReplyPreview() string
+}
+
+var funcs = template.FuncMap{
+	"attachments": func(att []model.Attachment) string {
+		if len(att) == 0 {
+			return ""
+		}
+		return model.Attachments(att).String()
+	},
+	"truncate": Truncate,
+}
+
+// Template renders the bridged text of a target.
+type Template struct {
+	tpl *template.Template
+}
+
+var defaultTemplate = &Template{tpl: template.Must(template.New("default").Funcs(funcs).Parse(DefaultTemplate))}
+
+// New parses the template, empty text returns the default template.
+func New(text string) (*Template, error) {
+	if len(text) == 0 {
+		return defaultTemplate, nil
+	}
+	tpl, err := template.New("message").Funcs(funcs).Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	// 提前执行一次, 字段写错在启动时就报错
+	if err = tpl.Execute(new(strings.Builder), Data{}); err != nil {
+		return nil, err
+	}
+	return &Template{tpl: tpl}, nil
+}
+
+// ForChat returns the template of the target, the most specific setting wins:
+// the chat, then the platform, then the text of the room, then the same order in the global config.
+func ForChat(room, global conf.Template, source model.TypeSource, chatID string) (*Template, error) {
+	for _, c := range []conf.Template{room, global} {
+		for key, text := range c.Chat {
+			if strings.EqualFold(key, fmt.Sprintf("%s:%s", source, chatID)) {
+				return New(text)
+			}
+		}
+		for key, text := range c.Chat {
+			if strings.EqualFold(key, source.String()) {
+				return New(text)
+			}
+		}
+		if len(c.Text) != 0 {
+			return New(c.Text)
+		}
+	}
+	return defaultTemplate, nil
+}
+
+// 渲染占位符, 私用区字符不会出现在模板的固定文本中
+const (
+	slotText  = "\ue000text\ue000"
+	slotField = "\ue000field\ue000"
+)
+
+var (
+	slotRgx  = regexp.MustCompile(regexp.QuoteMeta(slotText) + "|" + regexp.QuoteMeta(slotField))
+	digitRgx = regexp.MustCompile(`[0-9]+`)
+)
+
+// Patterns returns the regular expressions matching the texts rendered by the template, the first group is the
+// text of the message. The pattern of the replies comes first, the numbers of the fixed text, e.g. a formatted
+// time, match any number, and the fields do not span lines. A template which does not start with fixed text,
+// e.g. "{{.User}}: {{.Text}}", has no pattern, its header can not be told from an ordinary message.
+func (t *Template) Patterns() []*regexp.Regexp {
+	if t == nil {
+		t = defaultTemplate
+	}
+	var result []*regexp.Regexp
+	seen := make(map[string]bool)
+	for _, reply := range []string{slotField, ""} {
+		data := Data{Platform: slotField, Target: slotField, Channel: slotField, User: slotField, Text: slotText, Reply: reply}
+		var b strings.Builder
+		if err := t.tpl.Execute(&b, data); err != nil || !strings.Contains(b.String(), slotText) {
+			continue
+		}
+		rendered := b.String()
+		if loc := slotRgx.FindStringIndex(rendered); len(strings.TrimSpace(rendered[:loc[0]])) == 0 {
+			continue
+		}
+		var expr strings.Builder
+		expr.WriteString(`(?s)^`)
+		last := 0
+		for _, loc := range slotRgx.FindAllStringIndex(rendered, -1) {
+			expr.WriteString(literal(rendered[last:loc[0]]))
+			expr.WriteString(utils.IfElse(rendered[loc[0]:loc[1]] == slotText, `(.*)`, `[^\n]*?`))
+			last = loc[1]
+		}
+		expr.WriteString(literal(rendered[last:]) + `$`)
+		if seen[expr.String()] {
+			continue
+		}
+		seen[expr.String()] = true
+		result = append(result, regexp.MustCompile(expr.String()))
+	}
+	return result
+}
+
+func literal(text string) string {
+	parts := digitRgx.Split(text, -1)
+	for i := range parts {
+		parts[i] = regexp.QuoteMeta(parts[i])
+	}
+	return strings.Join(parts, `[0-9]+`)
+}
+
+// Render returns the text sent to the target platform. The text converted for the target, e.g. with
+// the mentions translated, is used for the other platforms, the raw text for the same platform.
+func (t *Template) Render(msg model.IChatMessage, target model.TypeSource, text string) string {
+	if t == nil {
+		t = defaultTemplate
+	}
+	data := Data{
+		Platform:    msg.Source().String(),
+		Target:      target.String(),
+		Text:        text,
+		Time:        time.Now(),
+		Attachments: msg.Attachment(),
+	}
+	if msg.Source() == target {
+		data.Text = msg.RawText()
+	}
+	if channel := msg.BelongChannel(); channel != nil {
+		data.Channel = channel.CName()
+	}
+	if user := msg.BelongUser(); user != nil {
+		data.User = user.UName()
+	}
+	if v, ok := msg.(Dated); ok {
+		data.Time = v.ReceivedAt()
+	}
+	if v, ok := msg.(Replied); ok {
+		data.Reply = v.ReplyPreview()
+	}
+	var b strings.Builder
+	if err := t.tpl.Execute(&b, data); err != nil {
+		log.Printf("failed to render message template, the default is used: %v", err)
+		b.Reset()
+		_ = defaultTemplate.tpl.Execute(&b, data)
+	}
+	return b.String()
+}
+
+// Truncate shortens the text to n characters.
+func Truncate(n int, text string) string {
+	if utf8.RuneCountInString(text) <= n {
+		return text
+	}
+	return string([]rune(text)[:n]) + "…"
+}
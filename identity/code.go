@@ -0,0 +1,67 @@
+package identity
+
+import (
+	"crypto/rand"
+	"errors"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// CodeTTL 一次性验证码的有效期
+	CodeTTL = 10 * time.Minute
+	// codeAlphabet 去掉了容易混淆的 0/O 和 1/I
+	codeAlphabet = "23456789ABCDEFGHJKLMNPQRSTUVWXYZ"
+	codeLength   = 8
+)
+
+var ErrInvalidCode = errors.New("the code is invalid or expired")
+
+type pendingCode struct {
+	account Account
+	until   time.Time
+}
+
+var (
+	codes    = make(map[string]pendingCode)
+	codeLock sync.Mutex
+)
+
+// NewCode returns a one-time code which links the account to the account redeeming it,
+// the code replaces the previous code of the account.
+func NewCode(a Account) (string, error) {
+	var b strings.Builder
+	for range codeLength {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(codeAlphabet))))
+		if err != nil {
+			return "", err
+		}
+		b.WriteByte(codeAlphabet[n.Int64()])
+	}
+	code := b.String()
+	codeLock.Lock()
+	defer codeLock.Unlock()
+	now := time.Now()
+	for k, v := range codes {
+		if v.account == a || now.After(v.until) {
+			delete(codes, k)
+		}
+	}
+	codes[code] = pendingCode{account: a, until: now.Add(CodeTTL)}
+	return code, nil
+}
+
+// Redeem links the account to the account of the code, the code can be used once.
+func Redeem(code string, b Account) (Account, error) {
+	code = strings.ToUpper(code)
+	codeLock.Lock()
+	pending, ok := codes[code]
+	delete(codes, code)
+	codeLock.Unlock()
+	if !ok || time.Now().After(pending.until) {
+		return Account{}, ErrInvalidCode
+	}
+	return pending.account, Link(pending.account, b)
+}
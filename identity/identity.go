@@ -0,0 +1,248 @@
+package identity
+
+import (
+	"chatroom/conf"
+	"chatroom/model"
+	"chatroom/store"
+	"chatroom/utils"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Account is a user on one platform.
+type Account struct {
+	Source model.TypeSource `json:"source"`
+	UserID string           `json:"userID"`
+}
+
+func (a Account) String() string {
+	return fmt.Sprintf("%s:%s", a.Source, a.UserID)
+}
+
+// person 同一个人在各平台的账号, 链接的账号共用同一个 person
+type person struct {
+	accounts map[model.TypeSource]string
+	// name 配置的显示名称, 桥接消息中代替各平台的名称
+	name string
+}
+
+const linkBucket = "identity"
+
+var (
+	people = make(map[string]*person)
+	lock   sync.RWMutex
+)
+
+// InitIdentity links the accounts of the config and the accounts linked by the users.
+func InitIdentity() {
+	lock.Lock()
+	rebuild()
+	count := len(people)
+	lock.Unlock()
+	log.Printf("init identity: %d accounts linked\n", count)
+}
+
+// rebuild applies the config and then the links of the users.
+func rebuild() {
+	people = make(map[string]*person)
+	for _, c := range conf.Conf.Identity {
+		var accounts []Account
+		for source, userID := range map[model.TypeSource]string{model.SlackType: c.Slack, model.DiscordType: c.Discord, model.TelegramType: c.Telegram, model.MatrixType: c.Matrix} {
+			if len(userID) != 0 {
+				accounts = append(accounts, Account{Source: source, UserID: userID})
+			}
+		}
+		if p := link(accounts...); p != nil && len(c.Name) != 0 {
+			p.name = c.Name
+		}
+	}
+	for _, key := range store.Keys(linkBucket, "") {
+		var pair [2]Account
+		if store.Get(linkBucket, key, &pair) {
+			link(pair[:]...)
+		}
+	}
+}
+
+// link marks the accounts as the same person, together with the accounts already linked to them.
+// A platform has one account per person, the later account wins.
+func link(accounts ...Account) *person {
+	if len(accounts) == 0 {
+		return nil
+	}
+	merged := &person{accounts: make(map[model.TypeSource]string)}
+	for _, account := range accounts {
+		if p := people[account.String()]; p != nil {
+			for source, userID := range p.accounts {
+				merged.accounts[source] = userID
+			}
+			merged.name = utils.Default(merged.name, func(v string) bool { return len(v) != 0 }, p.name)
+		}
+	}
+	for _, account := range accounts {
+		if old, ok := merged.accounts[account.Source]; ok && old != account.UserID {
+			delete(people, Account{Source: account.Source, UserID: old}.String())
+		}
+		merged.accounts[account.Source] = account.UserID
+	}
+	for source, userID := range merged.accounts {
+		people[Account{Source: source, UserID: userID}.String()] = merged
+	}
+	return merged
+}
+
+func pairKey(a, b Account) string {
+	keys := []string{a.String(), b.String()}
+	slices.Sort(keys)
+	return strings.Join(keys, "|")
+}
+
+// Link links the accounts of two platforms and keeps the link across restarts. A platform has one
+// account per person, the other account of the platform has to be unlinked first.
+func Link(a, b Account) error {
+	if a.Source == b.Source {
+		return fmt.Errorf("both accounts are on %s", a.Source)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	for _, x := range accountsOf(a) {
+		for _, y := range accountsOf(b) {
+			if x.Source == y.Source && x.UserID != y.UserID {
+				return fmt.Errorf("%s and %s would both be linked, unlink one of them first", x, y)
+			}
+		}
+	}
+	if err := store.Put(linkBucket, pairKey(a, b), [2]Account{a, b}); err != nil {
+		return err
+	}
+	link(a, b)
+	return nil
+}
+
+// Unlink removes the links the user made to the account, it returns false when there was none.
+// The links of the config are kept.
+func Unlink(a Account) (bool, error) {
+	var removed bool
+	for _, key := range store.Keys(linkBucket, "") {
+		if !slices.Contains(strings.Split(key, "|"), a.String()) {
+			continue
+		}
+		if err := store.Delete(linkBucket, key); err != nil {
+			return removed, err
+		}
+		removed = true
+	}
+	if removed {
+		lock.Lock()
+		rebuild()
+		lock.Unlock()
+	}
+	return removed, nil
+}
+
+// Linked returns the accounts of the person, including the account itself.
+func Linked(a Account) []Account {
+	lock.RLock()
+	defer lock.RUnlock()
+	return accountsOf(a)
+}
+
+func accountsOf(a Account) []Account {
+	p := people[a.String()]
+	if p == nil {
+		return []Account{a}
+	}
+	var result []Account
+	for source, userID := range p.accounts {
+		result = append(result, Account{Source: source, UserID: userID})
+	}
+	slices.SortFunc(result, func(x, y Account) int { return int(x.Source) - int(y.Source) })
+	return result
+}
+
+// Name returns the configured display name of the person, empty when there is none.
+func Name(a Account) string {
+	lock.RLock()
+	defer lock.RUnlock()
+	if p := people[a.String()]; p != nil {
+		return p.name
+	}
+	return ""
+}
+
+// Resolve returns the account on the target platform linked to the user.
+func Resolve(source model.TypeSource, userID string, target model.TypeSource) (string, bool) {
+	if source == target {
+		return userID, len(userID) != 0
+	}
+	lock.RLock()
+	defer lock.RUnlock()
+	p := people[Account{Source: source, UserID: userID}.String()]
+	if p == nil {
+		return "", false
+	}
+	userID, ok := p.accounts[target]
+	return userID, ok
+}
+
+// Translate replaces the mentions of the text with the linked users on the target platform,
+// the mentions of users without a linked account are kept as they are. Only whole names are
+// replaced, the mention of Bob is not found in Bobby or Bob's.
+func Translate(text string, mentions []model.Mention, target model.TypeSource, format func(userID string) string) string {
+	// 长的写法优先, @alice 不会抢先替换 @alice2 的前缀
+	sorted := slices.Clone(mentions)
+	slices.SortStableFunc(sorted, func(a, b model.Mention) int {
+		return len(b.Name) - len(a.Name)
+	})
+	var names, replaced []string
+	for _, m := range sorted {
+		if len(m.Name) == 0 {
+			continue
+		}
+		if userID, ok := Resolve(m.Source, m.UserID, target); ok {
+			if mention := format(userID); len(mention) != 0 {
+				names, replaced = append(names, m.Name), append(replaced, mention)
+			}
+		}
+	}
+	if len(names) == 0 {
+		return text
+	}
+	var b strings.Builder
+	for i := 0; i < len(text); {
+		n := slices.IndexFunc(names, func(name string) bool {
+			return strings.HasPrefix(text[i:], name) && boundary(text[:i], text[i+len(name):])
+		})
+		if n >= 0 {
+			b.WriteString(replaced[n])
+			i += len(names[n])
+			continue
+		}
+		_, size := utf8.DecodeRuneInString(text[i:])
+		b.WriteString(text[i : i+size])
+		i += size
+	}
+	return b.String()
+}
+
+// boundary reports whether a name between before and after is a whole word, an apostrophe followed by
+// a letter continues the word.
+func boundary(before, after string) bool {
+	word := func(r rune) bool {
+		return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_'
+	}
+	if r, _ := utf8.DecodeLastRuneInString(before); len(before) != 0 && word(r) {
+		return false
+	}
+	r, size := utf8.DecodeRuneInString(after)
+	if r == '\'' || r == '’' {
+		r, _ = utf8.DecodeRuneInString(after[size:])
+		return !unicode.IsLetter(r)
+	}
+	return len(after) == 0 || !word(r)
+}
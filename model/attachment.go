@@ -0,0 +1,115 @@
+package model
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The kinds of attachments, a platform without the kind sends the closest one it has or a link.
+const (
+	AttachmentFile      = "file"
+	AttachmentImage     = "image"
+	AttachmentVideo     = "video"
+	AttachmentAudio     = "audio"
+	AttachmentVoice     = "voice"
+	AttachmentVideoNote = "videoNote"
+	AttachmentSticker   = "sticker"
+	AttachmentAnimation = "animation"
+	AttachmentLocation  = "location"
+	AttachmentContact   = "contact"
+)
+
+type Attachments []Attachment
+type Attachment struct {
+	Name string
+	// Type mime 类型
+	Type string
+	URL  string
+	// Kind 附件的类别, 为空时按 mime 类型判断
+	Kind   string `json:",omitempty"`
+	Width  int    `json:",omitempty"`
+	Height int    `json:",omitempty"`
+	// Duration 音视频的时长
+	Duration  time.Duration `json:",omitempty"`
+	Thumbnail string        `json:",omitempty"`
+}
+
+// MediaKind returns the kind of the attachment, the attachments without one are classified by the mime type.
+func (a Attachment) MediaKind() string {
+	if len(a.Kind) != 0 {
+		return a.Kind
+	}
+	switch {
+	case a.Type == "image/gif":
+		return AttachmentAnimation
+	case strings.HasPrefix(a.Type, "image/"):
+		return AttachmentImage
+	case strings.HasPrefix(a.Type, "video/"):
+		return AttachmentVideo
+	case strings.HasPrefix(a.Type, "audio/"):
+		return AttachmentAudio
+	}
+	return AttachmentFile
+}
+
+// NewLocation returns a location as a map link, the platforms without locations show the link.
+func NewLocation(name string, latitude, longitude float64) Attachment {
+	return Attachment{
+		Name: name,
+		Kind: AttachmentLocation,
+		URL:  fmt.Sprintf("https://www.openstreetmap.org/?mlat=%f&mlon=%f#map=16/%f/%f", latitude, longitude, latitude, longitude),
+	}
+}
+
+// Location returns the coordinates of a location attachment.
+func (a Attachment) Location() (float64, float64, bool) {
+	if a.MediaKind() != AttachmentLocation {
+		return 0, 0, false
+	}
+	u, err := url.Parse(a.URL)
+	if err != nil {
+		return 0, 0, false
+	}
+	latitude, err1 := strconv.ParseFloat(u.Query().Get("mlat"), 64)
+	longitude, err2 := strconv.ParseFloat(u.Query().Get("mlon"), 64)
+	return latitude, longitude, err1 == nil && err2 == nil
+}
+
+func (a Attachments) String() string {
+	str := strings.Builder{}
+	str.WriteString("\nAttachment:")
+	for _, att := range a {
+		str.WriteByte('\n')
+		if kind := att.MediaKind(); kind != AttachmentFile {
+			str.WriteString(fmt.Sprintf("[%s%s] ", kind, att.details()))
+		}
+		if len(att.Name) != 0 {
+			str.WriteString(fmt.Sprintf("Name: [%s] ", att.Name))
+		}
+		if len(att.URL) != 0 {
+			str.WriteString(att.URL)
+			str.WriteString(" ")
+		}
+		if len(att.Type) != 0 {
+			str.WriteString(fmt.Sprintf("Type: [%s]", att.Type))
+		}
+
+	}
+	return str.String()
+}
+
+// details returns the size and the length shown after the kind, e.g. " 640x480 0:07".
+func (a Attachment) details() string {
+	var result string
+	if a.Width > 0 && a.Height > 0 {
+		result += fmt.Sprintf(" %dx%d", a.Width, a.Height)
+	}
+	if a.Duration > 0 {
+		seconds := int(a.Duration.Round(time.Second).Seconds())
+		result += fmt.Sprintf(" %d:%02d", seconds/60, seconds%60)
+	}
+	return result
+}
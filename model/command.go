@@ -0,0 +1,34 @@
+package model
+
+import (
+	"strings"
+	"sync"
+)
+
+// CommandPrefix starts a bridge command in a bridged chat, e.g. "!bridge status".
+const CommandPrefix = "!bridge"
+
+var (
+	commandNames = make(map[string]bool)
+	commandLock  sync.RWMutex
+)
+
+// AddCommandName records the name of a bridge command, the adapters which accept a mention of the bot as a
+// command only take the mentions starting with a known name.
+func AddCommandName(name string) {
+	commandLock.Lock()
+	commandNames[strings.ToLower(name)] = true
+	commandLock.Unlock()
+}
+
+// IsCommandName reports whether the name is a bridge command.
+func IsCommandName(name string) bool {
+	commandLock.RLock()
+	defer commandLock.RUnlock()
+	return commandNames[strings.ToLower(name)]
+}
+
+// CommandText returns the text command of the arguments, the platform commands run as text commands.
+func CommandText(args string) string {
+	return strings.TrimSpace(CommandPrefix + " " + strings.TrimSpace(args))
+}
@@ -6,17 +6,20 @@ type DiscordMessageEmoji struct {
 }
 
 type DiscordMessage struct {
-	ID         string
-	Type       MessageType
-	Channel    IChannelInfo
-	User       IUserInfo
-	Message    string
-	RawMessage string
-	SendTime   int64
-	//Mentions   []string // 软件内@可转换消息
+	ID          string
+	Type        MessageType
+	Channel     IChannelInfo
+	User        IUserInfo
+	Message     string
+	RawMessage  string
+	SendTime    int64
+	Mentioned   []Mention // 软件内@可转换消息
 	EmojiData   *DiscordMessageEmoji
 	Attachments []Attachment
 	ParentID    string
+	// Thread 消息位于子区内, ParentID 为子区的起始消息
+	Thread bool
+	Receipt
 }
 
 func (d *DiscordMessage) MessageID() string {
@@ -27,6 +30,10 @@ func (d *DiscordMessage) ParentMessageID() string {
 	return d.ParentID
 }
 
+func (d *DiscordMessage) InThread() bool {
+	return d.Thread
+}
+
 func (d *DiscordMessage) MessageType() MessageType {
 	return d.Type
 }
@@ -58,3 +65,7 @@ func (d *DiscordMessage) Emoji() string {
 func (d *DiscordMessage) BelongUser() IUserInfo {
 	return d.User
 }
+
+func (d *DiscordMessage) Mentions() []Mention {
+	return d.Mentioned
+}
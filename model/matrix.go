@@ -11,6 +11,9 @@ type MatrixMessage struct {
 	Reaction    string
 	Attachments []Attachment
 	ParentID    string
+	Thread      bool
+	Mentioned   []Mention
+	Receipt
 }
 
 func (s *MatrixMessage) MessageID() string {
@@ -21,6 +24,10 @@ func (s *MatrixMessage) ParentMessageID() string {
 	return s.ParentID
 }
 
+func (s *MatrixMessage) InThread() bool {
+	return s.Thread
+}
+
 func (s *MatrixMessage) MessageType() MessageType {
 	return s.Type
 }
@@ -52,3 +59,7 @@ func (s *MatrixMessage) Emoji() string {
 func (s *MatrixMessage) BelongUser() IUserInfo {
 	return s.User
 }
+
+func (s *MatrixMessage) Mentions() []Mention {
+	return s.Mentioned
+}
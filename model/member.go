@@ -0,0 +1,99 @@
+package model
+
+import (
+	"fmt"
+	"slices"
+	"time"
+)
+
+// MemberMessage is a member joining, leaving or renamed in a channel.
+type MemberMessage struct {
+	ID      string
+	Type    MessageType
+	From    TypeSource
+	Channel IChannelInfo
+	User    IUserInfo
+	// OldName 改名前的名称, 只有改名时有值
+	OldName string
+	Receipt
+}
+
+func NewMemberMessage(from TypeSource, channel IChannelInfo, user IUserInfo, tp MessageType) *MemberMessage {
+	return &MemberMessage{
+		ID:      fmt.Sprintf("member-%d", time.Now().UnixNano()),
+		Type:    tp,
+		From:    from,
+		Channel: channel,
+		User:    user,
+	}
+}
+
+// IsMemberEvent reports whether the message type is a membership change.
+func IsMemberEvent(tp MessageType) bool {
+	return tp == MessageTypeMemberJoin || tp == MessageTypeMemberLeave || tp == MessageTypeMemberRename
+}
+
+// SetMember returns a copy of the members with the user added or removed.
+func SetMember(members []string, userID string, joined bool) []string {
+	result := slices.DeleteFunc(slices.Clone(members), func(v string) bool { return v == userID })
+	if joined {
+		result = append(result, userID)
+	}
+	return result
+}
+
+func (m *MemberMessage) MessageID() string {
+	return m.ID
+}
+
+func (m *MemberMessage) ParentMessageID() string {
+	return ""
+}
+
+func (m *MemberMessage) InThread() bool {
+	return false
+}
+
+func (m *MemberMessage) MessageType() MessageType {
+	return m.Type
+}
+
+func (m *MemberMessage) Source() TypeSource {
+	return m.From
+}
+
+func (m *MemberMessage) BelongChannel() IChannelInfo {
+	return m.Channel
+}
+
+func (m *MemberMessage) Text() string {
+	switch m.Type {
+	case MessageTypeMemberJoin:
+		return "joined the channel"
+	case MessageTypeMemberLeave:
+		return "left the channel"
+	case MessageTypeMemberRename:
+		return fmt.Sprintf("changed the name from %s", m.OldName)
+	}
+	return ""
+}
+
+func (m *MemberMessage) RawText() string {
+	return m.Text()
+}
+
+func (m *MemberMessage) Attachment() []Attachment {
+	return nil
+}
+
+func (m *MemberMessage) Emoji() string {
+	return ""
+}
+
+func (m *MemberMessage) BelongUser() IUserInfo {
+	return m.User
+}
+
+func (m *MemberMessage) Mentions() []Mention {
+	return nil
+}
@@ -0,0 +1,9 @@
+package model
+
+// Mention is a user mentioned in a message.
+type Mention struct {
+	Source TypeSource `json:"source"`
+	UserID string     `json:"userID"`
+	// Name 提及在消息文本中的写法, 例如 @alice, 转发时替换成目标平台的提及
+	Name string `json:"name"`
+}
@@ -0,0 +1,70 @@
+package model
+
+// NoticeMessage is a message created by the bridge itself, e.g. alerts and command replies.
+type NoticeMessage struct {
+	ID       string
+	Type     MessageType
+	From     TypeSource
+	Channel  IChannelInfo
+	User     IUserInfo
+	Message  string
+	ParentID string
+}
+
+func NewNoticeMessage(from TypeSource, channel IChannelInfo, text string) *NoticeMessage {
+	return &NoticeMessage{
+		Type:    MessageTypeTextCreate,
+		From:    from,
+		Channel: channel,
+		User:    &User{ID: "bridge", Name: "bridge", DisplayName: "bridge", BotID: "bridge"},
+		Message: text,
+	}
+}
+
+func (n *NoticeMessage) MessageID() string {
+	return n.ID
+}
+
+func (n *NoticeMessage) ParentMessageID() string {
+	return n.ParentID
+}
+
+func (n *NoticeMessage) InThread() bool {
+	return false
+}
+
+func (n *NoticeMessage) MessageType() MessageType {
+	return n.Type
+}
+
+func (n *NoticeMessage) Source() TypeSource {
+	return n.From
+}
+
+func (n *NoticeMessage) BelongChannel() IChannelInfo {
+	return n.Channel
+}
+
+func (n *NoticeMessage) Text() string {
+	return n.Message
+}
+
+func (n *NoticeMessage) RawText() string {
+	return n.Message
+}
+
+func (n *NoticeMessage) Attachment() []Attachment {
+	return nil
+}
+
+func (n *NoticeMessage) Emoji() string {
+	return ""
+}
+
+func (n *NoticeMessage) BelongUser() IUserInfo {
+	return n.User
+}
+
+func (n *NoticeMessage) Mentions() []Mention {
+	return nil
+}
@@ -0,0 +1,131 @@
+package model
+
+import (
+	"fmt"
+	"strings"
+)
+
+// PollKeys are the emoji voted with on the platforms without native polls, one per option.
+var PollKeys = []string{"1️⃣", "2️⃣", "3️⃣", "4️⃣", "5️⃣", "6️⃣", "7️⃣", "8️⃣", "9️⃣", "🔟"}
+
+// Poll is the question and the options of a poll.
+type Poll struct {
+	Question string   `json:"question"`
+	Options  []string `json:"options"`
+	// Multiple 可以选择多个选项
+	Multiple bool `json:"multiple,omitempty"`
+}
+
+// PollMessage is a poll created in a channel, or a vote on it when the type is MessageTypePollVote.
+type PollMessage struct {
+	// ID 投票时是被投票的消息
+	ID      string
+	Type    MessageType
+	From    TypeSource
+	Channel IChannelInfo
+	User    IUserInfo
+	Poll    *Poll
+	// Votes 选中的选项序号, 为空表示撤回投票
+	Votes []int
+	Receipt
+}
+
+// PollOf returns the poll of the message, nil when it is not a poll.
+func PollOf(msg IChatMessage) *Poll {
+	if p, ok := msg.(interface{ PollData() *Poll }); ok {
+		return p.PollData()
+	}
+	return nil
+}
+
+// PollVotes returns the options of a vote.
+func PollVotes(msg IChatMessage) []int {
+	if p, ok := msg.(*PollMessage); ok {
+		return p.Votes
+	}
+	return nil
+}
+
+// PollText renders the poll as an emoji vote, counts is nil before anyone voted.
+func PollText(poll *Poll, counts []int) string {
+	var b strings.Builder
+	b.WriteString(fmt.Sprintf("📊 %s", poll.Question))
+	for i, option := range poll.Options {
+		if i >= len(PollKeys) {
+			break
+		}
+		b.WriteString(fmt.Sprintf("\n%s %s", PollKeys[i], option))
+		if i < len(counts) {
+			b.WriteString(fmt.Sprintf(" — %d", counts[i]))
+		}
+	}
+	return b.String()
+}
+
+// PollKey returns the option voted with the emoji, -1 when the emoji is not a vote.
+func PollKey(emoji string) int {
+	// 客户端发送的数字表情可能没有 U+FE0F
+	emoji = strings.ReplaceAll(emoji, "\ufe0f", "")
+	for i, key := range PollKeys {
+		if strings.ReplaceAll(key, "\ufe0f", "") == emoji {
+			return i
+		}
+	}
+	return -1
+}
+
+func (p *PollMessage) PollData() *Poll {
+	return p.Poll
+}
+
+func (p *PollMessage) MessageID() string {
+	return p.ID
+}
+
+func (p *PollMessage) ParentMessageID() string {
+	return ""
+}
+
+func (p *PollMessage) InThread() bool {
+	return false
+}
+
+func (p *PollMessage) MessageType() MessageType {
+	return p.Type
+}
+
+func (p *PollMessage) Source() TypeSource {
+	return p.From
+}
+
+func (p *PollMessage) BelongChannel() IChannelInfo {
+	return p.Channel
+}
+
+// Text is the emoji vote rendering, it is what the platforms without native polls show.
+func (p *PollMessage) Text() string {
+	if p.Poll == nil {
+		return ""
+	}
+	return PollText(p.Poll, nil)
+}
+
+func (p *PollMessage) RawText() string {
+	return p.Text()
+}
+
+func (p *PollMessage) Attachment() []Attachment {
+	return nil
+}
+
+func (p *PollMessage) Emoji() string {
+	return ""
+}
+
+func (p *PollMessage) BelongUser() IUserInfo {
+	return p.User
+}
+
+func (p *PollMessage) Mentions() []Mention {
+	return nil
+}
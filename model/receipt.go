@@ -0,0 +1,46 @@
+package model
+
+import "sync/atomic"
+
+// Acked is implemented by the messages which tell the adapter when the rooms consumed them.
+type Acked interface {
+	OnAck(done func())
+	Expect(rooms int)
+	Ack()
+}
+
+// Receipt lets the adapter move its receive cursor only after every room which got the message consumed it, e.g.
+// queued its deliveries to the outbox, so a crash replays the message instead of skipping it.
+// The zero value ignores the acks.
+type Receipt struct {
+	ack *ack
+}
+
+type ack struct {
+	left atomic.Int32
+	done func()
+}
+
+// OnAck sets the function called once the rooms consumed the message, it is set before the message is queued.
+func (r *Receipt) OnAck(done func()) {
+	r.ack = &ack{done: done}
+}
+
+// Expect sets how many rooms the message is published to, it is called before the message is published.
+func (r *Receipt) Expect(rooms int) {
+	if r.ack == nil {
+		return
+	}
+	if rooms <= 0 {
+		r.ack.done()
+		return
+	}
+	r.ack.left.Store(int32(rooms))
+}
+
+// Ack confirms the message for one room.
+func (r *Receipt) Ack() {
+	if r.ack != nil && r.ack.left.Add(-1) == 0 {
+		r.ack.done()
+	}
+}
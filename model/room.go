@@ -1,10 +1,5 @@
 package model
 
-import (
-	"fmt"
-	"strings"
-)
-
 type TypeSource int
 type MessageType int
 
@@ -23,6 +18,14 @@ const (
 	MessageTypeActionAdd
 	MessageTypeActionRemove
 	MessageTypeActionRemoveALL
+	MessageTypeMemberJoin
+	MessageTypeMemberLeave
+	MessageTypeMemberRename
+	MessageTypeTyping
+	MessageTypePin
+	MessageTypeUnpin
+	MessageTypePoll
+	MessageTypePollVote
 )
 
 func (t TypeSource) String() string {
@@ -76,6 +79,10 @@ func (u *User) UName() string {
 	return u.DisplayName
 }
 
+func (u *User) IsBot() bool {
+	return len(u.BotID) != 0
+}
+
 func (c ChannelInfo) CID() string {
 	return c.ID
 }
@@ -100,42 +107,20 @@ type IChatMessage interface {
 	RawText() string
 	Attachment() []Attachment
 	ParentMessageID() string
+	// InThread reports whether the reply belongs to a thread instead of quoting the parent inline.
+	InThread() bool
 	Emoji() string
+	// Mentions returns the users mentioned in the text.
+	Mentions() []Mention
 }
 
 type IUserInfo interface {
 	UID() string
 	UName() string
+	IsBot() bool
 }
 
 type IChannelInfo interface {
 	CID() string
 	CName() string
 }
-
-type Attachments []Attachment
-type Attachment struct {
-	Name string
-	Type string
-	URL  string
-}
-
-func (a Attachments) String() string {
-	str := strings.Builder{}
-	str.WriteString("\nAttachment:")
-	for _, att := range a {
-		str.WriteByte('\n')
-		if len(att.Name) != 0 {
-			str.WriteString(fmt.Sprintf("Name: [%s] ", att.Name))
-		}
-		if len(att.URL) != 0 {
-			str.WriteString(att.URL)
-			str.WriteString(" ")
-		}
-		if len(att.Type) != 0 {
-			str.WriteString(fmt.Sprintf("Type: [%s]", att.Type))
-		}
-
-	}
-	return str.String()
-}
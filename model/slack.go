@@ -19,6 +19,8 @@ type SlackMessage struct {
 	Reaction    *SlackReaction
 	Attachments []Attachment
 	ParentID    string
+	Mentioned   []Mention
+	Receipt
 }
 
 func (s *SlackMessage) MessageID() string {
@@ -29,6 +31,11 @@ func (s *SlackMessage) ParentMessageID() string {
 	return s.ParentID
 }
 
+// InThread slack replies are always thread replies.
+func (s *SlackMessage) InThread() bool {
+	return len(s.ParentID) != 0
+}
+
 func (s *SlackMessage) MessageType() MessageType {
 	return s.Type
 }
@@ -60,3 +67,7 @@ func (s *SlackMessage) Emoji() string {
 func (s *SlackMessage) BelongUser() IUserInfo {
 	return s.User
 }
+
+func (s *SlackMessage) Mentions() []Mention {
+	return s.Mentioned
+}
@@ -0,0 +1,99 @@
+package model
+
+// StoredMessage is a serializable copy of a message, used where messages outlive the process.
+type StoredMessage struct {
+	ID          string       `json:"id"`
+	Type        MessageType  `json:"type"`
+	From        TypeSource   `json:"from"`
+	Channel     ChannelInfo  `json:"channel"`
+	User        User         `json:"user"`
+	Message     string       `json:"message"`
+	RawMessage  string       `json:"rawMessage"`
+	Attachments []Attachment `json:"attachments,omitempty"`
+	ParentID    string       `json:"parentID,omitempty"`
+	Thread      bool         `json:"thread,omitempty"`
+	Reaction    string       `json:"reaction,omitempty"`
+	Mentioned   []Mention    `json:"mentions,omitempty"`
+	Poll        *Poll        `json:"poll,omitempty"`
+}
+
+func NewStoredMessage(msg IChatMessage) *StoredMessage {
+	s := &StoredMessage{
+		ID:          msg.MessageID(),
+		Type:        msg.MessageType(),
+		From:        msg.Source(),
+		Message:     msg.Text(),
+		RawMessage:  msg.RawText(),
+		Attachments: msg.Attachment(),
+		ParentID:    msg.ParentMessageID(),
+		Thread:      msg.InThread(),
+		Mentioned:   msg.Mentions(),
+		Poll:        PollOf(msg),
+	}
+	if channel := msg.BelongChannel(); channel != nil {
+		s.Channel = ChannelInfo{ID: channel.CID(), Name: channel.CName()}
+	}
+	if user := msg.BelongUser(); user != nil {
+		s.User = User{ID: user.UID(), Name: user.UName(), DisplayName: user.UName()}
+		if user.IsBot() {
+			s.User.BotID = user.UID()
+		}
+	}
+	switch msg.MessageType() {
+	case MessageTypeActionAdd, MessageTypeActionRemove:
+		s.Reaction = msg.Emoji()
+	}
+	return s
+}
+
+func (s *StoredMessage) PollData() *Poll {
+	return s.Poll
+}
+
+func (s *StoredMessage) MessageID() string {
+	return s.ID
+}
+
+func (s *StoredMessage) ParentMessageID() string {
+	return s.ParentID
+}
+
+func (s *StoredMessage) InThread() bool {
+	return s.Thread
+}
+
+func (s *StoredMessage) MessageType() MessageType {
+	return s.Type
+}
+
+func (s *StoredMessage) Source() TypeSource {
+	return s.From
+}
+
+func (s *StoredMessage) BelongChannel() IChannelInfo {
+	return s.Channel
+}
+
+func (s *StoredMessage) Text() string {
+	return s.Message
+}
+
+func (s *StoredMessage) RawText() string {
+	return s.RawMessage
+}
+
+func (s *StoredMessage) Attachment() []Attachment {
+	return s.Attachments
+}
+
+func (s *StoredMessage) Emoji() string {
+	return s.Reaction
+}
+
+func (s *StoredMessage) BelongUser() IUserInfo {
+	return &s.User
+}
+
+func (s *StoredMessage) Mentions() []Mention {
+	return s.Mentioned
+}
@@ -17,6 +17,10 @@ type TelegramMessage struct {
 	Attachments []Attachment
 	//Reaction *SlackReaction
 	ParentID int
+	// TopicID 论坛话题, 0 表示不在话题内
+	TopicID   int
+	Mentioned []Mention
+	Receipt
 }
 
 func (t *TelegramMessage) MessageID() string {
@@ -27,6 +31,10 @@ func (t *TelegramMessage) ParentMessageID() string {
 	return strconv.Itoa(t.ParentID)
 }
 
+func (t *TelegramMessage) InThread() bool {
+	return false
+}
+
 func (t *TelegramMessage) MessageType() MessageType {
 	return t.Type
 }
@@ -59,3 +67,7 @@ func (t *TelegramMessage) Emoji() string {
 func (t *TelegramMessage) BelongUser() IUserInfo {
 	return t.User
 }
+
+func (t *TelegramMessage) Mentions() []Mention {
+	return t.Mentioned
+}
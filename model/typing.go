@@ -0,0 +1,71 @@
+package model
+
+import (
+	"fmt"
+	"time"
+)
+
+// TypingMessage is a user typing in a channel, it has no content.
+type TypingMessage struct {
+	ID      string
+	From    TypeSource
+	Channel IChannelInfo
+	User    IUserInfo
+}
+
+func NewTypingMessage(from TypeSource, channel IChannelInfo, user IUserInfo) *TypingMessage {
+	return &TypingMessage{
+		ID:      fmt.Sprintf("typing-%d", time.Now().UnixNano()),
+		From:    from,
+		Channel: channel,
+		User:    user,
+	}
+}
+
+func (t *TypingMessage) MessageID() string {
+	return t.ID
+}
+
+func (t *TypingMessage) ParentMessageID() string {
+	return ""
+}
+
+func (t *TypingMessage) InThread() bool {
+	return false
+}
+
+func (t *TypingMessage) MessageType() MessageType {
+	return MessageTypeTyping
+}
+
+func (t *TypingMessage) Source() TypeSource {
+	return t.From
+}
+
+func (t *TypingMessage) BelongChannel() IChannelInfo {
+	return t.Channel
+}
+
+func (t *TypingMessage) Text() string {
+	return ""
+}
+
+func (t *TypingMessage) RawText() string {
+	return ""
+}
+
+func (t *TypingMessage) Attachment() []Attachment {
+	return nil
+}
+
+func (t *TypingMessage) Emoji() string {
+	return ""
+}
+
+func (t *TypingMessage) BelongUser() IUserInfo {
+	return t.User
+}
+
+func (t *TypingMessage) Mentions() []Mention {
+	return nil
+}
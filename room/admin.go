@@ -0,0 +1,98 @@
+package room
+
+import (
+	"chatroom/model"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	ErrChatNotFound = errors.New("chat not found")
+	ErrRoomBusy     = errors.New("receive queue of the room is full")
+)
+
+// ChatKey returns the key of the chat used by the admin api and the outbox, e.g. Slack:C0123.
+func ChatKey(chat IChat) string {
+	return targetKey(chat)
+}
+
+// Chat returns the chat of the room by its key.
+func (c *ChatRoom) Chat(key string) IChat {
+	for _, chat := range c.Room {
+		if targetKey(chat) == key {
+			return chat
+		}
+	}
+	return nil
+}
+
+// Pause stops bridging the room, or only the given chat when the key is not empty.
+func (c *ChatRoom) Pause(key string) error {
+	return c.setPaused(key, true)
+}
+
+// Resume bridges the paused room or chat again, the messages sent while paused are not bridged.
+func (c *ChatRoom) Resume(key string) error {
+	return c.setPaused(key, false)
+}
+
+func (c *ChatRoom) setPaused(key string, paused bool) error {
+	if len(key) == 0 {
+		c.paused.Store(paused)
+		c.log.Printf("room paused: %v", paused)
+		return nil
+	}
+	if c.Chat(key) == nil {
+		return ErrChatNotFound
+	}
+	c.pauseLock.Lock()
+	if paused {
+		c.pausedChat[key] = true
+	} else {
+		delete(c.pausedChat, key)
+	}
+	c.pauseLock.Unlock()
+	c.log.Printf("chat [%s] paused: %v", key, paused)
+	return nil
+}
+
+// Paused reports whether the room, or the given chat when the key is not empty, is paused.
+func (c *ChatRoom) Paused(key string) bool {
+	if len(key) == 0 {
+		return c.paused.Load()
+	}
+	c.pauseLock.RLock()
+	defer c.pauseLock.RUnlock()
+	return c.pausedChat[key]
+}
+
+// Inject queues a text message to the room as if a user named admin sent it in the given chat.
+func (c *ChatRoom) Inject(key, text string) (model.IChatMessage, error) {
+	chat := c.Chat(key)
+	if chat == nil {
+		return nil, ErrChatNotFound
+	}
+	msg := model.NewNoticeMessage(chat.Source(), &model.ChannelInfo{ID: chat.ChannelID(), Name: "admin"}, text)
+	msg.ID = fmt.Sprintf("admin-%d", time.Now().UnixNano())
+	// 不是机器人, 和普通消息一样经过过滤和回环检测
+	msg.User = &model.User{ID: "admin", Name: "admin", DisplayName: "admin"}
+	select {
+	case c.Receive <- msg:
+		return msg, nil
+	default:
+		return nil, ErrRoomBusy
+	}
+}
+
+// FindMessage searches the message mapping of every room by the message id of any platform.
+func FindMessage(messageID string) (*ChatRoom, *MessageTuple) {
+	for _, r := range Rooms() {
+		if v := r.MessageList.SearchFunc(func(v *MessageTuple) bool {
+			return v.HasID(messageID)
+		}); v != nil {
+			return r, *v
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,257 @@
+package room
+
+import (
+	"chatroom/conf"
+	"chatroom/identity"
+	"chatroom/model"
+	"chatroom/utils"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Command is a bridge command run from a bridged chat, e.g. "!bridge status".
+type Command struct {
+	Help string
+	// Admin 只有配置的管理员可以执行
+	Admin bool
+	Run   func(c *ChatRoom, req *CommandRequest) string
+}
+
+// Whisperer is implemented by chats which can reply to one user privately.
+type Whisperer interface {
+	Whisper(userID, text string) error
+}
+
+// CommandRequest is a command sent in a chat of the room.
+type CommandRequest struct {
+	Chat IChat
+	Msg  model.IChatMessage
+	Args []string
+}
+
+var (
+	commands    = make(map[string]Command)
+	commandLock sync.RWMutex
+)
+
+// RegisterCommand makes a command available to every room by name.
+func RegisterCommand(name string, cmd Command) {
+	commandLock.Lock()
+	commands[name] = cmd
+	commandLock.Unlock()
+	model.AddCommandName(name)
+}
+
+func init() {
+	RegisterCommand("help", Command{Help: "list the commands", Run: helpCommand})
+	RegisterCommand("status", Command{Help: "show the linked chats and their health", Run: statusCommand})
+	RegisterCommand("who", Command{Help: "list the members of the linked chats", Run: whoCommand})
+	RegisterCommand("pause", Command{Help: "stop bridging the room, or a chat: pause [here|chat]", Admin: true, Run: pauseCommand(true)})
+	RegisterCommand("resume", Command{Help: "bridge the room, or a chat, again: resume [here|chat]", Admin: true, Run: pauseCommand(false)})
+	RegisterCommand("link", Command{Help: "link your accounts, run it without a code to get one privately: link [code]", Run: linkCommand})
+	RegisterCommand("unlink", Command{Help: "remove the links of this account", Run: unlinkCommand})
+	RegisterCommand("optout", Command{Help: "stop bridging your messages in this room, or everywhere: optout [all]", Run: optCommand(true)})
+	RegisterCommand("optin", Command{Help: "bridge your messages again in this room, or everywhere: optin [all]", Run: optCommand(false)})
+}
+
+// ParseCommand returns the arguments of a command text, it returns false when the text is not a command.
+func ParseCommand(text string) ([]string, bool) {
+	fields := strings.Fields(text)
+	if len(fields) == 0 || !strings.EqualFold(fields[0], model.CommandPrefix) {
+		return nil, false
+	}
+	return fields[1:], true
+}
+
+// command runs the bridge command of the message and replies in its chat, it returns false when
+// the message is not a command. The commands are not bridged.
+func (c *ChatRoom) command(msg model.IChatMessage) bool {
+	if msg.MessageType() != model.MessageTypeTextCreate && msg.MessageType() != model.MessageTypeTextReply {
+		return false
+	}
+	if user := msg.BelongUser(); user != nil && user.IsBot() {
+		return false
+	}
+	args, ok := ParseCommand(msg.Text())
+	if !ok {
+		return false
+	}
+	chat := c.Chat(fmt.Sprintf("%s:%s", msg.Source(), msg.BelongChannel().CID()))
+	if chat == nil {
+		return false
+	}
+	name := "help"
+	if len(args) != 0 {
+		name, args = strings.ToLower(args[0]), args[1:]
+	}
+	commandLock.RLock()
+	cmd, exist := commands[name]
+	commandLock.RUnlock()
+	var reply string
+	switch {
+	case !exist:
+		reply = fmt.Sprintf("Unknown command %q, try \"%s help\".", name, model.CommandPrefix)
+	case cmd.Admin && !authorized(msg):
+		reply = fmt.Sprintf("You are not allowed to run %q.", name)
+	default:
+		reply = cmd.Run(c, &CommandRequest{Chat: chat, Msg: msg, Args: args})
+	}
+	c.log.Printf("command %q from [%s] channel [%s] user [%s]", name, msg.Source(), msg.BelongChannel().CID(), msg.BelongUser().UID())
+	c.notice(msg.Source(), msg.BelongChannel(), reply)
+	return true
+}
+
+// authorized reports whether the sender, or an account linked to the sender, is one of the configured admins.
+func authorized(msg model.IChatMessage) bool {
+	user := msg.BelongUser()
+	if user == nil {
+		return false
+	}
+	for _, account := range identity.Linked(identity.Account{Source: msg.Source(), UserID: user.UID()}) {
+		if slices.ContainsFunc(conf.Conf.Command.Admins, func(v string) bool {
+			return strings.EqualFold(v, account.String())
+		}) {
+			return true
+		}
+	}
+	return false
+}
+
+func helpCommand(_ *ChatRoom, _ *CommandRequest) string {
+	commandLock.RLock()
+	defer commandLock.RUnlock()
+	var names []string
+	for name := range commands {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	var result strings.Builder
+	result.WriteString("Bridge commands:")
+	for _, name := range names {
+		result.WriteString(fmt.Sprintf("\n%s %s - %s", model.CommandPrefix, name, commands[name].Help))
+	}
+	return result.String()
+}
+
+func statusCommand(c *ChatRoom, _ *CommandRequest) string {
+	var result strings.Builder
+	result.WriteString(fmt.Sprintf("Room %s is %s", c.Name, utils.IfElse(c.Paused(""), "paused", "running")))
+	for _, chat := range c.Room {
+		o := c.OutboxOf(chat)
+		result.WriteString(fmt.Sprintf("\n%s: %s, %d pending, %d dead letters", targetKey(chat),
+			chatState(c.Paused(targetKey(chat)), chat.Connected()), len(o.Pending()), len(o.DeadLetters())))
+	}
+	return result.String()
+}
+
+func chatState(paused, connected bool) string {
+	switch {
+	case paused:
+		return "paused"
+	case !connected:
+		return "disconnected"
+	}
+	return "connected"
+}
+
+func whoCommand(c *ChatRoom, _ *CommandRequest) string {
+	var result strings.Builder
+	result.WriteString(fmt.Sprintf("Members of room %s:", c.Name))
+	for _, chat := range c.Room {
+		members := chat.Members()
+		if len(members) == 0 {
+			result.WriteString(fmt.Sprintf("\n%s: member list not available", targetKey(chat)))
+			continue
+		}
+		slices.Sort(members)
+		result.WriteString(fmt.Sprintf("\n%s (%d): %s", targetKey(chat), len(members), strings.Join(members, ", ")))
+	}
+	return result.String()
+}
+
+func pauseCommand(paused bool) func(c *ChatRoom, req *CommandRequest) string {
+	return func(c *ChatRoom, req *CommandRequest) string {
+		var key string
+		if len(req.Args) != 0 {
+			key = req.Args[0]
+			if strings.EqualFold(key, "here") {
+				key = targetKey(req.Chat)
+			}
+		}
+		var err error
+		if paused {
+			err = c.Pause(key)
+		} else {
+			err = c.Resume(key)
+		}
+		if err != nil {
+			return fmt.Sprintf("Chat %s is not linked to room %s.", key, c.Name)
+		}
+		return fmt.Sprintf("%s %s.", utils.Default(key, func(v string) bool { return len(v) != 0 }, "Room "+c.Name), utils.IfElse(paused, "paused", "resumed"))
+	}
+}
+
+func linkCommand(_ *ChatRoom, req *CommandRequest) string {
+	account := identity.Account{Source: req.Msg.Source(), UserID: req.Msg.BelongUser().UID()}
+	if len(req.Args) != 0 {
+		linked, err := identity.Redeem(req.Args[0], account)
+		if err != nil {
+			return fmt.Sprintf("Failed to link: %v.", err)
+		}
+		return fmt.Sprintf("Linked %s with %s.", account, linked)
+	}
+	// 验证码只能私下发送, 公开的验证码会被别人抢先使用
+	w, ok := req.Chat.(Whisperer)
+	if !ok {
+		return fmt.Sprintf("%s can not send the code privately, run \"%s link\" on another platform and the code here.", req.Chat.Source(), model.CommandPrefix)
+	}
+	code, err := identity.NewCode(account)
+	if err != nil {
+		return fmt.Sprintf("Failed to create a code: %v.", err)
+	}
+	if err = w.Whisper(account.UserID, fmt.Sprintf("Run \"%s link %s\" with your account on another platform within %s.", model.CommandPrefix, code, identity.CodeTTL)); err != nil {
+		return fmt.Sprintf("Failed to send the code privately: %v.", err)
+	}
+	return "The code was sent to you privately."
+}
+
+func unlinkCommand(_ *ChatRoom, req *CommandRequest) string {
+	account := identity.Account{Source: req.Msg.Source(), UserID: req.Msg.BelongUser().UID()}
+	removed, err := identity.Unlink(account)
+	switch {
+	case err != nil:
+		return fmt.Sprintf("Failed to unlink: %v.", err)
+	case !removed:
+		return fmt.Sprintf("%s has no links, the links of the config are managed by the admins.", account)
+	}
+	return fmt.Sprintf("Removed the links of %s.", account)
+}
+
+func optCommand(out bool) func(c *ChatRoom, req *CommandRequest) string {
+	return func(c *ChatRoom, req *CommandRequest) string {
+		account := identity.Account{Source: req.Msg.Source(), UserID: req.Msg.BelongUser().UID()}
+		room := c.Name
+		if len(req.Args) != 0 && strings.EqualFold(req.Args[0], "all") {
+			room = ""
+		}
+		var err error
+		if out {
+			err = OptOut(room, account)
+		} else {
+			err = OptIn(room, account)
+		}
+		if err != nil {
+			return fmt.Sprintf("Failed to save your choice: %v.", err)
+		}
+		where := utils.IfElse(len(room) == 0, "any room", "room "+room)
+		switch {
+		case out:
+			return fmt.Sprintf("Your messages are not bridged in %s from now on.", where)
+		case c.optedOut(account):
+			return fmt.Sprintf("Your messages are bridged in %s again, but you are still opted out here by another setting.", where)
+		}
+		return fmt.Sprintf("Your messages are bridged in %s again.", where)
+	}
+}
@@ -0,0 +1,108 @@
+package room
+
+import (
+	"chatroom/emoji"
+	"chatroom/model"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+const (
+	deliveryReaction = "reaction"
+	deliveryNotice   = "notice"
+)
+
+const (
+	StatePending   = "pending"
+	StateDelivered = "delivered"
+	StateFailed    = "failed"
+)
+
+// DeliveryStatus is the delivery of a message to one target.
+type DeliveryStatus struct {
+	State string `json:"state"`
+	Error string `json:"error,omitempty"`
+}
+
+// delivery collects the results of the targets of a message and reports them once every target is done.
+type delivery struct {
+	room   *ChatRoom
+	msg    model.IChatMessage
+	tuple  *MessageTuple
+	lock   sync.Mutex
+	left   int
+	failed []string
+}
+
+// track marks the message pending on every target, the tasks report to the returned delivery.
+func (c *ChatRoom) track(tuple *MessageTuple, msg model.IChatMessage, room []IChat) *delivery {
+	for _, chat := range room {
+		tuple.SetStatus(targetKey(chat), DeliveryStatus{State: StatePending})
+	}
+	return &delivery{room: c, msg: msg, tuple: tuple, left: len(room)}
+}
+
+// report records the result of a target, it runs on the outbox worker of the target, or where the task was
+// queued when it could not be queued.
+func (d *delivery) report(target string, err error) {
+	d.tuple.SetStatus(target, deliveryStatus(err))
+	d.lock.Lock()
+	d.left--
+	if err != nil {
+		d.failed = append(d.failed, target)
+	}
+	done, failed := d.left == 0, d.failed
+	d.lock.Unlock()
+	if done {
+		d.room.feedback(d.msg, d.tuple, failed)
+	}
+}
+
+func deliveryStatus(err error) DeliveryStatus {
+	if err != nil {
+		return DeliveryStatus{State: StateFailed, Error: err.Error()}
+	}
+	return DeliveryStatus{State: StateDelivered}
+}
+
+// Reacter is implemented by chats where the bridge may not be able to add reactions, the delivery
+// reports fall back to notices there.
+type Reacter interface {
+	CanReact() bool
+}
+
+// feedback tells the sender how the delivery went, with a reaction on the message or a private notice
+// on failure. It runs on the worker of the last target, so the report is queued to the outbox of the
+// source chat. The reaction of the bot itself is not bridged.
+func (c *ChatRoom) feedback(msg model.IChatMessage, tuple *MessageTuple, failed []string) {
+	chat := c.Chat(fmt.Sprintf("%s:%s", msg.Source(), msg.BelongChannel().CID()))
+	if chat == nil {
+		return
+	}
+	mode := c.delivery.Mode
+	if r, ok := chat.(Reacter); ok && mode == deliveryReaction && !r.CanReact() {
+		mode = deliveryNotice
+	}
+	switch mode {
+	case deliveryReaction:
+		e := c.delivery.Success
+		if len(failed) != 0 {
+			e = c.delivery.Failure
+		}
+		if len(e) == 0 {
+			return
+		}
+		// 配置的是 unicode 表情, slack 需要转换成名称
+		c.offer(chat, &task{op: OpReactionAdd, origin: tuple, emoji: emoji.Convert(model.DiscordType, chat.Source(), e), msg: msg})
+	case deliveryNotice:
+		if len(failed) == 0 {
+			return
+		}
+		t := &task{op: OpWhisper, msg: model.NewNoticeMessage(msg.Source(), msg.BelongChannel(), fmt.Sprintf("Your message was not delivered to %s.", strings.Join(failed, ", ")))}
+		if user := msg.BelongUser(); user != nil {
+			t.user = user.UID()
+		}
+		c.offer(chat, t)
+	}
+}
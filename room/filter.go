@@ -0,0 +1,243 @@
+package room
+
+import (
+	"chatroom/conf"
+	"chatroom/model"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Envelope carries a message through the room pipeline.
+type Envelope struct {
+	Message model.IChatMessage
+	// Targets restricts the dispatch to the given chat ids, empty means every chat of the room.
+	Targets []string
+	// Extra adds targets by chat id or "platform:chatID", a chat of another room gets a copy of the new message.
+	Extra       []string
+	Annotations map[string]string
+}
+
+func (e *Envelope) Annotate(key, value string) {
+	if e.Annotations == nil {
+		e.Annotations = make(map[string]string)
+	}
+	e.Annotations[key] = value
+}
+
+// Rewrite replaces the text of the message, the other fields are kept.
+func (e *Envelope) Rewrite(text, rawText string) {
+	e.Message = &rewriteMessage{IChatMessage: e.Message, text: text, rawText: rawText}
+}
+
+func (e *Envelope) Route(chatID ...string) {
+	e.Targets = append(e.Targets, chatID...)
+}
+
+func (e *Envelope) Copy(chatID ...string) {
+	e.Extra = append(e.Extra, chatID...)
+}
+
+type rewriteMessage struct {
+	model.IChatMessage
+	text    string
+	rawText string
+}
+
+func (r *rewriteMessage) Text() string {
+	return r.text
+}
+
+func (r *rewriteMessage) RawText() string {
+	return r.rawText
+}
+
+// senderMessage replaces the sender shown in the bridged message.
+type senderMessage struct {
+	model.IChatMessage
+	user model.IUserInfo
+}
+
+func (s *senderMessage) BelongUser() model.IUserInfo {
+	return s.user
+}
+
+// bridgedMessage carries what the templates show besides the message, e.g. the preview of the replied message.
+type bridgedMessage struct {
+	model.IChatMessage
+	at    time.Time
+	reply string
+	poll  *model.Poll
+}
+
+func (b *bridgedMessage) ReceivedAt() time.Time {
+	return b.at
+}
+
+func (b *bridgedMessage) ReplyPreview() string {
+	return b.reply
+}
+
+func (b *bridgedMessage) PollData() *model.Poll {
+	return b.poll
+}
+
+// Middleware is a stage of the room pipeline, it returns false to drop the message.
+type Middleware interface {
+	Process(env *Envelope) bool
+}
+
+type MiddlewareFunc func(env *Envelope) bool
+
+func (f MiddlewareFunc) Process(env *Envelope) bool {
+	return f(env)
+}
+
+type MiddlewareFactory func(conf.Filter) (Middleware, error)
+
+var (
+	middlewares    = make(map[string]MiddlewareFactory)
+	middlewareLock sync.RWMutex
+)
+
+// RegisterMiddleware makes a stage available to the room filter configuration by type name.
+func RegisterMiddleware(name string, factory MiddlewareFactory) {
+	middlewareLock.Lock()
+	middlewares[name] = factory
+	middlewareLock.Unlock()
+}
+
+func init() {
+	RegisterMiddleware("regexDrop", newRegexDrop)
+	RegisterMiddleware("regexReplace", newRegexReplace)
+	RegisterMiddleware("userAllow", newUserAllow)
+	RegisterMiddleware("userBlock", newUserBlock)
+	RegisterMiddleware("dropBot", newDropBot)
+	RegisterMiddleware("minLength", newMinLength)
+	RegisterMiddleware("route", newRoute)
+}
+
+type Pipeline []Middleware
+
+func NewPipeline(filters []conf.Filter) (Pipeline, error) {
+	var pipeline Pipeline
+	middlewareLock.RLock()
+	defer middlewareLock.RUnlock()
+	for _, f := range filters {
+		factory, ok := middlewares[f.Type]
+		if !ok {
+			return nil, fmt.Errorf("unknown filter type: %s", f.Type)
+		}
+		m, err := factory(f)
+		if err != nil {
+			return nil, fmt.Errorf("filter %s: %w", f.Type, err)
+		}
+		pipeline = append(pipeline, m)
+	}
+	return pipeline, nil
+}
+
+func (p Pipeline) Process(msg model.IChatMessage) (*Envelope, bool) {
+	env := &Envelope{Message: msg}
+	for _, m := range p {
+		if !m.Process(env) {
+			return env, false
+		}
+	}
+	return env, true
+}
+
+func hasText(msg model.IChatMessage) bool {
+	switch msg.MessageType() {
+	case model.MessageTypeTextCreate, model.MessageTypeTextUpdate, model.MessageTypeTextReply:
+		return true
+	}
+	return false
+}
+
+func matchUser(user model.IUserInfo, users []string) bool {
+	if user == nil {
+		return false
+	}
+	for _, u := range users {
+		if u == user.UID() || strings.EqualFold(u, user.UName()) {
+			return true
+		}
+	}
+	return false
+}
+
+func newRegexDrop(f conf.Filter) (Middleware, error) {
+	rgx, err := regexp.Compile(f.Pattern)
+	if err != nil {
+		return nil, err
+	}
+	return MiddlewareFunc(func(env *Envelope) bool {
+		return !hasText(env.Message) || !rgx.MatchString(env.Message.Text())
+	}), nil
+}
+
+func newRegexReplace(f conf.Filter) (Middleware, error) {
+	rgx, err := regexp.Compile(f.Pattern)
+	if err != nil {
+		return nil, err
+	}
+	return MiddlewareFunc(func(env *Envelope) bool {
+		if hasText(env.Message) {
+			env.Rewrite(rgx.ReplaceAllString(env.Message.Text(), f.Replace), rgx.ReplaceAllString(env.Message.RawText(), f.Replace))
+		}
+		return true
+	}), nil
+}
+
+func newUserAllow(f conf.Filter) (Middleware, error) {
+	return MiddlewareFunc(func(env *Envelope) bool {
+		// 删除等事件没有用户信息
+		return env.Message.BelongUser() == nil || matchUser(env.Message.BelongUser(), f.Users)
+	}), nil
+}
+
+func newUserBlock(f conf.Filter) (Middleware, error) {
+	return MiddlewareFunc(func(env *Envelope) bool {
+		return !matchUser(env.Message.BelongUser(), f.Users)
+	}), nil
+}
+
+func newDropBot(_ conf.Filter) (Middleware, error) {
+	return MiddlewareFunc(func(env *Envelope) bool {
+		user := env.Message.BelongUser()
+		return user == nil || !user.IsBot()
+	}), nil
+}
+
+func newMinLength(f conf.Filter) (Middleware, error) {
+	return MiddlewareFunc(func(env *Envelope) bool {
+		if !hasText(env.Message) || len(env.Message.Attachment()) != 0 {
+			return true
+		}
+		return utf8.RuneCountInString(strings.TrimSpace(env.Message.Text())) >= f.Length
+	}), nil
+}
+
+func newRoute(f conf.Filter) (Middleware, error) {
+	if len(f.ChatID) == 0 {
+		return nil, fmt.Errorf("route needs chatID")
+	}
+	return MiddlewareFunc(func(env *Envelope) bool {
+		if !hasText(env.Message) {
+			return true
+		}
+		text := strings.ToLower(env.Message.Text())
+		for _, keyword := range f.Keywords {
+			if strings.Contains(text, strings.ToLower(keyword)) {
+				env.Route(f.ChatID...)
+				env.Annotate("route", keyword)
+				break
+			}
+		}
+		return true
+	}), nil
+}
@@ -0,0 +1,262 @@
+package room
+
+import (
+	"chatroom/conf"
+	"chatroom/format"
+	"chatroom/model"
+	"crypto/sha1"
+	"encoding/hex"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 隐藏标记: 零宽字符包裹的跳数, 用于识别桥接产生的消息
+const (
+	markerBound = '\u2063'
+	markerZero  = '\u200b'
+	markerOne   = '\u200c'
+	markerBits  = 4
+)
+
+var (
+	// headerRgx 旧版本 telegram 的 "User:[" 写法, 其他模板的消息头由模板生成
+	headerRgx = regexp.MustCompile(`^From: \[[^\]]*\] User:\[[^\]]*\] Send: \n`)
+	spaceRgx  = regexp.MustCompile(`\s+`)
+)
+
+// LoopDetector recognizes messages which were produced by a bridge, ours or another one.
+type LoopDetector struct {
+	maxHops   int
+	ttl       time.Duration
+	window    time.Duration
+	threshold int
+	cooldown  time.Duration
+	bots      []string
+	// headers 房间各模板渲染结果的格式, 第一组为消息内容
+	headers []*regexp.Regexp
+
+	lock    sync.Mutex
+	sent    map[string]time.Time
+	suspect map[string][]time.Time
+	muted   map[string]time.Time
+}
+
+func NewLoopDetector(c conf.Loop) *LoopDetector {
+	l := &LoopDetector{
+		maxHops:   c.MaxHops,
+		ttl:       c.TTL,
+		window:    c.Window,
+		threshold: c.Threshold,
+		cooldown:  c.Cooldown,
+		bots:      c.Bots,
+		sent:      make(map[string]time.Time),
+		suspect:   make(map[string][]time.Time),
+		muted:     make(map[string]time.Time),
+	}
+	if l.maxHops <= 0 {
+		l.maxHops = 1
+	}
+	if l.ttl <= 0 {
+		l.ttl = 5 * time.Minute
+	}
+	if l.window <= 0 {
+		l.window = time.Minute
+	}
+	if l.threshold <= 0 {
+		l.threshold = 5
+	}
+	if l.cooldown <= 0 {
+		l.cooldown = 10 * time.Minute
+	}
+	// 其他桥接通常使用默认模板
+	l.AddTemplate(nil)
+	return l
+}
+
+// AddTemplate strips the header of the template from the texts before they are fingerprinted, it is called
+// for every template of the room before the room runs.
+func (l *LoopDetector) AddTemplate(t *format.Template) {
+	for _, p := range t.Patterns() {
+		if !slices.ContainsFunc(l.headers, func(v *regexp.Regexp) bool { return v.String() == p.String() }) {
+			l.headers = append(l.headers, p)
+		}
+	}
+}
+
+// Check returns the hop count of the message and the reason when it looks like a loop.
+func (l *LoopDetector) Check(msg model.IChatMessage) (hops int, reason string) {
+	if !hasText(msg) {
+		return 0, ""
+	}
+	hops, marked := parseMarker(msg.RawText())
+	if !marked {
+		hops, marked = parseMarker(msg.Text())
+	}
+	if marked && hops >= l.maxHops {
+		return hops, "hop limit reached"
+	}
+	body, stripped := l.normalize(msg.Text())
+	if len(body) == 0 {
+		return hops, ""
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	at, exist := l.sent[fingerprint(body)]
+	if !exist || time.Since(at) > l.ttl {
+		return hops, ""
+	}
+	// 只有确认来自桥接时才算回环, 其他机器人重复发送同样的内容是正常的
+	if marked || stripped || matchUser(msg.BelongUser(), l.bots) {
+		return hops, "content already bridged"
+	}
+	return hops, ""
+}
+
+// Remember records the content sent by the bridge.
+func (l *LoopDetector) Remember(msg model.IChatMessage) {
+	if !hasText(msg) {
+		return
+	}
+	body, _ := l.normalize(msg.Text())
+	if len(body) == 0 {
+		return
+	}
+	now := time.Now()
+	l.lock.Lock()
+	l.sent[fingerprint(body)] = now
+	for k, at := range l.sent {
+		if now.Sub(at) > l.ttl {
+			delete(l.sent, k)
+		}
+	}
+	l.lock.Unlock()
+}
+
+// Suspect counts a suspected loop of the channel, it returns true when the channel starts being muted.
+func (l *LoopDetector) Suspect(key string) bool {
+	now := time.Now()
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	times := []time.Time{now}
+	for _, at := range l.suspect[key] {
+		if now.Sub(at) < l.window {
+			times = append(times, at)
+		}
+	}
+	l.suspect[key] = times
+	if len(times) < l.threshold {
+		return false
+	}
+	if until, ok := l.muted[key]; ok && now.Before(until) {
+		return false
+	}
+	l.muted[key] = now.Add(l.cooldown)
+	delete(l.suspect, key)
+	return true
+}
+
+func (l *LoopDetector) Muted(key string) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	until, ok := l.muted[key]
+	if !ok {
+		return false
+	}
+	if time.Now().After(until) {
+		delete(l.muted, key)
+		return false
+	}
+	return true
+}
+
+func (l *LoopDetector) Cooldown() time.Duration {
+	return l.cooldown
+}
+
+// Mark appends the hidden marker with the hop count to the message text.
+func (l *LoopDetector) Mark(msg model.IChatMessage, hops int) model.IChatMessage {
+	if !hasText(msg) {
+		return msg
+	}
+	marker := encodeMarker(hops)
+	return &rewriteMessage{IChatMessage: msg, text: stripMarker(msg.Text()) + marker, rawText: stripMarker(msg.RawText()) + marker}
+}
+
+func encodeMarker(hops int) string {
+	if hops >= 1<<markerBits {
+		hops = 1<<markerBits - 1
+	}
+	var b strings.Builder
+	b.WriteRune(markerBound)
+	for i := markerBits - 1; i >= 0; i-- {
+		if hops&(1<<i) != 0 {
+			b.WriteRune(markerOne)
+		} else {
+			b.WriteRune(markerZero)
+		}
+	}
+	b.WriteRune(markerBound)
+	return b.String()
+}
+
+func parseMarker(text string) (int, bool) {
+	start := strings.IndexRune(text, markerBound)
+	if start < 0 {
+		return 0, false
+	}
+	hops, n := 0, 0
+	for _, r := range text[start+len(string(markerBound)):] {
+		switch r {
+		case markerZero:
+			hops <<= 1
+		case markerOne:
+			hops = hops<<1 | 1
+		case markerBound:
+			return hops, n == markerBits
+		default:
+			return 0, false
+		}
+		n++
+	}
+	return 0, false
+}
+
+func stripMarker(text string) string {
+	return strings.Map(func(r rune) rune {
+		if r == markerBound || r == markerZero || r == markerOne {
+			return -1
+		}
+		return r
+	}, text)
+}
+
+// normalize removes markers and bridge headers, stripped reports whether a header was found.
+func (l *LoopDetector) normalize(text string) (body string, stripped bool) {
+	text = stripMarker(text)
+	for headerRgx.MatchString(text) {
+		text = headerRgx.ReplaceAllString(text, "")
+		stripped = true
+	}
+	// 嵌套的消息头逐层去掉, 只有正文的模板不算消息头
+	for found := true; found; {
+		found = false
+		for _, header := range l.headers {
+			if m := header.FindStringSubmatch(text); m != nil && len(m[1]) < len(text) {
+				text, stripped, found = m[1], true, true
+				break
+			}
+		}
+	}
+	if idx := strings.LastIndex(text, "\nAttachment:"); idx >= 0 {
+		text = text[:idx]
+	}
+	return strings.ToLower(strings.TrimSpace(spaceRgx.ReplaceAllString(text, " "))), stripped
+}
+
+func fingerprint(text string) string {
+	sum := sha1.Sum([]byte(text))
+	return hex.EncodeToString(sum[:])
+}
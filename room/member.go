@@ -0,0 +1,122 @@
+package room
+
+import (
+	"chatroom/identity"
+	"chatroom/model"
+	"chatroom/utils"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	memberForward = "forward"
+	memberSummary = "summary"
+)
+
+// member bridges a member joining, leaving or renamed according to the members mode of the room.
+func (c *ChatRoom) member(msg model.IChatMessage) {
+	if c.members.Mode != memberForward && c.members.Mode != memberSummary {
+		return
+	}
+	if user := msg.BelongUser(); user == nil || user.IsBot() || c.optedOut(identity.Account{Source: msg.Source(), UserID: user.UID()}) {
+		return
+	}
+	if msg.MessageType() == model.MessageTypeMemberRename {
+		// 匿名或配置了名称时, 桥接消息中看不到平台上的名称
+		if c.privacy.Anonymize || len(identity.Name(identity.Account{Source: msg.Source(), UserID: msg.BelongUser().UID()})) != 0 {
+			return
+		}
+	} else {
+		msg = c.sender(msg)
+	}
+	if c.members.Mode == memberSummary {
+		c.memberEvents = append(c.memberEvents, msg)
+		return
+	}
+	for _, chat := range c.Room {
+		if chat.Source() == msg.Source() && chat.ChannelID() == msg.BelongChannel().CID() || c.Paused(targetKey(chat)) {
+			continue
+		}
+		c.enqueue(chat, &task{op: OpSend, msg: msg})
+	}
+}
+
+// flushMembers sends the summary of the member events to every chat once the interval passed,
+// a chat does not get the events of its own channel.
+func (c *ChatRoom) flushMembers(force bool) {
+	if len(c.memberEvents) == 0 || !force && time.Since(c.memberFlush) < c.members.Interval {
+		return
+	}
+	events := c.memberEvents
+	c.memberEvents, c.memberFlush = nil, time.Now()
+	if c.Paused("") {
+		return
+	}
+	for _, chat := range c.Room {
+		if c.Paused(targetKey(chat)) {
+			continue
+		}
+		text := memberSummaryText(utils.FilterSlice(events, func(msg model.IChatMessage) bool {
+			return msg.Source() == chat.Source() && msg.BelongChannel().CID() == chat.ChannelID()
+		}))
+		if len(text) == 0 {
+			continue
+		}
+		msg := model.NewNoticeMessage(chat.Source(), &model.ChannelInfo{ID: chat.ChannelID(), Name: "members"}, text)
+		msg.ID = fmt.Sprintf("members-%d", time.Now().UnixNano())
+		c.enqueue(chat, &task{op: OpSend, msg: msg})
+	}
+}
+
+// memberSummaryText groups the events by channel, e.g. "[Slack] general: joined alice, bob; left carol".
+func memberSummaryText(events []model.IChatMessage) string {
+	if len(events) == 0 {
+		return ""
+	}
+	type group struct {
+		name   string
+		joined []string
+		left   []string
+		rename []string
+	}
+	var keys []string
+	groups := make(map[string]*group)
+	for _, msg := range events {
+		key := fmt.Sprintf("%s:%s", msg.Source(), msg.BelongChannel().CID())
+		g := groups[key]
+		if g == nil {
+			g = &group{name: fmt.Sprintf("[%s] %s", msg.Source(), msg.BelongChannel().CName())}
+			groups[key] = g
+			keys = append(keys, key)
+		}
+		name := msg.BelongUser().UName()
+		switch msg.MessageType() {
+		case model.MessageTypeMemberJoin:
+			g.joined = append(g.joined, name)
+		case model.MessageTypeMemberLeave:
+			g.left = append(g.left, name)
+		case model.MessageTypeMemberRename:
+			if m, ok := msg.(*model.MemberMessage); ok {
+				g.rename = append(g.rename, fmt.Sprintf("%s -> %s", m.OldName, name))
+			}
+		}
+	}
+	var result strings.Builder
+	result.WriteString("Member changes:")
+	for _, key := range keys {
+		g := groups[key]
+		var parts []string
+		for _, v := range []struct {
+			label string
+			names []string
+		}{{"joined", g.joined}, {"left", g.left}, {"renamed", g.rename}} {
+			if len(v.names) != 0 {
+				parts = append(parts, fmt.Sprintf("%s %s", v.label, strings.Join(slices.Compact(v.names), ", ")))
+			}
+		}
+		result.WriteString(fmt.Sprintf("\n%s: %s", g.name, strings.Join(parts, "; ")))
+	}
+	return result.String()
+}
@@ -1,9 +1,15 @@
 package room
 
 import (
+	"chatroom/format"
 	"chatroom/model"
+	"fmt"
+	"maps"
+	"sync"
 )
 
+const previewLength = 200
+
 type MessageRecord struct {
 	ID        string
 	ChannelID string
@@ -15,16 +21,34 @@ type MessageTuple struct {
 	Type    model.MessageType
 	Child   *MessageTuple
 	Parent  *MessageTuple
+	// Preview 消息内容的开头, 回复时在模板中显示
+	Preview string
+	// status 各目标的投递状态
+	status map[string]DeliveryStatus
+	// poll 投票的统计, 不是投票时为空
+	poll *pollTally
+	// 记录由各目标的投递队列并发写入
+	lock sync.RWMutex
+}
+
+func NewMessageTuple(msg model.IChatMessage) *MessageTuple {
+	return &MessageTuple{
+		Type:    msg.MessageType(),
+		Message: []MessageRecord{{ID: msg.MessageID(), ChannelID: msg.BelongChannel().CID(), Source: msg.Source()}},
+		Preview: format.Truncate(previewLength, stripMarker(msg.Text())),
+	}
 }
 
 func (m *MessageTuple) FindMessageID(source model.TypeSource, channelID string) string {
 	cur := m
 	if source == model.SlackType { // 找slack 顶级parent
-		for cur.Parent != nil {
-			cur = cur.Parent
+		for parent := cur.ParentTuple(); parent != nil; parent = cur.ParentTuple() {
+			cur = parent
 		}
 	}
-	for _, record := range m.Message {
+	cur.lock.RLock()
+	defer cur.lock.RUnlock()
+	for _, record := range cur.Message {
 		if record.Source == source && record.ChannelID == channelID {
 			return record.ID
 		}
@@ -32,18 +56,96 @@ func (m *MessageTuple) FindMessageID(source model.TypeSource, channelID string)
 	return ""
 }
 
-func (m *MessageTuple) Delete() {
-	if m.Parent != nil {
-		m.Parent.Child = m.Child
+// ParentTuple returns the message the tuple replies to, the links are changed by the room loop while the
+// outbox workers read them.
+func (m *MessageTuple) ParentTuple() *MessageTuple {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return m.Parent
+}
+
+func (m *MessageTuple) Has(source model.TypeSource, channelID, messageID string) bool {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	for _, record := range m.Message {
+		if record.Source == source && record.ChannelID == channelID && record.ID == messageID {
+			return true
+		}
+	}
+	return false
+}
+
+// HasID reports whether any platform message of the tuple has the id.
+func (m *MessageTuple) HasID(messageID string) bool {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	for _, record := range m.Message {
+		if record.ID == messageID {
+			return true
+		}
 	}
-	if m.Child != nil {
-		m.Child.Parent = m.Parent
+	return false
+}
+
+// Records returns a copy of the platform messages of the tuple.
+func (m *MessageTuple) Records() []MessageRecord {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return append([]MessageRecord(nil), m.Message...)
+}
+
+// SetStatus records the delivery status of a target.
+func (m *MessageTuple) SetStatus(target string, status DeliveryStatus) {
+	m.lock.Lock()
+	if m.status == nil {
+		m.status = make(map[string]DeliveryStatus)
 	}
+	m.status[target] = status
+	m.lock.Unlock()
+}
+
+// Status returns a copy of the delivery status of every target.
+func (m *MessageTuple) Status() map[string]DeliveryStatus {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return maps.Clone(m.status)
+}
+
+func (m *MessageTuple) Append(record MessageRecord) {
+	m.lock.Lock()
+	m.Message = append(m.Message, record)
+	m.lock.Unlock()
+}
+
+func (m *MessageTuple) String() string {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return fmt.Sprintf("%v", m.Message)
+}
+
+func (m *MessageTuple) Delete() {
+	m.lock.Lock()
+	parent, child := m.Parent, m.Child
 	m.Parent = nil
 	m.Child = nil
+	m.lock.Unlock()
+	if parent != nil {
+		parent.lock.Lock()
+		parent.Child = child
+		parent.lock.Unlock()
+	}
+	if child != nil {
+		child.lock.Lock()
+		child.Parent = parent
+		child.lock.Unlock()
+	}
 }
 
 func (m *MessageTuple) AddChild(child *MessageTuple) {
+	child.lock.Lock()
 	child.Parent = m
+	child.lock.Unlock()
+	m.lock.Lock()
 	m.Child = child
+	m.lock.Unlock()
 }
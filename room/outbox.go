@@ -0,0 +1,456 @@
+package room
+
+import (
+	"chatroom/conf"
+	"chatroom/model"
+	"chatroom/store"
+	"chatroom/utils"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	outboxBucket     = "outbox"
+	deadLetterBucket = "deadletter"
+)
+
+var (
+	errMessageNotFound = errors.New("message not found in the target")
+	errLeftInOutbox    = errors.New("not delivered before shutdown, left in the outbox")
+	errQueueFull       = errors.New("queue of the target is full, dropped")
+)
+
+type Operation int
+
+const (
+	OpSend Operation = iota
+	OpReply
+	OpUpdate
+	OpDelete
+	OpReactionAdd
+	OpReactionRemove
+	OpReactionRemoveAll
+	OpPin
+	OpUnpin
+	OpPoll
+	OpWhisper
+)
+
+func (o Operation) String() string {
+	switch o {
+	case OpSend:
+		return "send"
+	case OpReply:
+		return "reply"
+	case OpUpdate:
+		return "update"
+	case OpDelete:
+		return "delete"
+	case OpReactionAdd:
+		return "reactionAdd"
+	case OpReactionRemove:
+		return "reactionRemove"
+	case OpReactionRemoveAll:
+		return "reactionRemoveAll"
+	case OpPin:
+		return "pin"
+	case OpUnpin:
+		return "unpin"
+	case OpPoll:
+		return "poll"
+	case OpWhisper:
+		return "whisper"
+	}
+	return "unknown"
+}
+
+// Job is one delivery to a target chat, it is persisted from the time it is queued until it succeeds
+// or is dead-lettered.
+type Job struct {
+	Key       string               `json:"key"`
+	Room      string               `json:"room"`
+	Target    string               `json:"target"`
+	Op        Operation            `json:"op"`
+	MessageID string               `json:"messageID,omitempty"`
+	Emoji     string               `json:"emoji,omitempty"`
+	UserID    string               `json:"userID,omitempty"`
+	Message   *model.StoredMessage `json:"message"`
+	// Origin is a platform message of the tuple the operation applies to, the target message id is resolved from it
+	Origin *MessageRecord `json:"origin,omitempty"`
+	// Record appends the delivered message to the tuple of Message
+	Record    bool      `json:"record,omitempty"`
+	Attempts  int       `json:"attempts"`
+	LastError string    `json:"lastError,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+
+	msg model.IChatMessage
+}
+
+// task is a dispatched operation waiting in the queue of a target, the target message id is resolved when it runs
+// so that operations on a message queued behind its creation still find it.
+type task struct {
+	op     Operation
+	origin *MessageTuple
+	record *MessageTuple
+	emoji  string
+	// user 私下通知的用户
+	user string
+	msg  model.IChatMessage
+	// done 收到投递结果后调用, 只有发送和回复有
+	done func(target string, err error)
+	// job 入队时持久化的任务
+	job *Job
+}
+
+// Retrier is implemented by chats which can tell whether a failed request is worth retrying.
+type Retrier interface {
+	RetryAfter(err error) (time.Duration, bool)
+}
+
+// Pinner is implemented by chats which can pin messages, pins are not bridged to the other chats.
+type Pinner interface {
+	Pin(messageID string) error
+	Unpin(messageID string) error
+}
+
+// Outbox delivers the jobs of one target chat in order, every target has its own queue and worker
+// so that a slow platform does not hold back the others.
+type Outbox struct {
+	room    string
+	target  string
+	chat    IChat
+	queue   chan *task
+	done    chan struct{}
+	dropped int
+	// closed 停止接收任务后仍可能有其他目标的回执入队
+	closed    bool
+	closeLock sync.RWMutex
+	// replay 上次运行留下的任务, worker 先投递它们
+	replay []string
+	// recorded 在记录新的目标消息后调用, restore 重建上次运行留下的任务
+	recorded       func()
+	restore        func(job *Job) *task
+	ctx            context.Context
+	maxAttempts    int
+	backoff        time.Duration
+	maxBackoff     time.Duration
+	maxDeadLetters int
+	seq            atomic.Int64
+	log            *log.Logger
+}
+
+// NewOutbox creates the outbox of the target, the context stops the deliveries and retries in flight.
+func NewOutbox(ctx context.Context, room string, chat IChat, c conf.Outbox, logger *log.Logger) *Outbox {
+	o := &Outbox{
+		room:        room,
+		target:      targetKey(chat),
+		chat:        chat,
+		queue:       make(chan *task, utils.Default(c.QueueSize, func(v int) bool { return v > 0 }, 100)),
+		done:        make(chan struct{}),
+		ctx:         ctx,
+		maxAttempts: utils.Default(c.MaxAttempts, func(v int) bool { return v > 0 }, 5),
+		backoff:     utils.Default(c.Backoff, func(v time.Duration) bool { return v > 0 }, time.Second),
+		maxBackoff:  utils.Default(c.MaxBackoff, func(v time.Duration) bool { return v > 0 }, time.Minute),
+		log:         logger,
+	}
+	o.maxDeadLetters = utils.Default(c.MaxDeadLetters, func(v int) bool { return v > 0 }, 100)
+	o.restore = func(job *Job) *task { return &task{op: job.Op, emoji: job.Emoji, msg: job.msg, job: job} }
+	o.replay = store.Keys(outboxBucket, o.prefix())
+	o.seq.Store(time.Now().UnixNano())
+	return o
+}
+
+func targetKey(chat IChat) string {
+	return fmt.Sprintf("%s:%s", chat.Source(), chat.ChannelID())
+}
+
+func (o *Outbox) prefix() string {
+	return fmt.Sprintf("%s/%s/", o.room, o.target)
+}
+
+// Run delivers the jobs left by the previous run and then the queued tasks until the queue is closed,
+// the tasks left after the context is done stay in the outbox for the next start.
+func (o *Outbox) Run() {
+	defer close(o.done)
+	o.replayJobs()
+	for t := range o.queue {
+		if o.ctx.Err() != nil {
+			o.dropped++
+			o.report(t, errLeftInOutbox)
+			continue
+		}
+		o.process(t)
+	}
+}
+
+// Close stops accepting tasks, Wait returns once the queued tasks are delivered.
+func (o *Outbox) Close() {
+	o.closeLock.Lock()
+	defer o.closeLock.Unlock()
+	o.closed = true
+	close(o.queue)
+}
+
+// Wait waits for the worker to stop and returns the number of tasks left in the outbox.
+func (o *Outbox) Wait() int {
+	<-o.done
+	return o.dropped
+}
+
+// enqueue persists and queues the task, it blocks while the queue is full to hold back the room instead of piling
+// up messages. The tasks which can not be queued once the outbox is stopping stay in the outbox for the next start.
+func (o *Outbox) enqueue(t *task) bool {
+	return o.push(t, true)
+}
+
+// offer queues the task unless the queue is full, it is used by the workers of the other targets which must not
+// wait for each other.
+func (o *Outbox) offer(t *task) bool {
+	return o.push(t, false)
+}
+
+func (o *Outbox) push(t *task, wait bool) bool {
+	t.job = &Job{
+		Key:       fmt.Sprintf("%s%020d", o.prefix(), o.seq.Add(1)),
+		Room:      o.room,
+		Target:    o.target,
+		Op:        t.op,
+		Emoji:     t.emoji,
+		UserID:    t.user,
+		Message:   model.NewStoredMessage(t.msg),
+		Record:    t.record != nil,
+		CreatedAt: time.Now(),
+		msg:       t.msg,
+	}
+	if t.origin != nil {
+		if records := t.origin.Records(); len(records) != 0 {
+			t.job.Origin = &records[0]
+		}
+	}
+	o.persist(t.job)
+	// 没能排队的任务也要报告结果, 否则投递状态一直等待
+	if err := o.put(t, wait); err != nil {
+		o.report(t, err)
+		return false
+	}
+	return true
+}
+
+func (o *Outbox) put(t *task, wait bool) error {
+	o.closeLock.RLock()
+	defer o.closeLock.RUnlock()
+	if o.closed {
+		return errLeftInOutbox
+	}
+	select {
+	case o.queue <- t:
+		return nil
+	default:
+	}
+	if !wait {
+		o.remove(t.job)
+		return errQueueFull
+	}
+	o.log.Printf("queue of [%s] is full, waiting for delivery", o.target)
+	select {
+	case o.queue <- t:
+		return nil
+	case <-o.ctx.Done():
+		return errLeftInOutbox
+	}
+}
+
+// replayJobs delivers the jobs left by the previous run in their order, before the tasks of this run.
+func (o *Outbox) replayJobs() {
+	for _, key := range o.replay {
+		if o.ctx.Err() != nil {
+			return
+		}
+		job := new(Job)
+		if !store.Get(outboxBucket, key, job) {
+			continue
+		}
+		job.msg = job.Message
+		o.log.Printf("replay outbox job %s %s to [%s]", job.Key, job.Op, job.Target)
+		o.process(o.restore(job))
+	}
+	o.replay = nil
+}
+
+func (o *Outbox) process(t *task) {
+	job := t.job
+	if t.origin != nil {
+		job.MessageID = t.origin.FindMessageID(o.chat.Source(), o.chat.ChannelID())
+		if len(job.MessageID) == 0 {
+			o.log.Printf("%s [%s] message, not found channel [%s] messageID\n", t.op, o.chat.Source(), o.chat.ChannelID())
+			if t.op != OpReply {
+				o.remove(job)
+				o.report(t, errMessageNotFound)
+				return
+			}
+		}
+	}
+	id, err := o.run(job)
+	o.report(t, err)
+	if err != nil {
+		o.log.Printf("failed to %s [%s] message, id: [%s], %v", t.op, o.chat.ChannelID(), job.MessageID, err)
+		return
+	}
+	if t.record != nil {
+		t.record.Append(MessageRecord{ID: id, ChannelID: o.chat.ChannelID(), Source: o.chat.Source()})
+		if o.recorded != nil {
+			o.recorded()
+		}
+	}
+}
+
+func (o *Outbox) report(t *task, err error) {
+	if t.done != nil {
+		t.done(o.target, err)
+	}
+}
+
+func (o *Outbox) persist(job *Job) {
+	if err := store.Put(outboxBucket, job.Key, job); err != nil {
+		o.log.Printf("failed to persist outbox job %s, %v", job.Key, err)
+	}
+}
+
+func (o *Outbox) remove(job *Job) {
+	if err := store.Delete(outboxBucket, job.Key); err != nil {
+		o.log.Printf("failed to remove outbox job %s, %v", job.Key, err)
+	}
+}
+
+// run delivers the job with retries, the job is dead-lettered when it keeps failing.
+func (o *Outbox) run(job *Job) (string, error) {
+	for {
+		id, err := o.exec(job)
+		if err == nil {
+			o.remove(job)
+			return id, nil
+		}
+		job.Attempts++
+		job.LastError = err.Error()
+		wait, retry := o.retryAfter(err, job.Attempts)
+		if !retry || job.Attempts >= o.maxAttempts {
+			o.log.Printf("dead letter %s %s to [%s] after %d attempts, %v", job.Key, job.Op, job.Target, job.Attempts, err)
+			o.deadLetter(job)
+			o.remove(job)
+			return "", err
+		}
+		o.persist(job)
+		o.log.Printf("retry %s %s to [%s] in %s, attempt %d, %v", job.Key, job.Op, job.Target, wait, job.Attempts, err)
+		select {
+		case <-time.After(wait):
+		case <-o.ctx.Done():
+			// 任务留在 outbox 中, 下次启动重新投递
+			o.log.Printf("stop retrying %s %s to [%s], left in outbox", job.Key, job.Op, job.Target)
+			return "", o.ctx.Err()
+		}
+	}
+}
+
+// deadLetter keeps the failed job for inspection, only the latest dead letters of the target are kept.
+func (o *Outbox) deadLetter(job *Job) {
+	if err := store.Put(deadLetterBucket, job.Key, job); err != nil {
+		o.log.Printf("failed to persist dead letter %s, %v", job.Key, err)
+	}
+	keys := store.Keys(deadLetterBucket, o.prefix())
+	for _, key := range keys[:max(len(keys)-o.maxDeadLetters, 0)] {
+		if err := store.Delete(deadLetterBucket, key); err != nil {
+			o.log.Printf("failed to remove dead letter %s, %v", key, err)
+		}
+	}
+}
+
+func (o *Outbox) exec(job *Job) (string, error) {
+	switch job.Op {
+	case OpSend:
+		return o.chat.SendMessage(job.msg)
+	case OpReply:
+		return o.chat.SendReplyMessage(job.MessageID, job.msg)
+	case OpUpdate:
+		return job.MessageID, o.chat.UpdateMessage(job.MessageID, job.msg)
+	case OpDelete:
+		return job.MessageID, o.chat.DeleteMessage(job.MessageID)
+	case OpReactionAdd:
+		return job.MessageID, o.chat.SendReaction(job.MessageID, job.Emoji)
+	case OpReactionRemove:
+		return job.MessageID, o.chat.RemoveReaction(job.MessageID, job.Emoji)
+	case OpReactionRemoveAll:
+		return job.MessageID, o.chat.RemoveReactionAll(job.MessageID)
+	case OpPin, OpUnpin:
+		p, ok := o.chat.(Pinner)
+		if !ok {
+			return "", fmt.Errorf("%s is not supported by %s", job.Op, o.chat.Source())
+		}
+		if job.Op == OpPin {
+			return job.MessageID, p.Pin(job.MessageID)
+		}
+		return job.MessageID, p.Unpin(job.MessageID)
+	case OpPoll:
+		p, ok := o.chat.(Poller)
+		if !ok || model.PollOf(job.msg) == nil {
+			// 重放时 chat 可能已不支持原生投票
+			return o.chat.SendMessage(job.msg)
+		}
+		return p.SendPoll(job.msg)
+	case OpWhisper:
+		if w, ok := o.chat.(Whisperer); ok && len(job.UserID) != 0 {
+			if err := w.Whisper(job.UserID, job.msg.Text()); err == nil {
+				return "", nil
+			}
+		}
+		// 不能私聊时发到频道
+		return o.chat.SendMessage(job.msg)
+	}
+	return "", fmt.Errorf("unknown operation %d", job.Op)
+}
+
+// retryAfter returns the delay before the next attempt, the platform retry-after wins over the backoff.
+func (o *Outbox) retryAfter(err error, attempts int) (time.Duration, bool) {
+	backoff := o.backoff << (attempts - 1)
+	if backoff > o.maxBackoff || backoff <= 0 {
+		backoff = o.maxBackoff
+	}
+	if r, ok := o.chat.(Retrier); ok {
+		if wait, retry := r.RetryAfter(err); retry {
+			return max(wait, backoff), true
+		}
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return backoff, true
+	}
+	return 0, false
+}
+
+func (o *Outbox) Target() string {
+	return o.target
+}
+
+func (o *Outbox) Pending() []Job {
+	return jobs(outboxBucket, o.prefix())
+}
+
+func (o *Outbox) DeadLetters() []Job {
+	return jobs(deadLetterBucket, o.prefix())
+}
+
+func jobs(bucket, prefix string) []Job {
+	var result []Job
+	for _, key := range store.Keys(bucket, prefix) {
+		var job Job
+		if store.Get(bucket, key, &job) {
+			result = append(result, job)
+		}
+	}
+	return result
+}
@@ -0,0 +1,50 @@
+package room
+
+import (
+	"chatroom/model"
+	"time"
+)
+
+// pendingMessage is an edit, delete or reaction which arrived before the message it belongs to was dispatched.
+type pendingMessage struct {
+	msg   model.IChatMessage
+	room  []IChat
+	until time.Time
+}
+
+// hold keeps the message until the message it belongs to is dispatched or the pending ttl expires.
+func (c *ChatRoom) hold(msg model.IChatMessage, room []IChat) {
+	c.log.Printf("message not found yet, pending [%s] channel [%s] messageID: [%s] type: %d", msg.Source(), msg.BelongChannel().CID(), msg.MessageID(), msg.MessageType())
+	c.pending = append(c.pending, &pendingMessage{msg: msg, room: room, until: time.Now().Add(c.pendingTTL)})
+}
+
+// release routes the pending messages again after a new message was dispatched, in arrival order.
+func (c *ChatRoom) release() {
+	if len(c.pending) == 0 {
+		return
+	}
+	pending := c.pending
+	c.pending = nil
+	// 挂起的只有编辑, 删除和表情, route 不会再次调用 release
+	for _, p := range pending {
+		if !c.route(p.msg, p.room) {
+			c.pending = append(c.pending, p)
+			continue
+		}
+		c.log.Printf("pending message dispatched [%s] channel [%s] messageID: [%s]", p.msg.Source(), p.msg.BelongChannel().CID(), p.msg.MessageID())
+	}
+}
+
+// expire drops the pending messages whose message never showed up.
+func (c *ChatRoom) expire() {
+	now := time.Now()
+	var pending []*pendingMessage
+	for _, p := range c.pending {
+		if now.Before(p.until) {
+			pending = append(pending, p)
+			continue
+		}
+		c.log.Printf("message failed, not found [%s] channel [%s] messageID: [%s] type: %d", p.msg.Source(), p.msg.BelongChannel().CID(), p.msg.MessageID(), p.msg.MessageType())
+	}
+	c.pending = pending
+}
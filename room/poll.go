@@ -0,0 +1,163 @@
+package room
+
+import (
+	"chatroom/emoji"
+	"chatroom/identity"
+	"chatroom/model"
+	"chatroom/utils"
+	"fmt"
+	"slices"
+	"time"
+)
+
+// Poller is implemented by chats which have native polls, the others get the emoji vote rendering.
+type Poller interface {
+	SendPoll(msg model.IChatMessage) (string, error)
+}
+
+// pollTally is the shared result of a bridged poll, the votes of every platform keyed by the voter.
+// It is only accessed in Loop.
+type pollTally struct {
+	// message 投票的原消息, 更新结果时沿用它的发送者
+	message *model.StoredMessage
+	votes   map[string][]int
+	// result 原生投票的 chat 在投票下方显示的结果消息
+	result *MessageTuple
+	sent   map[string]bool
+	dirty  bool
+}
+
+// storedPoll is the persisted tally of a poll.
+type storedPoll struct {
+	Message *model.StoredMessage `json:"message"`
+	Votes   map[string][]int     `json:"votes,omitempty"`
+	Result  []MessageRecord      `json:"result,omitempty"`
+}
+
+func newPollTally(msg model.IChatMessage) *pollTally {
+	return &pollTally{message: model.NewStoredMessage(msg), votes: make(map[string][]int), result: new(MessageTuple), sent: make(map[string]bool)}
+}
+
+func (p *pollTally) store() *storedPoll {
+	return &storedPoll{Message: p.message, Votes: p.votes, Result: p.result.Records()}
+}
+
+func (s *storedPoll) load() *pollTally {
+	p := &pollTally{message: s.Message, votes: s.Votes, result: &MessageTuple{Message: s.Result}, sent: make(map[string]bool)}
+	if p.votes == nil {
+		p.votes = make(map[string][]int)
+	}
+	for _, record := range s.Result {
+		p.sent[fmt.Sprintf("%s:%s", record.Source, record.ChannelID)] = true
+	}
+	return p
+}
+
+// counts returns the number of votes of every option.
+func (p *pollTally) counts() []int {
+	counts := make([]int, len(p.message.Poll.Options))
+	for _, votes := range p.votes {
+		for _, i := range votes {
+			if i >= 0 && i < len(counts) {
+				counts[i]++
+			}
+		}
+	}
+	return counts
+}
+
+// set replaces the votes of the voter, the native polls send every selected option.
+func (p *pollTally) set(voter string, votes []int) {
+	if len(votes) == 0 {
+		delete(p.votes, voter)
+	} else {
+		p.votes[voter] = votes
+	}
+	p.dirty = true
+}
+
+// toggle adds or removes the option voted with a reaction, a single choice poll keeps the last one.
+func (p *pollTally) toggle(voter string, option int, add bool) {
+	votes := slices.DeleteFunc(slices.Clone(p.votes[voter]), func(v int) bool { return v == option })
+	if add {
+		votes = append(utils.IfElse(p.message.Poll.Multiple, votes, nil), option)
+	}
+	p.set(voter, votes)
+}
+
+// pollReaction counts a number reaction on a copy of the poll as a vote, it returns false for the other reactions.
+func (c *ChatRoom) pollReaction(origin *MessageTuple, msg model.IChatMessage) bool {
+	option := model.PollKey(emoji.Convert(msg.Source(), model.DiscordType, msg.Emoji()))
+	if option < 0 || option >= len(origin.poll.message.Poll.Options) {
+		return false
+	}
+	// 和原生投票一样, 退出桥接的用户不计票
+	if user := msg.BelongUser(); user != nil && !user.IsBot() && !c.optedOut(identity.Account{Source: msg.Source(), UserID: user.UID()}) {
+		origin.poll.toggle(voter(msg), option, msg.MessageType() == model.MessageTypeActionAdd)
+	}
+	return true
+}
+
+// vote records a vote of a native poll.
+func (c *ChatRoom) vote(msg model.IChatMessage) {
+	if user := msg.BelongUser(); user == nil || user.IsBot() || c.optedOut(identity.Account{Source: msg.Source(), UserID: user.UID()}) {
+		return
+	}
+	origin := c.SearchMessage(msg.Source(), msg.BelongChannel().CID(), msg.MessageID())
+	if origin == nil || origin.poll == nil {
+		c.log.Printf("vote dropped, poll not found [%s] channel [%s] messageID: [%s]", msg.Source(), msg.BelongChannel().CID(), msg.MessageID())
+		return
+	}
+	origin.poll.set(voter(msg), model.PollVotes(msg))
+}
+
+// voter keys the votes by person, the linked accounts of a person vote once.
+func voter(msg model.IChatMessage) string {
+	return identity.Linked(identity.Account{Source: msg.Source(), UserID: msg.BelongUser().UID()})[0].String()
+}
+
+// flushPolls updates the result of the polls voted since the last flush on every copy.
+func (c *ChatRoom) flushPolls(force bool) {
+	if !force && time.Since(c.pollFlush) < c.pollInterval {
+		return
+	}
+	c.pollFlush = time.Now()
+	if c.Paused("") {
+		return
+	}
+	for _, tuple := range c.MessageList.Values() {
+		if tuple.poll == nil || !tuple.poll.dirty {
+			continue
+		}
+		tuple.poll.dirty = false
+		c.flushPoll(tuple)
+		c.dirty.Store(true)
+	}
+}
+
+// flushPoll edits the emoji vote copies, the chats with the native poll get a result message which is edited afterwards.
+func (c *ChatRoom) flushPoll(tuple *MessageTuple) {
+	p := tuple.poll
+	text := model.PollText(p.message.Poll, p.counts())
+	update := *p.message
+	update.Message, update.RawMessage = text, text
+	for _, chat := range c.Room {
+		key := targetKey(chat)
+		if c.Paused(key) {
+			continue
+		}
+		_, native := chat.(Poller)
+		if !native && (chat.Source() != p.message.Source() || chat.ChannelID() != p.message.BelongChannel().CID()) {
+			c.enqueue(chat, &task{op: OpUpdate, origin: tuple, msg: &update})
+			continue
+		}
+		result := model.NewNoticeMessage(chat.Source(), &model.ChannelInfo{ID: chat.ChannelID(), Name: "poll"}, fmt.Sprintf("Poll results:\n%s", text))
+		result.ID = fmt.Sprintf("poll-%d", time.Now().UnixNano())
+		if p.sent[key] {
+			c.enqueue(chat, &task{op: OpUpdate, origin: p.result, msg: result})
+			continue
+		}
+		p.sent[key] = true
+		c.enqueue(chat, &task{op: OpSend, record: p.result, msg: result})
+	}
+}
@@ -0,0 +1,153 @@
+package room
+
+import (
+	"chatroom/conf"
+	"chatroom/identity"
+	"chatroom/model"
+	"chatroom/store"
+	"chatroom/utils"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"sync"
+)
+
+const (
+	privacyBucket = "privacy"
+	// allRooms 在所有房间退出
+	allRooms = "*"
+)
+
+// placeholderMessage bridges the placeholder instead of the content of an opted out user.
+type placeholderMessage struct {
+	model.IChatMessage
+	text string
+}
+
+func (p *placeholderMessage) Text() string {
+	return p.text
+}
+
+func (p *placeholderMessage) RawText() string {
+	return p.text
+}
+
+func (p *placeholderMessage) Attachment() []model.Attachment {
+	return nil
+}
+
+func (p *placeholderMessage) Mentions() []model.Mention {
+	return nil
+}
+
+// newPrivacy merges the privacy of the room with the global one.
+func newPrivacy(global, room conf.Privacy) conf.Privacy {
+	return conf.Privacy{
+		OptOut:      append(slices.Clone(global.OptOut), room.OptOut...),
+		Placeholder: utils.Default(room.Placeholder, func(v string) bool { return len(v) != 0 }, global.Placeholder),
+		Anonymize:   global.Anonymize || room.Anonymize,
+	}
+}
+
+func optOutKey(room string, account identity.Account) string {
+	return fmt.Sprintf("%s|%s", room, account)
+}
+
+// OptOut stops bridging the messages of the user in the room, or in every room when the room is empty.
+func OptOut(room string, account identity.Account) error {
+	return store.Put(privacyBucket, optOutKey(utils.Default(room, func(v string) bool { return len(v) != 0 }, allRooms), account), true)
+}
+
+// OptIn bridges the messages of the user in the room again, or in every room when the room is empty.
+func OptIn(room string, account identity.Account) error {
+	if len(room) != 0 {
+		return store.Delete(privacyBucket, optOutKey(room, account))
+	}
+	for _, key := range store.Keys(privacyBucket, "") {
+		if strings.HasSuffix(key, "|"+account.String()) {
+			if err := store.Delete(privacyBucket, key); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// optedOut reports whether the user, or an account linked to the user, opted out of the room.
+func (c *ChatRoom) optedOut(account identity.Account) bool {
+	for _, a := range identity.Linked(account) {
+		if slices.ContainsFunc(c.privacy.OptOut, func(v string) bool { return strings.EqualFold(v, a.String()) }) {
+			return true
+		}
+		var v bool
+		if store.Get(privacyBucket, optOutKey(c.Name, a), &v) || store.Get(privacyBucket, optOutKey(allRooms, a), &v) {
+			return true
+		}
+	}
+	return false
+}
+
+// protect drops the messages of the opted out users, or replaces their content with the placeholder.
+func (c *ChatRoom) protect(msg model.IChatMessage) (model.IChatMessage, bool) {
+	user := msg.BelongUser()
+	if user == nil || len(user.UID()) == 0 || !c.optedOut(identity.Account{Source: msg.Source(), UserID: user.UID()}) {
+		return msg, true
+	}
+	if len(c.privacy.Placeholder) == 0 || !hasText(msg) {
+		return msg, false
+	}
+	return &placeholderMessage{IChatMessage: msg, text: c.privacy.Placeholder}, true
+}
+
+// sender returns the message with the sender shown on the other platforms, the anonymous name
+// of the person when the room is anonymized, otherwise the configured name of the linked person.
+func (c *ChatRoom) sender(msg model.IChatMessage) model.IChatMessage {
+	user := msg.BelongUser()
+	if user == nil {
+		return msg
+	}
+	account := identity.Account{Source: msg.Source(), UserID: user.UID()}
+	var name string
+	if c.privacy.Anonymize {
+		name = anonymous(account)
+	} else if name = identity.Name(account); len(name) == 0 {
+		return msg
+	}
+	return &senderMessage{IChatMessage: msg, user: &model.User{ID: user.UID(), Name: name, DisplayName: name, BotID: utils.IfElse(user.IsBot(), user.UID(), "")}}
+}
+
+// anonymous returns the same name for the linked accounts of a person, the names are keyed by a
+// random salt so they can not be computed back from the user ids.
+func anonymous(account identity.Account) string {
+	mac := hmac.New(sha256.New, anonymousSalt())
+	mac.Write([]byte(identity.Linked(account)[0].String()))
+	return "Anonymous-" + hex.EncodeToString(mac.Sum(nil)[:3])
+}
+
+var (
+	salt     []byte
+	saltOnce sync.Once
+)
+
+func anonymousSalt() []byte {
+	saltOnce.Do(func() {
+		var v string
+		if store.Get(privacyBucket, "salt", &v) {
+			salt, _ = hex.DecodeString(v)
+		}
+		if len(salt) != 0 {
+			return
+		}
+		salt = make([]byte, 16)
+		_, _ = rand.Read(salt)
+		if err := store.Put(privacyBucket, "salt", hex.EncodeToString(salt)); err != nil {
+			log.Printf("failed to save the anonymous salt: %v", err)
+		}
+	})
+	return salt
+}
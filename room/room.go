@@ -7,6 +7,7 @@ import (
 	"chatroom/chat/telegram"
 	"chatroom/conf"
 	"chatroom/emoji"
+	"chatroom/format"
 	"chatroom/model"
 	"chatroom/utils"
 	"chatroom/utils/queue"
@@ -14,12 +15,18 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"slices"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type IChat interface {
 	ChannelID() string
 	Source() model.TypeSource
+	Connected() bool
+	// Members returns the names of the cached members of the chat.
+	Members() []string
 	SendMessage(model.IChatMessage) (string, error)
 	SendReplyMessage(string, model.IChatMessage) (string, error)
 	UpdateMessage(messageID string, message model.IChatMessage) error
@@ -33,195 +40,375 @@ type ChatRoom struct {
 	Name        string
 	Room        []IChat
 	Receive     chan model.IChatMessage
-	MessageList *queue.List[MessageTuple]
-	log         *log.Logger
+	MessageList *queue.List[*MessageTuple]
+	Pipeline    Pipeline
+	LoopCheck   *LoopDetector
+	Outbox      map[string]*Outbox
+	pending     []*pendingMessage
+	pendingTTL  time.Duration
+	privacy     conf.Privacy
+	members     conf.Members
+	delivery    conf.Delivery
+	// memberEvents 汇总模式下等待发送的成员变化
+	memberEvents []model.IChatMessage
+	memberFlush  time.Time
+	// lastTyping 各目标上次显示输入状态的时间, 只在 Loop 中访问
+	lastTyping     map[string]time.Time
+	typingInterval time.Duration
+	// pollFlush 上次更新投票结果的时间, 只在 Loop 中访问
+	pollFlush    time.Time
+	pollInterval time.Duration
+	// paused 暂停整个房间, pausedChat 暂停单个 chat 的收发
+	paused     atomic.Bool
+	pausedChat map[string]bool
+	pauseLock  sync.RWMutex
+	// dirty 消息映射有变化, 定期保存以便重启后跳过重复消息
+	dirty atomic.Bool
+	// ctx 控制投递, 停止接收消息后仍然有效直到排空或超时
+	ctx  context.Context
+	stop context.CancelFunc
+	log  *log.Logger
 }
 
-func NewMainRoom(ctx context.Context) {
-	var rooms []*ChatRoom
+var (
+	rooms     []*ChatRoom
+	roomsLock sync.RWMutex
+)
+
+// Rooms returns the running rooms.
+func Rooms() []*ChatRoom {
+	roomsLock.RLock()
+	defer roomsLock.RUnlock()
+	return rooms
+}
+
+// NewMainRoom runs the rooms until the context is done, it returns false when a room did not shut down cleanly.
+func NewMainRoom(ctx context.Context) bool {
+	roomsLock.Lock()
 	for _, room := range conf.Conf.Room {
 		rooms = append(rooms, NewChatRoom(ctx, room))
 	}
+	roomsLock.Unlock()
 	wg := new(sync.WaitGroup)
+	var unclean atomic.Bool
 	for i := range rooms {
 		wg.Add(1)
 		go func(r *ChatRoom) {
-			r.Loop(ctx)
-			wg.Done()
+			defer wg.Done()
+			if !r.Loop(ctx) {
+				unclean.Store(true)
+			}
 		}(rooms[i])
 	}
 	log.Println("chatroom bridge running...")
 	wg.Wait()
+	return !unclean.Load()
 }
 
 func NewChatRoom(_ context.Context, chat conf.Room) *ChatRoom {
 	room := new(ChatRoom)
 	room.Name = chat.Name
-	room.MessageList = queue.NewMessageList[MessageTuple](500)
+	room.ctx, room.stop = context.WithCancel(context.Background())
+	room.pendingTTL = utils.Default(conf.Conf.Receive.PendingTTL, func(v time.Duration) bool { return v > 0 }, 30*time.Second)
+	room.MessageList = queue.NewMessageList[*MessageTuple](500)
 	room.log = log.New(os.Stdout, fmt.Sprintf("Room: [%s]: ", room.Name), log.Lshortfile|log.Ldate|log.Ltime)
 	room.Receive = make(chan model.IChatMessage, 100*len(chat.Chat))
+	pipeline, err := NewPipeline(chat.Filter)
+	if err != nil {
+		room.log.Fatalf("failed to init filter. err: %s\n", err.Error())
+	}
+	room.Pipeline = pipeline
+	room.privacy = newPrivacy(conf.Conf.Privacy, chat.Privacy)
+	room.members = chat.Members
+	room.delivery = chat.Delivery
+	room.delivery.Failure = utils.Default(chat.Delivery.Failure, func(v string) bool { return len(v) != 0 }, "⚠️")
+	room.members.Interval = utils.Default(chat.Members.Interval, func(v time.Duration) bool { return v > 0 }, 10*time.Minute)
+	room.memberFlush = time.Now()
+	room.lastTyping = make(map[string]time.Time)
+	room.typingInterval = utils.Default(conf.Conf.Typing.Interval, func(v time.Duration) bool { return v != 0 }, 5*time.Second)
+	room.pollInterval = utils.Default(conf.Conf.Poll.Interval, func(v time.Duration) bool { return v > 0 }, 30*time.Second)
+	room.LoopCheck = NewLoopDetector(conf.Conf.Loop)
+	room.Outbox = make(map[string]*Outbox)
+	room.pausedChat = make(map[string]bool)
+	tpl := func(source model.TypeSource, id string) *format.Template {
+		t, err := format.ForChat(chat.Template, conf.Conf.Template, source, id)
+		if err != nil {
+			room.log.Fatalf("failed to parse the template of [%s:%s]. err: %s\n", source, id, err.Error())
+		}
+		room.LoopCheck.AddTemplate(t)
+		return t
+	}
 	for _, roomChat := range chat.Chat {
 		for _, id := range roomChat.ChatID {
 			switch roomChat.Type {
 			case "slack":
-				room.Room = append(room.Room, slack.NewSlackChat(id, room.Receive))
+				room.Room = append(room.Room, slack.NewSlackChat(id, room.Receive, tpl(model.SlackType, id)))
 			case "discord":
-				room.Room = append(room.Room, discord.NewDiscordChat(id, room.Receive))
+				room.Room = append(room.Room, discord.NewDiscordChat(id, room.Receive, tpl(model.DiscordType, id)))
 			case "telegram":
-				room.Room = append(room.Room, telegram.NewTelegramChat(id, room.Receive))
+				room.Room = append(room.Room, telegram.NewTelegramChat(id, room.Receive, tpl(model.TelegramType, id)))
 			case "matrix":
-				room.Room = append(room.Room, matrix.NewMatrixChat(id, room.Receive))
+				room.Room = append(room.Room, matrix.NewMatrixChat(id, room.Receive, tpl(model.MatrixType, id)))
 			}
 		}
 	}
+	for _, chat := range room.Room {
+		o := NewOutbox(room.ctx, room.Name, chat, conf.Conf.Outbox, room.log)
+		o.recorded = func() { room.dirty.Store(true) }
+		o.restore = func(job *Job) *task { return room.restore(job) }
+		room.Outbox[targetKey(chat)] = o
+	}
+	room.loadMessages()
 	return room
 }
 
-func (c *ChatRoom) Loop(ctx context.Context) {
+// Loop dispatches the received messages until the context is done and then drains the room.
+func (c *ChatRoom) Loop(ctx context.Context) bool {
+	for _, chat := range c.Room {
+		go c.OutboxOf(chat).Run()
+	}
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
 	for {
 		select {
 		case <-ctx.Done():
-			return
+			return c.shutdown()
 		case msg := <-c.Receive:
 			c.Dispatch(msg)
+		case <-ticker.C:
+			c.expire()
+			c.flushMembers(false)
+			c.flushPolls(false)
+			if c.dirty.Swap(false) {
+				c.saveMessages()
+			}
 		}
 	}
 }
 
+// Dispatch resolves the message in arrival order and queues it to every target, the targets deliver concurrently.
+// The message is acked once its tasks are persisted in the outbox.
 func (c *ChatRoom) Dispatch(msg model.IChatMessage) {
-	// 过滤消息的来源 channel
+	// 投递已写入 outbox 或消息被丢弃后, 来源才能移动接收位置
+	if r, ok := msg.(model.Acked); ok {
+		defer r.Ack()
+	}
+	// 命令在暂停时也要执行, 否则无法恢复
+	if c.command(msg) {
+		return
+	}
+	if c.Paused("") || c.Paused(fmt.Sprintf("%s:%s", msg.Source(), msg.BelongChannel().CID())) {
+		c.log.Printf("message dropped by pause, from: [%s] channel [%s] messageID: [%s]", msg.Source(), msg.BelongChannel().CID(), msg.MessageID())
+		return
+	}
+	if model.IsMemberEvent(msg.MessageType()) {
+		c.member(msg)
+		return
+	}
+	if msg.MessageType() == model.MessageTypeTyping {
+		c.typing(msg)
+		return
+	}
+	if msg.MessageType() == model.MessageTypePollVote {
+		c.vote(msg)
+		return
+	}
+	hops, ok := c.checkLoop(msg)
+	if !ok {
+		return
+	}
+	env, ok := c.Pipeline.Process(msg)
+	if !ok {
+		c.log.Printf("message dropped by filter, from: [%s] channel [%s] messageID: [%s]", msg.Source(), msg.BelongChannel().CID(), msg.MessageID())
+		return
+	}
+	msg, ok = c.protect(env.Message)
+	if !ok {
+		c.log.Printf("message dropped by opt-out, from: [%s] channel [%s] messageID: [%s]", msg.Source(), msg.BelongChannel().CID(), msg.MessageID())
+		return
+	}
+	c.LoopCheck.Remember(msg)
+	msg = &bridgedMessage{IChatMessage: c.sender(c.LoopCheck.Mark(msg, hops+1)), at: time.Now(), poll: model.PollOf(msg)}
+	// 过滤消息的来源 channel 和暂停的 chat
 	room := utils.FilterSlice(c.Room, func(chat IChat) bool {
-		return chat.Source() == msg.Source() && chat.ChannelID() == msg.BelongChannel().CID()
+		return chat.Source() == msg.Source() && chat.ChannelID() == msg.BelongChannel().CID() || c.Paused(targetKey(chat))
 	})
+	if len(env.Targets) != 0 {
+		room = utils.FilterSlice(room, func(chat IChat) bool {
+			return !slices.Contains(env.Targets, chat.ChannelID())
+		})
+	}
+	room = c.extend(msg, room, env.Extra)
+	fresh := c.SearchMessage(msg.Source(), msg.BelongChannel().CID(), msg.MessageID()) == nil
+	if len(env.Annotations) != 0 {
+		c.log.Printf("message annotations: %v", env.Annotations)
+	}
 	defer func() {
 		c.log.Printf("message queue: %s", c.MessageList.String())
 	}()
+	if !c.route(msg, room) {
+		c.hold(msg, room)
+	}
+	if fresh {
+		c.copyOut(msg, env.Extra)
+	}
+}
+
+// extend adds the chats of the room which the filters name as extra targets, e.g. one left out by route.
+func (c *ChatRoom) extend(msg model.IChatMessage, room []IChat, ids []string) []IChat {
+	for _, chat := range c.Room {
+		if !slices.ContainsFunc(ids, func(id string) bool { return isChat(chat, id) }) || slices.Contains(room, chat) {
+			continue
+		}
+		if chat.Source() == msg.Source() && chat.ChannelID() == msg.BelongChannel().CID() || c.Paused(targetKey(chat)) {
+			continue
+		}
+		room = append(room, chat)
+	}
+	return room
+}
+
+// copyOut queues a copy of a new message to the extra targets which belong to the other rooms. The copies are not
+// recorded, edits, deletes and reactions do not follow them.
+func (c *ChatRoom) copyOut(msg model.IChatMessage, ids []string) {
+	if len(ids) == 0 || msg.MessageType() != model.MessageTypeTextCreate && msg.MessageType() != model.MessageTypeTextReply {
+		return
+	}
+	for _, r := range Rooms() {
+		if r == c || r.Paused("") {
+			continue
+		}
+		for _, chat := range r.Room {
+			if !slices.ContainsFunc(ids, func(id string) bool { return isChat(chat, id) }) || r.Paused(targetKey(chat)) {
+				continue
+			}
+			c.log.Printf("copy message to [%s] of room [%s], messageID: [%s]", chat.ChannelID(), r.Name, msg.MessageID())
+			// 不阻塞当前房间
+			r.offer(chat, &task{op: OpSend, msg: msg})
+		}
+	}
+}
+
+// isChat reports whether the id names the chat, by chat id or by "platform:chatID".
+func isChat(chat IChat, id string) bool {
+	return chat.ChannelID() == id || targetKey(chat) == id
+}
+
+// route queues the message to the target chats, it returns false when the message it belongs to is not known yet.
+func (c *ChatRoom) route(msg model.IChatMessage, room []IChat) bool {
 	switch msg.MessageType() {
-	case model.MessageTypeTextCreate:
-		var tuple = MessageTuple{Type: msg.MessageType(), Message: []MessageRecord{{ID: msg.MessageID(), ChannelID: msg.BelongChannel().CID(), Source: msg.Source()}}}
+	case model.MessageTypeTextCreate, model.MessageTypePoll:
+		if c.SearchMessage(msg.Source(), msg.BelongChannel().CID(), msg.MessageID()) != nil {
+			c.log.Printf("message already dispatched [%s] channel [%s] messageID: [%s]", msg.Source(), msg.BelongChannel().CID(), msg.MessageID())
+			break
+		}
+		var tuple = NewMessageTuple(msg)
+		// 投票记录各平台的票数, 没有原生投票的平台用表情投票
+		poll := model.PollOf(msg)
+		if poll != nil {
+			tuple.poll = newPollTally(msg)
+		}
+		c.MessageList.Push(tuple)
+		c.dirty.Store(true)
+		d := c.track(tuple, msg, room)
 		for _, chat := range room {
 			c.log.Printf("dispatch message to [%s], from: %s %s %s", chat.ChannelID(), msg.BelongChannel().CName(), msg.BelongUser().UName(), msg.Text())
-			id, err := chat.SendMessage(msg)
-			if err != nil {
-				c.log.Printf("send message to [%s] failed, from: %s %s %s", chat.ChannelID(), msg.BelongChannel().CName(), msg.BelongUser().UName(), msg.Text())
+			if _, ok := chat.(Poller); ok && poll != nil {
+				c.enqueue(chat, &task{op: OpPoll, record: tuple, msg: msg, done: d.report})
+				continue
+			}
+			c.enqueue(chat, &task{op: OpSend, record: tuple, msg: msg, done: d.report})
+			// 没有原生投票的平台用数字表情投票
+			for i := 0; poll != nil && i < min(len(poll.Options), len(model.PollKeys)); i++ {
+				c.enqueue(chat, &task{op: OpReactionAdd, origin: tuple, emoji: emoji.Convert(model.DiscordType, chat.Source(), model.PollKeys[i]), msg: msg})
 			}
-			tuple.Message = append(tuple.Message, MessageRecord{ID: id, ChannelID: chat.ChannelID(), Source: chat.Source()})
 		}
-		c.MessageList.Push(tuple)
+		c.release()
 		// 回执
 	case model.MessageTypeTextUpdate:
 		origin := c.SearchMessage(msg.Source(), msg.BelongChannel().CID(), msg.MessageID())
 		if origin == nil {
-			origin = new(MessageTuple)
-			c.log.Printf("update message failed,not found [%s] channel [%s] messageID: [%s]\n", msg.Source(), msg.BelongChannel().CID(), msg.MessageID())
-			//return
+			return false
 		}
 		for _, chat := range room {
-			messageID := origin.FindMessageID(chat.Source(), chat.ChannelID())
-			err := chat.UpdateMessage(messageID, msg)
-			if err != nil {
-				c.log.Printf("failed to update [%s] message, id: [%s], %v", chat.ChannelID(), messageID, err)
-			}
+			c.enqueue(chat, &task{op: OpUpdate, origin: origin, msg: msg})
 		}
 	case model.MessageTypeTextDelete:
 		origin := c.SearchMessageDelete(msg.Source(), msg.BelongChannel().CID(), msg.MessageID())
 		if origin == nil {
-			c.log.Printf("delete message failed,not found [%s] channel [%s] messageID: [%s]\n", msg.Source(), msg.BelongChannel().CID(), msg.MessageID())
-			return
+			return false
 		}
 		for _, chat := range room {
-			messageID := origin.FindMessageID(chat.Source(), chat.ChannelID())
-			if len(messageID) == 0 {
-				c.log.Printf("delete [%s] message failed,not found channel [%s] messageID\n", chat.Source(), chat.ChannelID())
-				continue
-			}
-			err := chat.DeleteMessage(messageID)
-			if err != nil {
-				c.log.Printf("failed to delete [%s] message, id: [%s], %v", chat.ChannelID(), messageID, err)
-			}
+			c.enqueue(chat, &task{op: OpDelete, origin: origin, msg: msg})
 		}
 		origin.Delete()
+		c.dirty.Store(true)
 	case model.MessageTypeTextReply:
+		if c.SearchMessage(msg.Source(), msg.BelongChannel().CID(), msg.MessageID()) != nil {
+			c.log.Printf("message already dispatched [%s] channel [%s] messageID: [%s]", msg.Source(), msg.BelongChannel().CID(), msg.MessageID())
+			break
+		}
 		origin := c.SearchMessage(msg.Source(), msg.BelongChannel().CID(), msg.ParentMessageID())
-		if origin == nil {
+		found := origin != nil
+		if !found {
 			origin = new(MessageTuple)
 			c.log.Printf("reply message failed,not found [%s] channel [%s] messageID: [%s]\n", msg.Source(), msg.BelongChannel().CID(), msg.MessageID())
 			//return
 		}
-		tuple := MessageTuple{Type: msg.MessageType(), Message: []MessageRecord{{ID: msg.MessageID(), ChannelID: msg.BelongChannel().CID(), Source: msg.Source()}}}
-		for _, chat := range room {
-			messageID := origin.FindMessageID(chat.Source(), chat.ChannelID())
-			if len(messageID) == 0 {
-				c.log.Printf("reply [%s] message failed,not found channel [%s] messageID\n", chat.Source(), chat.ChannelID())
-				//continue
+		tuple := NewMessageTuple(msg)
+		if found {
+			origin.AddChild(tuple)
+			if b, ok := msg.(*bridgedMessage); ok {
+				b.reply = origin.Preview
 			}
-			c.log.Printf("dispatch message to [%s], from: %s %s %s", chat.ChannelID(), msg.BelongChannel().CName(), msg.BelongUser().UName(), msg.Text())
-			id, _ := chat.SendReplyMessage(messageID, msg)
-			tuple.Message = append(tuple.Message, MessageRecord{ID: id, ChannelID: chat.ChannelID(), Source: chat.Source()})
-		}
-		if len(origin.Message) != 0 {
-			origin.AddChild(&tuple)
 		}
 		c.MessageList.Push(tuple)
-	case model.MessageTypeActionAdd:
+		c.dirty.Store(true)
+		d := c.track(tuple, msg, room)
+		for _, chat := range room {
+			c.log.Printf("dispatch message to [%s], from: %s %s %s", chat.ChannelID(), msg.BelongChannel().CName(), msg.BelongUser().UName(), msg.Text())
+			c.enqueue(chat, &task{op: OpReply, origin: origin, record: tuple, msg: msg, done: d.report})
+		}
+		c.release()
+	case model.MessageTypeActionAdd, model.MessageTypeActionRemove:
+		op := utils.IfElse(msg.MessageType() == model.MessageTypeActionAdd, OpReactionAdd, OpReactionRemove)
 		origin := c.SearchMessage(msg.Source(), msg.BelongChannel().CID(), msg.MessageID())
 		if origin == nil {
-			c.log.Printf("add reaction failed,not found [%s] channel [%s] messageID: [%s]\n", msg.Source(), msg.BelongChannel().CID(), msg.MessageID())
-			return
+			return false
+		}
+		if origin.poll != nil && c.pollReaction(origin, msg) {
+			break
 		}
 		for _, chat := range room {
-			messageID := origin.FindMessageID(chat.Source(), chat.ChannelID())
-			if len(messageID) == 0 {
-				c.log.Printf("add reaction [%s] failed,not found channel [%s] messageID\n", chat.Source(), chat.ChannelID())
-				continue
-			}
 			emojiID := emoji.Convert(msg.Source(), chat.Source(), msg.Emoji())
 			if len(emojiID) == 0 {
-				c.log.Printf("add reaction [%s] failed,not found channel [%s] messageID\n", chat.Source(), chat.ChannelID())
+				c.log.Printf("%s [%s] failed,not found emoji [%s] for channel [%s]\n", op, chat.Source(), msg.Emoji(), chat.ChannelID())
 				continue
 			}
-			if err := chat.SendReaction(messageID, emojiID); err != nil {
-				c.log.Printf("failed to send [%s] id:[%s] reaction, %v", chat.ChannelID(), messageID, err)
-			}
+			c.enqueue(chat, &task{op: op, origin: origin, emoji: emojiID, msg: msg})
 		}
-	case model.MessageTypeActionRemove:
+	case model.MessageTypeActionRemoveALL:
 		origin := c.SearchMessage(msg.Source(), msg.BelongChannel().CID(), msg.MessageID())
 		if origin == nil {
-			c.log.Printf("remove reaction failed,not found [%s] channel [%s] messageID: [%s]\n", msg.Source(), msg.BelongChannel().CID(), msg.MessageID())
-			return
+			return false
 		}
 		for _, chat := range room {
-			messageID := origin.FindMessageID(chat.Source(), chat.ChannelID())
-			if len(messageID) == 0 {
-				c.log.Printf("remove reaction [%s] failed,not found channel [%s] messageID\n", chat.Source(), chat.ChannelID())
-				continue
-			}
-			emojiID := emoji.Convert(msg.Source(), chat.Source(), msg.Emoji())
-			if len(emojiID) == 0 {
-				c.log.Printf("remove reaction [%s] failed,not found channel [%s] messageID\n", chat.Source(), chat.ChannelID())
-				continue
-			}
-			if err := chat.RemoveReaction(messageID, emojiID); err != nil {
-				c.log.Printf("failed to remove [%s] id:[%s] reaction, %v", chat.ChannelID(), messageID, err)
-			}
+			c.enqueue(chat, &task{op: OpReactionRemoveAll, origin: origin, msg: msg})
 		}
-	case model.MessageTypeActionRemoveALL:
+	case model.MessageTypePin, model.MessageTypeUnpin:
+		op := utils.IfElse(msg.MessageType() == model.MessageTypePin, OpPin, OpUnpin)
 		origin := c.SearchMessage(msg.Source(), msg.BelongChannel().CID(), msg.MessageID())
 		if origin == nil {
-			c.log.Printf("remove all reaction failed,not found [%s] channel [%s] messageID: [%s]\n", msg.Source(), msg.BelongChannel().CID(), msg.MessageID())
-			return
+			return false
 		}
 		for _, chat := range room {
-			messageID := origin.FindMessageID(chat.Source(), chat.ChannelID())
-			if len(messageID) == 0 {
-				c.log.Printf("remove all reaction [%s] failed,not found channel [%s] messageID\n", chat.Source(), chat.ChannelID())
+			if _, ok := chat.(Pinner); !ok {
 				continue
 			}
-			if err := chat.RemoveReactionAll(messageID); err != nil {
-				c.log.Printf("failed to remove [%s] id:[%s] all reaction, %v", chat.ChannelID(), messageID, err)
-			}
+			c.enqueue(chat, &task{op: op, origin: origin, msg: msg})
 		}
 	}
+	return true
 }
 
 func (c *ChatRoom) SearchMessage(source model.TypeSource, channelID, messageID string) *MessageTuple {
@@ -233,23 +420,89 @@ func (c *ChatRoom) SearchMessage(source model.TypeSource, channelID, messageID s
 	//	}
 	//	return false
 	//})
-	return c.MessageList.SearchFunc(func(v MessageTuple) bool {
-		for _, record := range v.Message {
-			if record.Source == source && record.ChannelID == channelID && record.ID == messageID {
-				return true
-			}
-		}
-		return false
-	})
+	if v := c.MessageList.SearchFunc(func(v *MessageTuple) bool {
+		return v.Has(source, channelID, messageID)
+	}); v != nil {
+		return *v
+	}
+	return nil
 }
 
 func (c *ChatRoom) SearchMessageDelete(source model.TypeSource, channelID, messageID string) *MessageTuple {
-	return c.MessageList.DeleteFunc(func(v MessageTuple) bool {
-		for _, record := range v.Message {
-			if record.Source == source && record.ChannelID == channelID && record.ID == messageID {
-				return true
-			}
+	if v := c.MessageList.DeleteFunc(func(v *MessageTuple) bool {
+		return v.Has(source, channelID, messageID)
+	}); v != nil {
+		return *v
+	}
+	return nil
+}
+
+func (c *ChatRoom) OutboxOf(chat IChat) *Outbox {
+	return c.Outbox[targetKey(chat)]
+}
+
+func (c *ChatRoom) enqueue(chat IChat, t *task) {
+	if !c.OutboxOf(chat).enqueue(t) {
+		c.log.Printf("%s to [%s] canceled, messageID: [%s]", t.op, chat.ChannelID(), t.msg.MessageID())
+	}
+}
+
+// offer queues a task from the worker of another target, it is dropped when the queue of the chat is full.
+func (c *ChatRoom) offer(chat IChat, t *task) {
+	if !c.OutboxOf(chat).offer(t) {
+		c.log.Printf("%s to [%s] dropped, messageID: [%s]", t.op, chat.ChannelID(), t.msg.MessageID())
+	}
+}
+
+// restore rebuilds the task of a job left by the previous run from the saved message mapping, it runs on the
+// worker of the target. The sent messages are recorded again and their delivery status is updated.
+func (c *ChatRoom) restore(job *Job) *task {
+	t := &task{op: job.Op, emoji: job.Emoji, msg: job.msg, job: job}
+	if job.Origin != nil {
+		// 找不到时沿用已解析的 id, 回复没有 id 时不引用原消息
+		if origin := c.SearchMessage(job.Origin.Source, job.Origin.ChannelID, job.Origin.ID); origin != nil {
+			t.origin = origin
+		} else if len(job.MessageID) == 0 {
+			t.origin = new(MessageTuple)
 		}
-		return false
-	})
+	}
+	if job.Record {
+		msg := job.Message
+		tuple := c.SearchMessage(msg.Source(), msg.BelongChannel().CID(), msg.MessageID())
+		if tuple == nil {
+			tuple = NewMessageTuple(msg)
+			c.MessageList.Push(tuple)
+		}
+		t.record = tuple
+		t.done = func(target string, err error) { tuple.SetStatus(target, deliveryStatus(err)) }
+	}
+	return t
+}
+
+// checkLoop drops the messages produced by a bridge and mutes the channel when it keeps looping.
+func (c *ChatRoom) checkLoop(msg model.IChatMessage) (int, bool) {
+	key := fmt.Sprintf("%s:%s", msg.Source(), msg.BelongChannel().CID())
+	if c.LoopCheck.Muted(key) {
+		return 0, false
+	}
+	hops, reason := c.LoopCheck.Check(msg)
+	if len(reason) == 0 {
+		return hops, true
+	}
+	c.log.Printf("suspected bridge loop, %s, from: [%s] channel [%s] messageID: [%s] hops: %d", reason, msg.Source(), msg.BelongChannel().CID(), msg.MessageID(), hops)
+	if c.LoopCheck.Suspect(key) {
+		c.log.Printf("ALERT: bridge loop on [%s] channel [%s], muted for %s", msg.Source(), msg.BelongChannel().CID(), c.LoopCheck.Cooldown())
+		c.notice(msg.Source(), msg.BelongChannel(), fmt.Sprintf("Bridge loop detected, this channel is not bridged for %s.", c.LoopCheck.Cooldown()))
+	}
+	return hops, false
+}
+
+// notice queues a bridge message to the given chat of the room, it is delivered by the outbox of the chat.
+func (c *ChatRoom) notice(source model.TypeSource, channel model.IChannelInfo, text string) {
+	for _, chat := range c.Room {
+		if chat.Source() != source || chat.ChannelID() != channel.CID() {
+			continue
+		}
+		c.enqueue(chat, &task{op: OpSend, msg: model.NewNoticeMessage(source, channel, text)})
+	}
 }
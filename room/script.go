@@ -0,0 +1,238 @@
+package room
+
+import (
+	"chatroom/conf"
+	"chatroom/model"
+	"chatroom/utils"
+	"fmt"
+	"log"
+	"os"
+	"runtime/metrics"
+	"time"
+
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+	"go.starlark.net/syntax"
+)
+
+const (
+	scriptEntry           = "transform"
+	defaultScriptTimeout  = time.Second
+	defaultScriptMaxSteps = 1_000_000
+	defaultScriptMaxSize  = 64 * 1024
+	// 堆是整个进程共享的, 内存限制只是近似值, 采样间隔不必太短
+	heapMetric         = "/memory/classes/heap/objects:bytes"
+	heapSampleInterval = 50 * time.Millisecond
+)
+
+func init() {
+	RegisterMiddleware("script", newScript)
+}
+
+// script runs a starlark transform(msg) function for every message.
+// The function returns None to keep the message, False to drop it,
+// a string to replace the text, or a dict with the keys text, drop and targets, the extra chats.
+// A failed script drops the message unless onError is forward, so a script which redacts the text is not
+// bypassed when it hits its limits.
+type script struct {
+	name      string
+	fn        starlark.Callable
+	timeout   time.Duration
+	maxSteps  uint64
+	maxSize   int
+	maxMemory uint64
+	forward   bool
+}
+
+func newScript(f conf.Filter) (Middleware, error) {
+	src, err := os.ReadFile(f.Script)
+	if err != nil {
+		return nil, err
+	}
+	s := &script{
+		name:      f.Script,
+		timeout:   f.Timeout,
+		maxSteps:  f.MaxSteps,
+		maxSize:   f.MaxSize,
+		maxMemory: f.MaxMemory,
+	}
+	switch f.OnError {
+	case "", "drop":
+	case "forward":
+		s.forward = true
+	default:
+		return nil, fmt.Errorf("unknown onError %q of script %s", f.OnError, f.Script)
+	}
+	// 顶层代码和 transform 使用同样的限制
+	thread, stop := s.thread()
+	globals, err := starlark.ExecFileOptions(&syntax.FileOptions{}, thread, f.Script, src, nil)
+	stop()
+	if err != nil {
+		return nil, err
+	}
+	fn, ok := globals[scriptEntry].(starlark.Callable)
+	if !ok {
+		return nil, fmt.Errorf("script %s does not define %s(msg)", f.Script, scriptEntry)
+	}
+	globals.Freeze()
+	s.fn = fn
+	return s, nil
+}
+
+// thread creates a thread bounded by the steps, the timeout and the memory of the script, stop must be called
+// once the thread is done.
+func (s *script) thread() (*starlark.Thread, func()) {
+	thread := &starlark.Thread{
+		Name:  s.name,
+		Print: func(_ *starlark.Thread, msg string) { log.Printf("script [%s]: %s", s.name, msg) },
+	}
+	thread.SetMaxExecutionSteps(defaultScriptMaxSteps)
+	if s.maxSteps != 0 {
+		thread.SetMaxExecutionSteps(s.maxSteps)
+	}
+	timer := time.AfterFunc(s.timeoutOrDefault(), func() { thread.Cancel("timeout") })
+	if s.maxMemory == 0 {
+		return thread, func() { timer.Stop() }
+	}
+	done := make(chan struct{})
+	go s.watchMemory(thread, done)
+	return thread, func() {
+		timer.Stop()
+		close(done)
+	}
+}
+
+// watchMemory cancels the thread when the heap grows by more than the memory limit while it runs. Starlark has no
+// allocation counter, so the limit is approximate: the heap of the whole process is sampled, including what the
+// other rooms and the outbox allocate meanwhile, and the thread stops at its next step.
+func (s *script) watchMemory(thread *starlark.Thread, done chan struct{}) {
+	sample := []metrics.Sample{{Name: heapMetric}}
+	metrics.Read(sample)
+	base := sample[0].Value.Uint64()
+	ticker := time.NewTicker(heapSampleInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			metrics.Read(sample)
+			if heap := sample[0].Value.Uint64(); heap > base && heap-base > s.maxMemory {
+				thread.Cancel(fmt.Sprintf("memory limit of %d bytes exceeded", s.maxMemory))
+				return
+			}
+		}
+	}
+}
+
+func (s *script) Process(env *Envelope) bool {
+	thread, stop := s.thread()
+	defer stop()
+
+	v, err := starlark.Call(thread, s.fn, starlark.Tuple{messageValue(env.Message)}, nil)
+	if err != nil {
+		return s.fail("failed: %v", err)
+	}
+	return s.apply(env, v)
+}
+
+// fail logs why the script did not produce a result and returns whether the message is still forwarded.
+func (s *script) fail(format string, args ...any) bool {
+	log.Printf("script [%s] %s, message %s", s.name, fmt.Sprintf(format, args...), utils.IfElse(s.forward, "forwarded", "dropped"))
+	return s.forward
+}
+
+func (s *script) timeoutOrDefault() time.Duration {
+	if s.timeout > 0 {
+		return s.timeout
+	}
+	return defaultScriptTimeout
+}
+
+func (s *script) maxSizeOrDefault() int {
+	if s.maxSize > 0 {
+		return s.maxSize
+	}
+	return defaultScriptMaxSize
+}
+
+func (s *script) apply(env *Envelope, v starlark.Value) bool {
+	switch r := v.(type) {
+	case starlark.NoneType:
+		return true
+	case starlark.Bool:
+		return bool(r)
+	case starlark.String:
+		return s.rewrite(env, string(r))
+	case *starlark.Dict:
+		if drop, found, _ := r.Get(starlark.String("drop")); found && bool(drop.Truth()) {
+			return false
+		}
+		if text, found, _ := r.Get(starlark.String("text")); found {
+			str, ok := starlark.AsString(text)
+			if !ok {
+				return s.fail("returned text of type %s", text.Type())
+			}
+			if !s.rewrite(env, str) {
+				return false
+			}
+		}
+		if targets, found, _ := r.Get(starlark.String("targets")); found {
+			if list, ok := targets.(starlark.Iterable); ok {
+				iter := list.Iterate()
+				var t starlark.Value
+				for iter.Next(&t) {
+					if str, ok := starlark.AsString(t); ok {
+						env.Copy(str)
+					}
+				}
+				iter.Done()
+			}
+		}
+		return true
+	default:
+		return s.fail("returned unsupported type %s", v.Type())
+	}
+}
+
+// rewrite replaces the text, a result over the size limit counts as a failure of the script.
+func (s *script) rewrite(env *Envelope, text string) bool {
+	if len(text) > s.maxSizeOrDefault() {
+		return s.fail("result exceeds %d bytes", s.maxSizeOrDefault())
+	}
+	env.Rewrite(text, text)
+	return true
+}
+
+func messageValue(msg model.IChatMessage) starlark.Value {
+	fields := starlark.StringDict{
+		"id":        starlark.String(msg.MessageID()),
+		"type":      starlark.MakeInt(int(msg.MessageType())),
+		"source":    starlark.String(msg.Source().String()),
+		"parent_id": starlark.String(msg.ParentMessageID()),
+		"text":      starlark.String(msg.Text()),
+		"raw_text":  starlark.String(msg.RawText()),
+	}
+	if channel := msg.BelongChannel(); channel != nil {
+		fields["channel_id"] = starlark.String(channel.CID())
+		fields["channel_name"] = starlark.String(channel.CName())
+	}
+	if user := msg.BelongUser(); user != nil {
+		fields["user_id"] = starlark.String(user.UID())
+		fields["user_name"] = starlark.String(user.UName())
+		fields["is_bot"] = starlark.Bool(user.IsBot())
+	}
+	if msg.MessageType() == model.MessageTypeActionAdd || msg.MessageType() == model.MessageTypeActionRemove {
+		fields["emoji"] = starlark.String(msg.Emoji())
+	}
+	var attachments []starlark.Value
+	for _, att := range msg.Attachment() {
+		attachments = append(attachments, starlarkstruct.FromStringDict(starlarkstruct.Default, starlark.StringDict{
+			"name": starlark.String(att.Name),
+			"type": starlark.String(att.Type),
+			"url":  starlark.String(att.URL),
+		}))
+	}
+	fields["attachments"] = starlark.NewList(attachments)
+	return starlarkstruct.FromStringDict(starlarkstruct.Default, fields)
+}
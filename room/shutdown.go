@@ -0,0 +1,104 @@
+package room
+
+import (
+	"chatroom/conf"
+	"chatroom/model"
+	"chatroom/store"
+	"chatroom/utils"
+	"maps"
+	"time"
+)
+
+const messageBucket = "message"
+
+// shutdown dispatches the messages received before the intake stopped and waits for the targets to deliver them,
+// the deliveries left after the deadline stay in the outbox and are delivered on the next start.
+func (c *ChatRoom) shutdown() bool {
+	timeout := utils.Default(conf.Conf.Shutdown.Timeout, func(v time.Duration) bool { return v > 0 }, 10*time.Second)
+	c.log.Printf("shutting down, draining messages within %s", timeout)
+	deadline := time.AfterFunc(timeout, c.stop)
+	defer deadline.Stop()
+	// 适配器停止后仍可能有排队中的消息, 空闲一段时间后认为已经排空
+	for drained := false; !drained; {
+		select {
+		case msg := <-c.Receive:
+			c.Dispatch(msg)
+		case <-time.After(500 * time.Millisecond):
+			drained = true
+		case <-c.ctx.Done():
+			drained = true
+		}
+	}
+	c.flushMembers(true)
+	c.flushPolls(true)
+	for _, chat := range c.Room {
+		c.OutboxOf(chat).Close()
+	}
+	var dropped int
+	for _, chat := range c.Room {
+		dropped += c.OutboxOf(chat).Wait()
+	}
+	c.saveMessages()
+	if len(c.pending) != 0 {
+		c.log.Printf("dropped %d messages whose message was not found", len(c.pending))
+	}
+	clean := c.ctx.Err() == nil
+	c.stop()
+	if !clean {
+		c.log.Printf("shutdown deadline exceeded, %d queued deliveries left in the outbox", dropped)
+		return false
+	}
+	c.log.Println("shutdown complete")
+	return true
+}
+
+type storedTuple struct {
+	Type    model.MessageType `json:"type"`
+	Message []MessageRecord   `json:"message"`
+	// Parent is the index of the parent tuple, -1 when it has none
+	Parent  int                       `json:"parent"`
+	Preview string                    `json:"preview,omitempty"`
+	Status  map[string]DeliveryStatus `json:"status,omitempty"`
+	Poll    *storedPoll               `json:"poll,omitempty"`
+}
+
+// saveMessages persists the message mapping so that edits, replies and reactions keep working after a restart.
+func (c *ChatRoom) saveMessages() {
+	tuples := c.MessageList.Values()
+	index := make(map[*MessageTuple]int, len(tuples))
+	stored := make([]storedTuple, 0, len(tuples))
+	for i, tuple := range tuples {
+		index[tuple] = i
+		tuple.lock.RLock()
+		stored = append(stored, storedTuple{Type: tuple.Type, Message: tuple.Message, Parent: -1, Preview: tuple.Preview, Status: maps.Clone(tuple.status)})
+		tuple.lock.RUnlock()
+		if tuple.poll != nil {
+			stored[i].Poll = tuple.poll.store()
+		}
+		if parent, ok := index[tuple.Parent]; ok && tuple.Parent != nil {
+			stored[i].Parent = parent
+		}
+	}
+	if err := store.Put(messageBucket, c.Name, stored); err != nil {
+		c.log.Printf("failed to save message mapping: %v", err)
+	}
+}
+
+func (c *ChatRoom) loadMessages() {
+	var stored []storedTuple
+	if !store.Get(messageBucket, c.Name, &stored) {
+		return
+	}
+	tuples := make([]*MessageTuple, len(stored))
+	for i, v := range stored {
+		tuples[i] = &MessageTuple{Type: v.Type, Message: v.Message, Preview: v.Preview, status: v.Status}
+		if v.Poll != nil && v.Poll.Message != nil && v.Poll.Message.Poll != nil {
+			tuples[i].poll = v.Poll.load()
+		}
+		if v.Parent >= 0 && v.Parent < i {
+			tuples[v.Parent].AddChild(tuples[i])
+		}
+		c.MessageList.Push(tuples[i])
+	}
+	c.log.Printf("loaded %d message mappings", len(tuples))
+}
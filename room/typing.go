@@ -0,0 +1,40 @@
+package room
+
+import (
+	"chatroom/identity"
+	"chatroom/model"
+	"time"
+)
+
+// Typer is implemented by chats which can show the bridge typing.
+type Typer interface {
+	Typing() error
+}
+
+// typing shows the typing indicator on the other chats, at most once per interval on every target.
+// The indicator is not queued to the outbox, a late or failed indicator is useless.
+func (c *ChatRoom) typing(msg model.IChatMessage) {
+	if c.typingInterval < 0 {
+		return
+	}
+	if user := msg.BelongUser(); user == nil || user.IsBot() || c.optedOut(identity.Account{Source: msg.Source(), UserID: user.UID()}) {
+		return
+	}
+	now := time.Now()
+	for _, chat := range c.Room {
+		key := targetKey(chat)
+		if chat.Source() == msg.Source() && chat.ChannelID() == msg.BelongChannel().CID() || c.Paused(key) {
+			continue
+		}
+		t, ok := chat.(Typer)
+		if !ok || now.Sub(c.lastTyping[key]) < c.typingInterval {
+			continue
+		}
+		c.lastTyping[key] = now
+		go func() {
+			if err := t.Typing(); err != nil {
+				c.log.Printf("failed to show typing on [%s], %v", key, err)
+			}
+		}()
+	}
+}
@@ -0,0 +1,263 @@
+package server
+
+import (
+	"chatroom/chat/discord"
+	"chatroom/chat/matrix"
+	"chatroom/chat/slack"
+	"chatroom/chat/telegram"
+	"chatroom/conf"
+	"chatroom/model"
+	"chatroom/room"
+	"chatroom/utils"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var logger = log.New(os.Stdout, "Admin: ", log.Lshortfile|log.Ldate|log.Ltime)
+
+func Route() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /rooms", rooms)
+	mux.HandleFunc("POST /rooms/{room}/pause", pause(true))
+	mux.HandleFunc("POST /rooms/{room}/resume", pause(false))
+	mux.HandleFunc("POST /rooms/{room}/chats/{chat}/pause", pause(true))
+	mux.HandleFunc("POST /rooms/{room}/chats/{chat}/resume", pause(false))
+	mux.HandleFunc("POST /rooms/{room}/messages", inject)
+	mux.HandleFunc("GET /messages/{id}", message)
+	mux.HandleFunc("POST /refresh", refresh)
+	mux.HandleFunc("GET /outbox", outbox)
+	mux.HandleFunc("GET /media/telegram/{file}", telegramMedia)
+	return mux
+}
+
+// Run serves the admin api until the context is done, nothing is served without a listen address and a token.
+func Run(ctx context.Context, c conf.Admin, handler http.Handler) {
+	if len(c.Listen) == 0 {
+		return
+	}
+	if len(c.Token) == 0 {
+		logger.Println("admin api disabled, token is not configured")
+		return
+	}
+	srv := &http.Server{Addr: c.Listen, Handler: auth(c.Token, handler), ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		shutdown, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(shutdown); err != nil {
+			logger.Printf("failed to shutdown admin server: %v", err)
+		}
+	}()
+	logger.Printf("admin api listen on %s", c.Listen)
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		logger.Printf("admin api stopped: %v", err)
+	}
+}
+
+// auth rejects the requests without the bearer token, the media links are signed instead.
+func auth(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/media/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			writeError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+type chatInfo struct {
+	Key       string `json:"key"`
+	Source    string `json:"source"`
+	ChannelID string `json:"channelId"`
+	Connected bool   `json:"connected"`
+	Paused    bool   `json:"paused"`
+}
+
+type roomInfo struct {
+	Name   string     `json:"name"`
+	Paused bool       `json:"paused"`
+	Chats  []chatInfo `json:"chats"`
+}
+
+func rooms(w http.ResponseWriter, _ *http.Request) {
+	result := make([]roomInfo, 0)
+	for _, r := range room.Rooms() {
+		info := roomInfo{Name: r.Name, Paused: r.Paused(""), Chats: make([]chatInfo, 0, len(r.Room))}
+		for _, chat := range r.Room {
+			key := room.ChatKey(chat)
+			info.Chats = append(info.Chats, chatInfo{Key: key, Source: chat.Source().String(), ChannelID: chat.ChannelID(), Connected: chat.Connected(), Paused: r.Paused(key)})
+		}
+		result = append(result, info)
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+// pause pauses or resumes the room, or the chat of the room when the path has one.
+func pause(paused bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cr := findRoom(r.PathValue("room"))
+		if cr == nil {
+			writeError(w, http.StatusNotFound, "room not found")
+			return
+		}
+		key := r.PathValue("chat")
+		var err error
+		if paused {
+			err = cr.Pause(key)
+		} else {
+			err = cr.Resume(key)
+		}
+		if err != nil {
+			writeError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+type injectRequest struct {
+	Chat string `json:"chat"`
+	Text string `json:"text"`
+}
+
+// inject queues a test message to the room, it is bridged from the given chat to the others.
+func inject(w http.ResponseWriter, r *http.Request) {
+	cr := findRoom(r.PathValue("room"))
+	if cr == nil {
+		writeError(w, http.StatusNotFound, "room not found")
+		return
+	}
+	var req injectRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if len(req.Chat) == 0 || len(req.Text) == 0 {
+		writeError(w, http.StatusBadRequest, "chat and text are required")
+		return
+	}
+	msg, err := cr.Inject(req.Chat, req.Text)
+	switch {
+	case errors.Is(err, room.ErrChatNotFound):
+		writeError(w, http.StatusNotFound, err.Error())
+	case err != nil:
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+	default:
+		writeJSON(w, http.StatusAccepted, map[string]string{"id": msg.MessageID()})
+	}
+}
+
+type messageInfo struct {
+	Room    string               `json:"room"`
+	Type    model.MessageType    `json:"type"`
+	Message []room.MessageRecord `json:"message"`
+	Parent  []room.MessageRecord `json:"parent,omitempty"`
+	// Status 各目标的投递状态, key 为 chat, 例如 Slack:C0123
+	Status map[string]room.DeliveryStatus `json:"status,omitempty"`
+}
+
+// message looks up the bridged copies of a message and their delivery status by the id of any of them.
+func message(w http.ResponseWriter, r *http.Request) {
+	cr, tuple := room.FindMessage(r.PathValue("id"))
+	if tuple == nil {
+		writeError(w, http.StatusNotFound, "message not found")
+		return
+	}
+	info := messageInfo{Room: cr.Name, Type: tuple.Type, Message: tuple.Records(), Status: tuple.Status()}
+	if parent := tuple.ParentTuple(); parent != nil {
+		info.Parent = parent.Records()
+	}
+	writeJSON(w, http.StatusOK, info)
+}
+
+// refresh reloads the cached users and channels of every platform.
+func refresh(w http.ResponseWriter, _ *http.Request) {
+	wg := new(sync.WaitGroup)
+	for _, f := range []func(){slack.Refresh, discord.Refresh, telegram.Refresh, matrix.Refresh} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			f()
+		}()
+	}
+	wg.Wait()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func findRoom(name string) *room.ChatRoom {
+	for _, r := range room.Rooms() {
+		if r.Name == name {
+			return r
+		}
+	}
+	return nil
+}
+
+type outboxInfo struct {
+	Room       string     `json:"room"`
+	Target     string     `json:"target"`
+	Pending    []room.Job `json:"pending"`
+	DeadLetter []room.Job `json:"deadLetter"`
+}
+
+func outbox(w http.ResponseWriter, _ *http.Request) {
+	var result []outboxInfo
+	for _, r := range room.Rooms() {
+		for _, chat := range r.Room {
+			o := r.OutboxOf(chat)
+			result = append(result, outboxInfo{Room: r.Name, Target: o.Target(), Pending: o.Pending(), DeadLetter: o.DeadLetters()})
+		}
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+// telegramMedia streams a telegram file, the bridged links point here instead of the bot api.
+func telegramMedia(w http.ResponseWriter, r *http.Request) {
+	file := r.PathValue("file")
+	sign := utils.Sign(conf.Conf.Admin.Token, file)
+	if subtle.ConstantTimeCompare([]byte(r.URL.Query().Get("sig")), []byte(sign)) != 1 {
+		writeError(w, http.StatusForbidden, "invalid signature")
+		return
+	}
+	resp, err := telegram.File(r.Context(), file)
+	if err != nil {
+		logger.Printf("failed to get telegram file %s: %v", file, err)
+		writeError(w, http.StatusBadGateway, "failed to get the file")
+		return
+	}
+	defer resp.Body.Close()
+	for _, key := range []string{"Content-Type", "Content-Length"} {
+		if v := resp.Header.Get(key); len(v) != 0 {
+			w.Header().Set(key, v)
+		}
+	}
+	if _, err = io.Copy(w, resp.Body); err != nil {
+		logger.Printf("failed to send telegram file %s: %v", file, err)
+	}
+}
+
+func writeError(w http.ResponseWriter, code int, msg string) {
+	writeJSON(w, code, map[string]string{"error": msg})
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logger.Printf("failed to write response: %v", err)
+	}
+}
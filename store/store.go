@@ -0,0 +1,186 @@
+package store
+
+import (
+	"chatroom/conf"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Store is a small json file store, every bucket is kept in memory and written to <path>/<bucket>.json.
+// The changed buckets are written together every flush interval instead of on every change.
+type Store struct {
+	path    string
+	buckets map[string]map[string]json.RawMessage
+	// dirty 上次写入后有变化的 bucket
+	dirty map[string]bool
+	lock  sync.RWMutex
+	// flushLock 保证同一时间只有一次写入
+	flushLock sync.Mutex
+	log       *log.Logger
+}
+
+var db *Store
+
+func InitStore(c conf.Store) {
+	db = new(Store)
+	db.path = c.Path
+	db.buckets = make(map[string]map[string]json.RawMessage)
+	db.dirty = make(map[string]bool)
+	db.log = log.New(os.Stdout, "Store: ", log.Lshortfile|log.Ldate|log.Ltime)
+	if len(db.path) == 0 {
+		db.log.Println("store path is not configured, state is kept in memory only")
+		return
+	}
+	if err := os.MkdirAll(db.path, 0o755); err != nil {
+		db.log.Fatalf("failed to create store path %s: %v\n", db.path, err)
+	}
+	files, err := filepath.Glob(filepath.Join(db.path, "*.json"))
+	if err != nil {
+		db.log.Fatalf("failed to read store path %s: %v\n", db.path, err)
+	}
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			db.log.Fatalf("failed to read %s: %v\n", file, err)
+		}
+		bucket := make(map[string]json.RawMessage)
+		if err = json.Unmarshal(data, &bucket); err != nil {
+			db.log.Fatalf("failed to parse %s: %v\n", file, err)
+		}
+		db.buckets[strings.TrimSuffix(filepath.Base(file), ".json")] = bucket
+	}
+	interval := c.FlushInterval
+	if interval <= 0 {
+		interval = 200 * time.Millisecond
+	}
+	go func() {
+		for range time.Tick(interval) {
+			db.flush()
+		}
+	}()
+}
+
+// Close writes the pending changes, it is called once the rooms are drained.
+func Close() {
+	if db != nil {
+		db.flush()
+	}
+}
+
+func Get(bucket, key string, v any) bool {
+	db.lock.RLock()
+	data, ok := db.buckets[bucket][key]
+	db.lock.RUnlock()
+	if !ok {
+		return false
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		db.log.Printf("failed to decode %s/%s: %v", bucket, key, err)
+		return false
+	}
+	return true
+}
+
+// Put stores the value, the bucket is written to disk with the next flush.
+func Put(bucket, key string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	if db.buckets[bucket] == nil {
+		db.buckets[bucket] = make(map[string]json.RawMessage)
+	}
+	db.buckets[bucket][key] = data
+	db.dirty[bucket] = true
+	return nil
+}
+
+func Delete(bucket, key string) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	if _, ok := db.buckets[bucket][key]; !ok {
+		return nil
+	}
+	delete(db.buckets[bucket], key)
+	db.dirty[bucket] = true
+	return nil
+}
+
+// Keys returns the sorted keys of the bucket with the given prefix.
+func Keys(bucket, prefix string) []string {
+	db.lock.RLock()
+	var keys []string
+	for k := range db.buckets[bucket] {
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	db.lock.RUnlock()
+	sort.Strings(keys)
+	return keys
+}
+
+// flush writes the changed buckets, a bucket which failed to be written is retried with the next flush.
+func (s *Store) flush() {
+	if len(s.path) == 0 {
+		return
+	}
+	s.flushLock.Lock()
+	defer s.flushLock.Unlock()
+	s.lock.Lock()
+	data := make(map[string][]byte, len(s.dirty))
+	for bucket := range s.dirty {
+		v, err := json.Marshal(s.buckets[bucket])
+		if err != nil {
+			s.log.Printf("failed to encode %s: %v", bucket, err)
+			continue
+		}
+		data[bucket] = v
+	}
+	s.dirty = make(map[string]bool)
+	s.lock.Unlock()
+	for bucket, v := range data {
+		if err := s.write(bucket, v); err != nil {
+			s.log.Printf("failed to write %s: %v", bucket, err)
+			s.lock.Lock()
+			s.dirty[bucket] = true
+			s.lock.Unlock()
+		}
+	}
+}
+
+// write replaces the bucket file atomically, the data is synced before the rename so that a crash leaves
+// either the old or the new file.
+func (s *Store) write(bucket string, data []byte) error {
+	file := filepath.Join(s.path, bucket+".json")
+	f, err := os.OpenFile(file+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if err = os.Rename(file+".tmp", file); err != nil {
+		return err
+	}
+	dir, err := os.Open(s.path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
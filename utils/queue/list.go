@@ -4,11 +4,13 @@ import (
 	"bytes"
 	"container/list"
 	"fmt"
+	"sync"
 )
 
 type List[T any] struct {
 	inner *list.List
 	max   int
+	lock  sync.RWMutex
 }
 
 func NewMessageList[T any](m int) *List[T] {
@@ -19,6 +21,8 @@ func NewMessageList[T any](m int) *List[T] {
 }
 
 func (l *List[T]) Push(data T) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
 	if l.inner.Len() >= l.max {
 		l.inner.Remove(l.inner.Front())
 	}
@@ -26,6 +30,8 @@ func (l *List[T]) Push(data T) {
 }
 
 func (l *List[T]) SearchFunc(ok func(v T) bool) *T {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
 	for e := l.inner.Back(); e != nil; e = e.Prev() {
 		v := e.Value.(T)
 		if ok(v) {
@@ -36,6 +42,8 @@ func (l *List[T]) SearchFunc(ok func(v T) bool) *T {
 }
 
 func (l *List[T]) DeleteFunc(del func(v T) bool) *T {
+	l.lock.Lock()
+	defer l.lock.Unlock()
 	for e := l.inner.Back(); e != nil; e = e.Prev() {
 		v := e.Value.(T)
 		if del(v) {
@@ -46,7 +54,20 @@ func (l *List[T]) DeleteFunc(del func(v T) bool) *T {
 	return nil
 }
 
+// Values returns the elements from the oldest to the newest.
+func (l *List[T]) Values() []T {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	result := make([]T, 0, l.inner.Len())
+	for e := l.inner.Front(); e != nil; e = e.Next() {
+		result = append(result, e.Value.(T))
+	}
+	return result
+}
+
 func (l *List[T]) String() string {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
 	var result bytes.Buffer
 	result.WriteByte('[')
 	for e := l.inner.Front(); e != nil; {
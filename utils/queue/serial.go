@@ -0,0 +1,102 @@
+package queue
+
+import (
+	"sync"
+)
+
+// Serial runs the pushed values of the same key one by one in push order, different keys run concurrently.
+type Serial[T any] struct {
+	size    int
+	handler func(T)
+	workers map[string]chan T
+	// held 暂停的 key 在暂停期间收到的值, holds 为暂停的次数
+	held    map[string][]T
+	holds   map[string]int
+	stopped bool
+	lock    sync.Mutex
+}
+
+func NewSerial[T any](size int, handler func(T)) *Serial[T] {
+	if size <= 0 {
+		size = 100
+	}
+	return &Serial[T]{size: size, handler: handler, workers: make(map[string]chan T), held: make(map[string][]T), holds: make(map[string]int)}
+}
+
+// Push queues the value of the key, it blocks while the queue of the key is full. The values pushed after Stop
+// are dropped.
+func (s *Serial[T]) Push(key string, v T) {
+	s.lock.Lock()
+	if s.stopped {
+		s.lock.Unlock()
+		return
+	}
+	if s.holds[key] > 0 {
+		s.held[key] = append(s.held[key], v)
+		s.lock.Unlock()
+		return
+	}
+	ch := s.worker(key)
+	s.lock.Unlock()
+	ch <- v
+}
+
+// Hold keeps the values pushed to the key from now on until Release.
+func (s *Serial[T]) Hold(key string) {
+	s.lock.Lock()
+	s.holds[key]++
+	s.lock.Unlock()
+}
+
+// Release queues the values before the values held since Hold, e.g. the history of a channel before the events
+// received while it was loaded. The key is held until the last Release when Hold was called more than once.
+func (s *Serial[T]) Release(key string, values ...T) {
+	s.lock.Lock()
+	ch := s.worker(key)
+	s.lock.Unlock()
+	for _, v := range values {
+		ch <- v
+	}
+	for {
+		s.lock.Lock()
+		if s.holds[key] > 1 {
+			s.holds[key]--
+			s.lock.Unlock()
+			return
+		}
+		held := s.held[key]
+		delete(s.held, key)
+		if len(held) == 0 {
+			delete(s.holds, key)
+			s.lock.Unlock()
+			return
+		}
+		s.lock.Unlock()
+		// 发送期间新的值继续暂存, 保持顺序
+		for _, v := range held {
+			ch <- v
+		}
+	}
+}
+
+// worker returns the queue of the key, s.lock must be held.
+func (s *Serial[T]) worker(key string) chan T {
+	ch, ok := s.workers[key]
+	if !ok {
+		ch = make(chan T, s.size)
+		s.workers[key] = ch
+		go func() {
+			for v := range ch {
+				s.handler(v)
+			}
+		}()
+	}
+	return ch
+}
+
+// Stop stops accepting values, the queued values are still handled.
+func (s *Serial[T]) Stop() {
+	s.lock.Lock()
+	s.stopped = true
+	s.lock.Unlock()
+}
@@ -1,6 +1,9 @@
 package utils
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"strconv"
 	"strings"
 	"time"
@@ -85,3 +88,10 @@ func MapKeyToSlice[K comparable, V any](m map[K]V) []K {
 	}
 	return result
 }
+
+// Sign returns the hmac of the value, used for the links served without a token.
+func Sign(key, value string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil))[:32]
+}